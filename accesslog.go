@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogNone     = "none"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// Cache outcomes reported in the X-Cache header. Hits are served by the
+// bucket and never seen here.
+const (
+	cacheMiss     = "MISS"
+	cacheBypass   = "BYPASS"
+	cacheNegative = "NEGATIVE"
+)
+
+// accessLogger writes one line per request, in Apache Combined Log Format
+// (the X-Cache outcome appended) or as JSON
+type accessLogger struct {
+	format string
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+func newAccessLogger(format string, out io.Writer) *accessLogger {
+	return &accessLogger{format: format, out: out}
+}
+
+func (l *accessLogger) wrap(next http.Handler) http.Handler {
+	if l.format == accessLogNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		l.log(r, rec, start)
+	})
+}
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+	Cache      string    `json:"cache,omitempty"`
+}
+
+func (l *accessLogger) log(r *http.Request, rec *statusRecorder, start time.Time) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	e := accessLogEntry{
+		Time:       start,
+		RemoteAddr: host,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     rec.Status(),
+		Bytes:      rec.bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   float64(time.Since(start).Microseconds()) / 1000,
+		Cache:      rec.Header().Get("X-Cache"),
+	}
+
+	var line []byte
+	if l.format == accessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s\n",
+			e.RemoteAddr, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, clfBytes(e.Bytes),
+			clfQuote(e.Referer), clfQuote(e.UserAgent), clfQuote(e.Cache)))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// statusRecorder captures the final status and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// Informational responses (Early Hints) precede the real one
+	if r.status == 0 && code >= 200 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Cache", cacheMiss)
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Write([]byte("image"))
+	})
+	tests := []struct {
+		name    string
+		path    string
+		referer string
+		ua      string
+		want    *regexp.Regexp
+	}{
+		{
+			name: "image", path: "/insecure/x?w=1", referer: "https://example.com/page", ua: `Mozilla/5.0 "quoted"`,
+			want: regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /insecure/x\?w=1 HTTP/1\.1" 200 5 "https://example\.com/page" "Mozilla/5\.0 \\"quoted\\"" "MISS"\n$`),
+		},
+		{
+			name: "empty fields", path: "/missing",
+			want: regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /missing HTTP/1\.1" 404 19 "-" "-" "-"\n$`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Served for real, the recorder refuses bodies after a 103
+			var out bytes.Buffer
+			srv := httptest.NewServer(newAccessLogger(accessLogCombined, &out).wrap(handler))
+			defer srv.Close()
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			req.Header["User-Agent"] = []string{tt.ua}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			srv.Close()
+			if !tt.want.Match(out.Bytes()) {
+				t.Errorf("line %q doesn't match %s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var out bytes.Buffer
+	req := httptest.NewRequest(http.MethodHead, "/insecure/x", nil)
+	req.Header.Set("User-Agent", "curl")
+	newAccessLogger(accessLogJSON, &out).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", cacheBypass)
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	var e accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatalf("%q: %v", out.String(), err)
+	}
+	if e.RemoteAddr != "192.0.2.1" || e.Method != http.MethodHead || e.URI != "/insecure/x" || e.Status != http.StatusNoContent ||
+		e.Bytes != 0 || e.UserAgent != "curl" || e.Cache != cacheBypass || e.Time.IsZero() {
+		t.Errorf("entry = %+v", e)
+	}
+}
+
+func TestAccessLogNone(t *testing.T) {
+	var out bytes.Buffer
+	newAccessLogger(accessLogNone, &out).wrap(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if out.Len() != 0 {
+		t.Errorf("logged %q", out.String())
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type cacheStatus struct {
+	Path            string      `json:"path"`
+	Key             string      `json:"key"`
+	Exists          bool        `json:"exists"`
+	Status          int         `json:"status,omitempty"`
+	Size            int64       `json:"size,omitempty"`
+	ContentType     string      `json:"content_type,omitempty"`
+	ContentEncoding string      `json:"content_encoding,omitempty"`
+	LastModified    *time.Time  `json:"last_modified,omitempty"`
+	Provenance      *provenance `json:"provenance,omitempty"`
+	UpstreamETag    string      `json:"upstream_etag,omitempty"`
+	// SourceMismatch flags an object stored under the same key by another request
+	SourceMismatch bool `json:"source_mismatch,omitempty"`
+	// ContentKey is the CONTENT_ADDRESSED object Key points to
+	ContentKey string `json:"content_key,omitempty"`
+	// InMirror is set when the object was only found in MIRROR_S3_BUCKET
+	InMirror bool `json:"in_mirror,omitempty"`
+	// PromotedFrom is the S3_FALLBACK_FOLDERS key the object was copied from
+	PromotedFrom string `json:"promoted_from,omitempty"`
+}
+
+// requireAdminToken rejects requests that don't carry "Authorization: Bearer <ADMIN_TOKEN>"
+func requireAdminToken(cfg Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminCacheHandler reports whether the object for ?path=... is present in the bucket
+func adminCacheHandler(config func() *Config, client *s3.Client, mirror *mirror) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing path parameter"})
+			return
+		}
+		u, err := url.Parse(path)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path parameter"})
+			return
+		}
+		cfg := config()
+		lookup, err := lookupRequest(cfg, u, r.Header)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path parameter"})
+			return
+		}
+
+		// The rendered type isn't known here, so look in every folder an
+		// object may have been stored in, the former ones last
+		status := cacheStatus{Path: lookup.URL.Path}
+		keys := objectKeys(*cfg, lookup)
+		primary := len(keys)
+		keys = append(keys, fallbackKeys(*cfg, lookup)...)
+		var out *s3.HeadObjectOutput
+		found := 0
+		for i, key := range keys {
+			status.Key, found = key, i
+			out, err = client.HeadObject(r.Context(), &s3.HeadObjectInput{
+				Bucket: aws.String(cfg.S3Bucket),
+				Key:    aws.String(key),
+			})
+			if err == nil || !isNotFound(err) {
+				break
+			}
+		}
+		// Objects written while the mirror was the only working store, or
+		// since lost from the primary
+		store, bucket := client, cfg.S3Bucket
+		if err != nil && isNotFound(err) && mirror != nil {
+			for _, key := range keys[:primary] {
+				status.Key = key
+				out, err = mirror.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+					Bucket: aws.String(mirror.bucket),
+					Key:    aws.String(key),
+				})
+				if err == nil || !isNotFound(err) {
+					break
+				}
+			}
+			if err == nil {
+				status.InMirror = true
+				store, bucket = mirror.client, mirror.bucket
+			}
+		}
+		if err != nil {
+			if isNotFound(err) {
+				status.Key = keys[0]
+				writeJSON(w, http.StatusNotFound, status)
+				return
+			}
+			slog.Error("HeadObject failed", "path", path, "key", status.Key, "error", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to query bucket"})
+			return
+		}
+
+		// Objects stored before VERIFY_KEY_SOURCE was enabled can't be checked
+		stored, ok := out.Metadata[keySourceMetadataKey]
+		if cfg.VerifyKeySource && ok && stored != keySource(*cfg, lookup) {
+			status.SourceMismatch = true
+			writeJSON(w, http.StatusNotFound, status)
+			return
+		}
+
+		if found >= primary && !status.InMirror && cfg.S3FallbackPromote {
+			target := objectKey(*cfg, lookup, normalizeContentType(aws.ToString(out.ContentType)))
+			if err := promoteObject(r.Context(), client, cfg.S3Bucket, status.Key, target); err != nil {
+				slog.Error("Failed to promote object", "key", status.Key, "target", target, "error", err)
+			} else {
+				status.PromotedFrom, status.Key = status.Key, target
+			}
+		}
+
+		status.Status = storedStatus(out.Metadata)
+		// A CONTENT_ADDRESSED pointer, describe the object it points to
+		if target, ok := out.Metadata[contentKeyMetadataKey]; ok {
+			status.ContentKey = target
+			out, err = store.HeadObject(r.Context(), &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(target),
+			})
+			if err != nil {
+				if isNotFound(err) {
+					writeJSON(w, http.StatusNotFound, status)
+					return
+				}
+				slog.Error("HeadObject failed", "path", path, "key", target, "error", err)
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to query bucket"})
+				return
+			}
+		}
+
+		status.Exists = true
+		status.Size = aws.ToInt64(out.ContentLength)
+		status.ContentType = aws.ToString(out.ContentType)
+		status.ContentEncoding = aws.ToString(out.ContentEncoding)
+		status.LastModified = out.LastModified
+		status.Provenance = storedProvenance(out.Metadata)
+		status.UpstreamETag = out.Metadata[upstreamETagMetadataKey]
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// promoteObject copies an object found under a former folder to its key in
+// the current one, metadata included
+func promoteObject(ctx context.Context, client *s3.Client, bucket, from, to string) error {
+	source := &url.URL{Path: bucket + "/" + from}
+	_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(to),
+		CopySource: aws.String(source.EscapedPath()),
+	})
+	return err
+}
+
+// lookupRequest rebuilds the upstream request a GET of the public URL u
+// results in, so the same key the upload used is looked up. It fails when
+// CLEAN_PATHS rejects the path.
+func lookupRequest(cfg *Config, u *url.URL, header http.Header) (*http.Request, error) {
+	if cfg.CleanPaths {
+		if err := cleanURLPath(u); err != nil {
+			return nil, err
+		}
+	}
+	cfg.PathRewrites.apply(u)
+	cfg.CanonicalizePath.apply(u)
+	return &http.Request{Method: http.MethodGet, URL: u, Header: header}, nil
+}
+
+func isNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	return errors.As(err, &notFound) || errors.As(err, &noSuchKey)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "error", err)
+	}
+}
+
+// storedStatus returns the upstream status an object was cached from.
+// Objects uploaded before it was recorded were all 200 responses.
+func storedStatus(metadata map[string]string) int {
+	if code, err := strconv.Atoi(metadata[statusMetadataKey]); err == nil {
+		return code
+	}
+	return http.StatusOK
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listedObject struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+type objectList struct {
+	Objects []listedObject `json:"objects"`
+	// NextToken is passed back as ?token= to fetch the next page
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// adminListHandler lists the objects under the cache folder, one page per
+// request: ?prefix= narrows it (relative to S3_FOLDER), ?limit= sizes the
+// page and ?token= continues a previous listing
+func adminListHandler(config func() *Config, client *s3.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		query := r.URL.Query()
+		limit := defaultListLimit
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxListLimit)})
+				return
+			}
+			limit = n
+		}
+
+		// The type picks one of the S3_FOLDERS_BY_TYPE folders, S3_FOLDER
+		// being listed without one
+		cfg := config()
+		folder := cfg.S3Folder
+		if name := query.Get("type"); name != "" {
+			t := contentTypeByName(name)
+			if t < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown type " + strconv.Quote(name)})
+				return
+			}
+			folder = objectFolder(*cfg, t)
+		}
+		input := &s3.ListObjectsV2Input{
+			Bucket:  aws.String(cfg.S3Bucket),
+			Prefix:  aws.String(folder + query.Get("prefix")),
+			MaxKeys: aws.Int32(int32(limit)),
+		}
+		if token := query.Get("token"); token != "" {
+			input.ContinuationToken = aws.String(token)
+		}
+		out, err := client.ListObjectsV2(r.Context(), input)
+		if err != nil {
+			slog.Error("ListObjectsV2 failed", "prefix", aws.ToString(input.Prefix), "error", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to list bucket"})
+			return
+		}
+
+		list := objectList{Objects: make([]listedObject, 0, len(out.Contents))}
+		for _, o := range out.Contents {
+			list.Objects = append(list.Objects, listedObject{
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				LastModified: o.LastModified,
+			})
+		}
+		if aws.ToBool(out.IsTruncated) {
+			list.NextToken = aws.ToString(out.NextContinuationToken)
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
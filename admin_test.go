@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminCacheHandler(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, map[string]string{"S3_FOLDER": "cache/", "ADMIN_TOKEN": "secret"})
+	key := objectKey(cfg, httptest.NewRequest(http.MethodGet, "/insecure/cached", nil), contentTypePNG)
+	fake.put(key, []byte("png"), http.Header{"Content-Type": {"image/png"}})
+	handler := requireAdminToken(cfg, adminCacheHandler(func() *Config { return &cfg }, fake.client(), nil))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		fail   bool
+		status int
+	}{
+		{name: "no token", target: "/admin/cache?path=/insecure/cached", status: http.StatusUnauthorized},
+		{name: "wrong token", target: "/admin/cache?path=/insecure/cached", token: "nope", status: http.StatusUnauthorized},
+		{name: "wrong method", method: http.MethodPost, target: "/admin/cache?path=/insecure/cached", token: "secret", status: http.StatusMethodNotAllowed},
+		{name: "missing path", target: "/admin/cache", token: "secret", status: http.StatusBadRequest},
+		{name: "not cached", target: "/admin/cache?path=/insecure/other", token: "secret", status: http.StatusNotFound},
+		{name: "cached", target: "/admin/cache?path=/insecure/cached", token: "secret", status: http.StatusOK},
+		{name: "bucket failing", target: "/admin/cache?path=/insecure/cached", token: "secret", fail: true, status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fail {
+				fake.setFail(func(*http.Request) int { return http.StatusInternalServerError })
+				defer fake.setFail(nil)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var status cacheStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if !status.Exists || status.Size != 3 || status.ContentType != "image/png" || status.LastModified == nil {
+				t.Errorf("status = %+v, want an existing 3 byte image/png with a modification time", status)
+			}
+			if status.Key != key {
+				t.Errorf("key = %q, want %q", status.Key, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captureAudit collects the audit events logged until the test ends
+func captureAudit(t *testing.T) func() []map[string]any {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return func() []map[string]any {
+		var events []map[string]any
+		sc := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+		for sc.Scan() {
+			var record map[string]any
+			if json.Unmarshal(sc.Bytes(), &record) == nil && record["msg"] == "Admin audit" {
+				events = append(events, record)
+			}
+		}
+		return events
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	actor := adminActor("secret")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   map[string]any
+	}{
+		{
+			name: "lookup", method: http.MethodGet, path: "/admin/cache?path=/x", token: "secret",
+			want: map[string]any{"actor": actor, "action": "GET /admin/cache", "target": "path=/x", "status": 404.0, "result": "ok"},
+		},
+		{
+			name: "maintenance", method: http.MethodPost, path: "/admin/maintenance?enabled=true", token: "secret",
+			want: map[string]any{"actor": actor, "action": "POST /admin/maintenance", "target": "enabled=true", "status": 200.0, "result": "ok"},
+		},
+		{
+			name: "wrong method", method: http.MethodGet, path: "/admin/reload", token: "secret",
+			want: map[string]any{"actor": actor, "action": "GET /admin/reload", "status": 405.0, "result": "failed"},
+		},
+		{
+			name: "wrong token", method: http.MethodPost, path: "/admin/stats/reset", token: "guess",
+			want: map[string]any{"actor": "anonymous", "action": "POST /admin/stats/reset", "status": 401.0, "result": "denied"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+			events := captureAudit(t)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			e.do(req)
+
+			logged := events()
+			if len(logged) != 1 {
+				t.Fatalf("%d audit events, want 1", len(logged))
+			}
+			for name, want := range tt.want {
+				if got := logged[0][name]; got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminAuditWebhook(t *testing.T) {
+	hook, received := webhookReceiver(t, 0)
+	e := newTestEnv(t, map[string]string{
+		"ADMIN_TOKEN":             "secret",
+		"CACHE_EVENT_WEBHOOK_URL": hook.URL,
+		"ADMIN_AUDIT_WEBHOOK":     "true",
+	}, nil)
+	go e.srv.events.run(t.Context())
+
+	e.admin(http.MethodPost, "/admin/maintenance?enabled=true")
+	var ev auditEvent
+	select {
+	case payload := <-received:
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit event delivered")
+	}
+	if ev.Event != "admin_audit" || ev.Action != "POST /admin/maintenance" || ev.Actor != adminActor("secret") || ev.Result != "ok" {
+		t.Errorf("event = %+v", ev)
+	}
+}
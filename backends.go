@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Limiter caps how many requests are forwarded to imgproxy at once
+type Limiter interface {
+	// Acquire reports whether a slot was obtained. Callers must Release it
+	// once done. An error means the limiter couldn't tell, e.g. its store is
+	// unreachable, and no slot is held: RATE_LIMIT_FAIL_OPEN decides whether
+	// the request is served anyway.
+	Acquire(ctx context.Context) (bool, error)
+	Release()
+	// InFlight is the number of slots currently held through this limiter
+	InFlight() int64
+}
+
+// Coordinator makes sure a key is only ever written by one upload at a time.
+// TryLock must never wait: the upload is fed by the client stream.
+type Coordinator interface {
+	// TryLock reports whether key was free, in which case it is now held
+	TryLock(key string) bool
+	Unlock(key string)
+}
+
+// LimiterFactory builds the limiter selected through LIMITER_BACKEND
+type LimiterFactory func(cfg Config) (Limiter, error)
+
+// CoordinatorFactory builds the coordinator selected through COORDINATOR_BACKEND
+type CoordinatorFactory func(cfg Config) (Coordinator, error)
+
+const defaultBackend = "memory"
+
+// The in-memory backends only coordinate the requests of one instance
+var (
+	limiterBackends = map[string]LimiterFactory{
+		defaultBackend: func(cfg Config) (Limiter, error) {
+			return newUpstreamLimiter(cfg.UpstreamConcurrency, cfg.UpstreamQueueTimeout), nil
+		},
+	}
+	coordinatorBackends = map[string]CoordinatorFactory{
+		defaultBackend: func(cfg Config) (Coordinator, error) {
+			return newKeyLocks(), nil
+		},
+	}
+)
+
+// RegisterLimiter makes a custom limiter selectable through LIMITER_BACKEND.
+// Call it from the init function of a file dropped into the package at
+// build time.
+func RegisterLimiter(name string, f LimiterFactory) {
+	if _, exists := limiterBackends[name]; exists {
+		panic(fmt.Sprintf("limiter %q already registered", name))
+	}
+	limiterBackends[name] = f
+}
+
+// RegisterCoordinator makes a custom coordinator selectable through
+// COORDINATOR_BACKEND. Call it from the init function of a file dropped into
+// the package at build time.
+func RegisterCoordinator(name string, f CoordinatorFactory) {
+	if _, exists := coordinatorBackends[name]; exists {
+		panic(fmt.Sprintf("coordinator %q already registered", name))
+	}
+	coordinatorBackends[name] = f
+}
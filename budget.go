@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// bufferBudget caps the memory held by upload buffers across all in-flight
+// uploads. A response that doesn't fit is served but not cached.
+type bufferBudget struct {
+	max  int64 // 0 means unlimited
+	used atomic.Int64
+}
+
+func newBufferBudget(max int64) *bufferBudget {
+	return &bufferBudget{max: max}
+}
+
+// tryAcquire reserves n bytes, reporting false when that would exceed the budget
+func (b *bufferBudget) tryAcquire(n int64) bool {
+	for {
+		used := b.used.Load()
+		if b.max > 0 && used+n > b.max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+func (b *bufferBudget) release(n int64) {
+	b.used.Add(-n)
+}
+
+func (b *bufferBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// uploadBufferSize is the memory held while uploading a body of the given
+// length: the body itself when sent with a single PutObject, otherwise whole
+// parts, at most one per concurrent part upload plus the one being filled.
+// Unknown lengths are assumed to need all of them. Resumable uploads hold the
+// part being sent and the next one. CONTENT_ADDRESSED bodies are held whole
+// to be hashed, unknown lengths possibly before being uploaded as usual.
+func uploadBufferSize(cfg *Config, contentLength int64) int64 {
+	if singlePut(cfg, contentLength) {
+		return contentLength
+	}
+	if cfg.ContentAddressed && contentLength >= 0 && contentLength <= cfg.ContentAddressedMaxSize {
+		return contentLength
+	}
+	var hashed int64
+	if cfg.ContentAddressed && contentLength < 0 {
+		hashed = cfg.ContentAddressedMaxSize
+	}
+	if cfg.ResumableUploads {
+		return hashed + 2*uploadPartSize
+	}
+	maxParts := int64(manager.DefaultUploadConcurrency + 1)
+	if contentLength < 0 {
+		return hashed + maxParts*uploadPartSize
+	}
+	parts := max(1, (contentLength+uploadPartSize-1)/uploadPartSize)
+	return min(parts, maxParts) * uploadPartSize
+}
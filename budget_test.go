@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+func TestBufferBudget(t *testing.T) {
+	b := newBufferBudget(10)
+	if !b.tryAcquire(6) || b.tryAcquire(5) || !b.tryAcquire(4) {
+		t.Fatal("the budget wasn't enforced")
+	}
+	b.release(6)
+	if !b.tryAcquire(5) || b.Used() != 9 {
+		t.Errorf("used = %d after a release, want 9", b.Used())
+	}
+	if unlimited := newBufferBudget(0); !unlimited.tryAcquire(1 << 40) {
+		t.Error("an unlimited budget refused a reservation")
+	}
+}
+
+func TestUploadBufferSize(t *testing.T) {
+	const part = uploadPartSize
+	maxParts := int64(manager.DefaultUploadConcurrency + 1)
+	tests := []struct {
+		name   string
+		env    map[string]string
+		length int64
+		want   int64
+	}{
+		{name: "single put", length: 1000, want: 1000},
+		{name: "two parts", length: part + 1, want: 2 * part},
+		{name: "more parts than uploaded at once", length: 100 * part, want: maxParts * part},
+		{name: "unknown length", length: -1, want: maxParts * part},
+		{name: "resumable", env: map[string]string{"RESUMABLE_UPLOADS": "true"}, length: 100 * part, want: 2 * part},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.env)
+			if got := uploadBufferSize(&cfg, tt.length); got != tt.want {
+				t.Errorf("uploadBufferSize(%d) = %d, want %d", tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxTotalBufferBytes(t *testing.T) {
+	// Room for one upload of testPNG and its tee buffer
+	const tee = 64 * 1024
+	budget := len(testPNG) + tee
+	e := newTestEnv(t, map[string]string{
+		"MAX_TOTAL_BUFFER_BYTES": strconv.Itoa(budget),
+		"UPLOAD_TEE_BUFFER_SIZE": strconv.Itoa(tee),
+		"KEY_GENERATOR":          "hash-path+query",
+	}, nil)
+	tests := []struct {
+		name     string
+		held     int64
+		uploaded bool
+	}{
+		{name: "fits", uploaded: true},
+		{name: "budget held elsewhere", held: 1},
+		{name: "released", uploaded: true},
+	}
+	for i, tt := range tests {
+		if tt.held > 0 && !e.srv.buffers.tryAcquire(tt.held) {
+			t.Fatal("couldn't hold the budget")
+		}
+		before := len(e.s3.keys(testBucket))
+		resp := e.get(testImagePath + "?n=" + strconv.Itoa(i))
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d, the image wasn't served", tt.name, resp.StatusCode)
+		}
+		if uploaded := len(e.s3.keys(testBucket)) > before; uploaded != tt.uploaded {
+			t.Errorf("%s: uploaded = %v, want %v", tt.name, uploaded, tt.uploaded)
+		}
+		e.srv.buffers.release(tt.held)
+		if used := e.srv.buffers.Used(); used != 0 {
+			t.Errorf("%s: %d bytes still held", tt.name, used)
+		}
+	}
+	if got := e.srv.stats.uploadsSkippedMemory.Load(); got != 1 {
+		t.Errorf("uploads_skipped_memory = %d, want 1", got)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkProxyCopy proxies a 200KB render with caching off, so only the
+// reverse proxy's copy of the body differs between the two runs
+func BenchmarkProxyCopy(b *testing.B) {
+	body := bytes.Repeat([]byte{0xff}, 200*1024)
+	for _, pooled := range []bool{false, true} {
+		b.Run("pooled="+strconv.FormatBool(pooled), func(b *testing.B) {
+			e := newTestEnv(b, map[string]string{"CACHE_ENABLED": "false"}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Write(body)
+			})
+			if !pooled {
+				e.srv.proxy.BufferPool = nil
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				rec := httptest.NewRecorder()
+				e.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, testImagePath, nil))
+				if rec.Code != http.StatusOK || rec.Body.Len() != len(body) {
+					b.Fatalf("status %d, %d bytes", rec.Code, rec.Body.Len())
+				}
+			}
+		})
+	}
+}
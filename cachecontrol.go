@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControlRules maps content types to the max-age served with them
+type cacheControlRules struct {
+	maxAge    map[contentType]time.Duration
+	fallback  time.Duration // 0 means no rule
+	overwrite bool
+	// jitter adds up to that much to each max-age so objects written in a
+	// burst don't all expire at once
+	jitter time.Duration
+}
+
+// parseCacheControlRules parses a comma separated list of type=duration
+// pairs such as "jpeg=720h,webp=720h,default=24h", the types being those of
+// the per content type stats
+func parseCacheControlRules(rules []string, overwrite bool, jitter time.Duration) (cacheControlRules, error) {
+	c := cacheControlRules{maxAge: make(map[contentType]time.Duration), overwrite: overwrite, jitter: jitter}
+	for _, rule := range rules {
+		name, value, ok := strings.Cut(rule, "=")
+		d, err := time.ParseDuration(value)
+		if !ok || err != nil || d <= 0 {
+			return c, fmt.Errorf("invalid cache control rule %q, expected type=duration", rule)
+		}
+		if name == "default" {
+			c.fallback = d
+			continue
+		}
+		t := contentTypeByName(name)
+		if t < 0 {
+			return c, fmt.Errorf("invalid cache control rule %q, unknown type %q", rule, name)
+		}
+		c.maxAge[t] = d
+	}
+	return c, nil
+}
+
+func contentTypeByName(name string) contentType {
+	for t, n := range contentTypeNames {
+		if n == name {
+			return contentType(t)
+		}
+	}
+	return -1
+}
+
+// apply sets Cache-Control on a response from its content type, leaving an
+// upstream value alone unless configured to overwrite it. The header is
+// stored with the object, which is how the jittered max-age reaches readers.
+func (c cacheControlRules) apply(h http.Header) {
+	if h.Get("Cache-Control") != "" && !c.overwrite {
+		return
+	}
+	d, ok := c.maxAge[normalizeContentType(h.Get("Content-Type"))]
+	if !ok {
+		d = c.fallback
+	}
+	if d > 0 && c.jitter > 0 {
+		d += rand.N(c.jitter)
+	}
+	if d > 0 {
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(d.Seconds())))
+	}
+}
+
+// upstreamForbidsCaching reports whether imgproxy asked for the response not
+// to be cached through one of the NO_CACHE_HEADERS: any value of a listed
+// header does, except Cache-Control which must say no-store or private
+func upstreamForbidsCaching(names []string, h http.Header) bool {
+	for _, name := range names {
+		if name != "Cache-Control" {
+			if h.Get(name) != "" {
+				return true
+			}
+			continue
+		}
+		for _, v := range h.Values(name) {
+			for _, directive := range strings.Split(v, ",") {
+				directive = strings.ToLower(strings.TrimSpace(directive))
+				if directive == "no-store" || directive == "private" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheControlRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       []string
+		overwrite   bool
+		contentType string
+		upstream    string
+		want        string
+	}{
+		{name: "matching type", rules: []string{"jpeg=720h", "default=24h"}, contentType: "image/jpeg", want: "public, max-age=2592000"},
+		{name: "default", rules: []string{"jpeg=720h", "default=24h"}, contentType: "image/webp", want: "public, max-age=86400"},
+		{name: "unknown type uses other", rules: []string{"other=1m"}, contentType: "image/heic", want: "public, max-age=60"},
+		{name: "no matching rule", rules: []string{"jpeg=720h"}, contentType: "image/png", want: ""},
+		{name: "upstream kept", rules: []string{"default=24h"}, contentType: "image/png", upstream: "max-age=60", want: "max-age=60"},
+		{name: "upstream overwritten", rules: []string{"default=24h"}, overwrite: true, contentType: "image/png", upstream: "max-age=60", want: "public, max-age=86400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCacheControlRules(tt.rules, tt.overwrite, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := http.Header{"Content-Type": {tt.contentType}}
+			if tt.upstream != "" {
+				h.Set("Cache-Control", tt.upstream)
+			}
+			c.apply(h)
+			if got := h.Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheControlRulesInvalid(t *testing.T) {
+	for _, rule := range []string{"jpeg", "jpeg=soon", "jpeg=-1h", "tiff=1h"} {
+		if _, err := parseCacheControlRules([]string{rule}, false, 0); err == nil {
+			t.Errorf("%q was accepted", rule)
+		}
+	}
+}
+
+func TestCacheControlServedAndStored(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"CACHE_CONTROL_MAX_AGES": "png=1h"}, nil)
+	resp := e.get(testImagePath)
+	want := "public, max-age=3600"
+	if got := resp.Header.Get("Cache-Control"); got != want {
+		t.Errorf("served Cache-Control = %q, want %q", got, want)
+	}
+	keys := e.s3.keys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("bucket has %v, want one object", keys)
+	}
+	if o, _ := e.s3.object(keys[0]); o.header.Get("Cache-Control") != want {
+		t.Errorf("stored Cache-Control = %q, want %q", o.header.Get("Cache-Control"), want)
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		jitter time.Duration
+		min    int
+		max    int
+	}{
+		{name: "jittered", rules: []string{"default=24h"}, jitter: time.Hour, min: 86400, max: 86400 + 3600},
+		{name: "no jitter", rules: []string{"default=24h"}, min: 86400, max: 86400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCacheControlRules(tt.rules, false, tt.jitter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[int]bool)
+			for range 200 {
+				h := http.Header{"Content-Type": {"image/png"}}
+				c.apply(h)
+				age, err := strconv.Atoi(strings.TrimPrefix(h.Get("Cache-Control"), "public, max-age="))
+				if err != nil {
+					t.Fatalf("Cache-Control = %q", h.Get("Cache-Control"))
+				}
+				if age < tt.min || age > tt.max {
+					t.Errorf("max-age = %d, want within [%d, %d]", age, tt.min, tt.max)
+				}
+				seen[age] = true
+			}
+			if spread := len(seen) > 1; spread != (tt.jitter > 0) {
+				t.Errorf("%d distinct max-ages over 200 objects", len(seen))
+			}
+		})
+	}
+}
+
+func TestCacheTTLJitterStored(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"CACHE_CONTROL_MAX_AGES": "png=1h", "CACHE_TTL_JITTER": "1h"}, nil)
+	served := make(map[string]bool)
+	for i := range 20 {
+		served[e.get(renderPath("local:///"+strconv.Itoa(i))).Header.Get("Cache-Control")] = true
+	}
+	stored := make(map[string]bool)
+	for _, key := range e.s3.keys(testBucket) {
+		o, _ := e.s3.object(key)
+		stored[o.header.Get("Cache-Control")] = true
+	}
+	// Readers get the jittered max-age from the object itself
+	if len(stored) < 2 || !maps.Equal(served, stored) {
+		t.Errorf("served %v, stored %v, want the same jittered values", served, stored)
+	}
+}
+
+func TestNoCacheHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     string
+		upstream  http.Header
+		overwrite bool
+		uploaded  bool
+	}{
+		{name: "custom header", names: "X-No-Cache", upstream: http.Header{"X-No-Cache": {"1"}}},
+		{name: "no-store", names: "Cache-Control", upstream: http.Header{"Cache-Control": {"public, no-store"}}},
+		{name: "private", names: "Cache-Control", upstream: http.Header{"Cache-Control": {"PRIVATE"}}},
+		{name: "cacheable Cache-Control", names: "Cache-Control", upstream: http.Header{"Cache-Control": {"max-age=60"}}, uploaded: true},
+		{name: "unlisted header", names: "Cache-Control", upstream: http.Header{"X-No-Cache": {"1"}}, uploaded: true},
+		{name: "not configured", upstream: http.Header{"Cache-Control": {"no-store"}}, uploaded: true},
+		// Honored even though the served Cache-Control is replaced
+		{name: "overwritten no-store", names: "Cache-Control", overwrite: true, upstream: http.Header{"Cache-Control": {"no-store"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"NO_CACHE_HEADERS": tt.names}
+			if tt.overwrite {
+				env["CACHE_CONTROL_MAX_AGES"], env["CACHE_CONTROL_OVERWRITE"] = "default=1h", "true"
+			}
+			e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+				maps.Copy(w.Header(), tt.upstream)
+				servePNG(w, r)
+			})
+			resp := e.get(testImagePath)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want the image served anyway", resp.StatusCode)
+			}
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+			want := int64(1)
+			if tt.uploaded {
+				want = 0
+			}
+			if got := e.srv.stats.uploadsNoCache.Load(); got != want {
+				t.Errorf("uploads_no_cache = %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pathCanonicalizer folds cosmetic path variations that would otherwise
+// fragment the cache. Only the routing portion is touched: signatures and
+// source URLs (base64 ones especially) are case-sensitive and kept as is.
+type pathCanonicalizer struct {
+	lowercase         bool
+	trimTrailingSlash bool
+}
+
+// parsePathCanonicalizer parses a comma separated list of the lowercase and
+// trailing-slash flags
+func parsePathCanonicalizer(flags []string) (pathCanonicalizer, error) {
+	var c pathCanonicalizer
+	for _, f := range flags {
+		switch f {
+		case "lowercase":
+			c.lowercase = true
+		case "trailing-slash":
+			c.trimTrailingSlash = true
+		default:
+			return c, fmt.Errorf("invalid CANONICALIZE_PATH flag %q, expected lowercase or trailing-slash", f)
+		}
+	}
+	return c, nil
+}
+
+func (c pathCanonicalizer) enabled() bool {
+	return c.lowercase || c.trimTrailingSlash
+}
+
+// canonicalize lowercases option names and the plain marker, and drops
+// trailing slashes unless they belong to a plain source URL
+func (c pathCanonicalizer) canonicalize(path string) string {
+	if !c.enabled() {
+		return path
+	}
+	p, ok := parseImgproxyPath(path)
+	if !ok {
+		if c.trimTrailingSlash && len(path) > 1 {
+			path = strings.TrimRight(path, "/")
+		}
+		return path
+	}
+
+	if c.lowercase {
+		for i, o := range p.Options {
+			name, args, _ := strings.Cut(o, ":")
+			p.Options[i] = strings.ToLower(name) + ":" + args
+		}
+		if marker, rest, ok := strings.Cut(p.Source, "/"); ok && strings.EqualFold(marker, "plain") {
+			p.Source = "plain/" + rest
+		}
+	}
+	path = p.String()
+	if c.trimTrailingSlash && !strings.HasPrefix(p.Source, "plain/") {
+		path = strings.TrimRight(path, "/")
+	}
+	return path
+}
+
+// apply canonicalizes u in place. It works on the escaped path so encoded
+// characters in the source reach imgproxy untouched.
+func (c pathCanonicalizer) apply(u *url.URL) {
+	if !c.enabled() {
+		return
+	}
+	escaped := c.canonicalize(u.EscapedPath())
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path, u.RawPath = path, escaped
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPathCanonicalizer(t *testing.T) {
+	const b64 = "aHR0cHM6Ly9leGFtcGxlLmNvbS9DYXQuanBn"
+	tests := []struct {
+		name  string
+		flags []string
+		path  string
+		want  string
+	}{
+		{name: "disabled", path: "/insecure/RS:fit:1:1/" + b64 + "/", want: "/insecure/RS:fit:1:1/" + b64 + "/"},
+		{name: "option names", flags: []string{"lowercase"}, path: "/insecure/RS:Fit:1:1/Q:80/" + b64, want: "/insecure/rs:Fit:1:1/q:80/" + b64},
+		{name: "base64 source kept", flags: []string{"lowercase"}, path: "/insecure/rs:fit:1:1/" + b64, want: "/insecure/rs:fit:1:1/" + b64},
+		{name: "signature kept", flags: []string{"lowercase"}, path: "/AbC/rs:fit:1:1/" + b64, want: "/AbC/rs:fit:1:1/" + b64},
+		{name: "plain marker", flags: []string{"lowercase"}, path: "/insecure/rs:fit:1:1/PLAIN/https://Example.com/Cat.jpg", want: "/insecure/rs:fit:1:1/plain/https://Example.com/Cat.jpg"},
+		{name: "trailing slash", flags: []string{"trailing-slash"}, path: "/insecure/rs:fit:1:1/" + b64 + "//", want: "/insecure/rs:fit:1:1/" + b64},
+		{name: "plain source slash kept", flags: []string{"trailing-slash"}, path: "/insecure/rs:fit:1:1/plain/https://example.com/dir/", want: "/insecure/rs:fit:1:1/plain/https://example.com/dir/"},
+		{name: "other path", flags: []string{"lowercase", "trailing-slash"}, path: "/Other/", want: "/Other"},
+		{name: "root", flags: []string{"trailing-slash"}, path: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parsePathCanonicalizer(tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.canonicalize(tt.path); got != tt.want {
+				t.Errorf("canonicalize(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+	if _, err := parsePathCanonicalizer([]string{"uppercase"}); err == nil {
+		t.Error("an unknown flag was accepted")
+	}
+}
+
+func TestCanonicalizePathForwardsAndKeys(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"CANONICALIZE_PATH": "lowercase,trailing-slash"}, nil)
+	src := renderPath("https://example.com/Cat.jpg")
+	for _, path := range []string{src, src + "/", "/insecure/RS:fit:100:100/" + src[len("/insecure/rs:fit:100:100/"):]} {
+		if resp := e.get(path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", path, resp.StatusCode)
+		}
+	}
+	for _, r := range e.img.renders() {
+		if r.URL.Path != src {
+			t.Errorf("imgproxy received %q, want %q", r.URL.Path, src)
+		}
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 1 {
+		t.Errorf("bucket has %v, want the variants to share a key", keys)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes reads a list of CIDRs, bare addresses standing for a single
+// host
+func parsePrefixes(name string, values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %w", name, v, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", name, v, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind r. X-Forwarded-For is
+// only believed when the connection comes from one of the trusted proxies,
+// and then walked from the right: the first hop that isn't a trusted proxy
+// is the client, anything left of it could have been forged.
+func clientIP(trusted []netip.Prefix, r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !containsAddr(trusted, addr) {
+		return addr, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Can't tell who sent it, stop at the last hop we could trust
+			break
+		}
+		addr = hop.Unmap()
+		if !containsAddr(trusted, addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// requireAdminIP rejects admin requests from outside ADMIN_IP_ALLOWLIST,
+// before the token is even looked at
+func requireAdminIP(cfg Config, next http.HandlerFunc) http.HandlerFunc {
+	if len(cfg.AdminIPAllowlist) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := clientIP(cfg.TrustedProxies, r)
+		if !ok || !containsAddr(cfg.AdminIPAllowlist, addr) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		next(w, r)
+	}
+}
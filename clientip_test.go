@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := parsePrefixes("ADMIN_IP_ALLOWLIST", []string{"10.1.2.3/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := parsePrefixes("ADMIN_IP_ALLOWLIST", []string{invalid}); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "forwarded by an untrusted peer", remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.7"}, want: "192.0.2.1"},
+		{name: "forwarded by a trusted proxy", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "forged hops left of the client", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 198.51.100.7, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "split headers", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7", "10.0.0.2"}, want: "198.51.100.7"},
+		{name: "unparsable hop", remoteAddr: "10.0.0.1:1234", forwarded: []string{"garbage, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "IPv4-mapped", remoteAddr: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got, ok := clientIP(trusted, r); !ok || got.String() != tt.want {
+				t.Errorf("clientIP = %s, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminIPAllowlist(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowlist  string
+		remoteAddr string
+		forwarded  string
+		token      string
+		status     int
+	}{
+		{name: "no allowlist", remoteAddr: "192.0.2.1:1234", token: "secret", status: http.StatusOK},
+		{name: "allowed", allowlist: "192.0.2.0/24", remoteAddr: "192.0.2.1:1234", token: "secret", status: http.StatusOK},
+		{name: "outside", allowlist: "192.0.2.0/24", remoteAddr: "198.51.100.7:1234", token: "secret", status: http.StatusForbidden},
+		// The address is checked before the token
+		{name: "outside without a token", allowlist: "192.0.2.0/24", remoteAddr: "198.51.100.7:1234", status: http.StatusForbidden},
+		{name: "allowed without a token", allowlist: "192.0.2.0/24", remoteAddr: "192.0.2.1:1234", status: http.StatusUnauthorized},
+		{name: "allowed behind a trusted proxy", allowlist: "192.0.2.0/24", remoteAddr: "10.0.0.1:1234", forwarded: "192.0.2.1", token: "secret", status: http.StatusOK},
+		{name: "forged by an untrusted peer", allowlist: "192.0.2.0/24", remoteAddr: "198.51.100.7:1234", forwarded: "192.0.2.1", token: "secret", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "ADMIN_IP_ALLOWLIST": tt.allowlist, "TRUSTED_PROXIES": "10.0.0.0/8"}, nil)
+			req := httptest.NewRequest(http.MethodGet, "/admin/list", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if resp := e.do(req); resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
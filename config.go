@@ -0,0 +1,859 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type Config struct {
+	// CacheEnabled false turns the process into a plain imgproxy reverse
+	// proxy that never talks to S3
+	CacheEnabled bool
+
+	S3Bucket string
+	S3Folder string
+	// S3FoldersByType stores some content types outside S3Folder
+	S3FoldersByType map[contentType]string
+	// CreateFolderMarker puts a zero-byte object at the folders at startup
+	CreateFolderMarker bool
+	// S3FallbackFolders are former values of S3Folder looked in on a miss,
+	// S3FallbackPromote copies what is found there to the current folder
+	S3FallbackFolders  []string
+	S3FallbackPromote  bool
+	S3Endpoint         string
+	TigrisProxyBind    string
+	HealthCheckTimeout time.Duration
+	AdminToken         string
+	// UploadTeeBufferSize bounds the bytes queued for an upload that falls
+	// behind the client, the upload is aborted above it
+	UploadTeeBufferSize int
+	// AdminIPAllowlist restricts the admin endpoints to these networks,
+	// empty allows any client holding the token
+	AdminIPAllowlist []netip.Prefix
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed
+	TrustedProxies []netip.Prefix
+
+	// HealthCheckAttemptTimeout bounds each individual health check request
+	HealthCheckAttemptTimeout time.Duration
+	// HealthCheckInterval is the delay between startup health checks
+	HealthCheckInterval time.Duration
+	// HealthCheckSuccessThreshold is how many consecutive checks must pass
+	// before imgproxy is considered ready, at startup and after a failure
+	HealthCheckSuccessThreshold int
+
+	// ShutdownDelay keeps serving, but not ready, for that long after SIGTERM
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds the wait for in-flight requests and uploads
+	ShutdownTimeout time.Duration
+	// The public listener's timeouts, 0 disabling one. WriteTimeout is off
+	// by default since it would also cut legitimately slow renders.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxConnections caps the open client connections, 0 means unlimited
+	MaxConnections int
+
+	// SelftestPath is the imgproxy path rendered by --selftest
+	SelftestPath string
+
+	// AccessLogFormat is none, combined or json
+	AccessLogFormat string
+
+	// UpstreamURL is where imgproxy is reached, http or https
+	UpstreamURL                string
+	UpstreamCABundle           string
+	UpstreamInsecureSkipVerify bool
+	// ImgproxyUnixSocket makes imgproxy reachable over a Unix socket instead of TCP
+	ImgproxyUnixSocket string
+
+	// ErrorPixelStatuses are the imgproxy error statuses answered with a
+	// transparent 1x1 ErrorPixelFormat (gif or png) image
+	ErrorPixelStatuses []int
+	ErrorPixelFormat   string
+	// MissingSourceBehavior is one of passthrough, fallback or negative-cache
+	MissingSourceBehavior string
+	FallbackImagePath     string
+	NegativeCacheTTL      time.Duration
+
+	S3ObjectACL types.ObjectCannedACL
+	// S3RetryMaxAttempts and S3RetryMaxBackoff tune the SDK's retries of
+	// each S3 request (including each part of a multipart upload)
+	S3RetryMaxAttempts int
+	S3RetryMaxBackoff  time.Duration
+
+	// S3CABundle adds PEM certificates to trust for the S3 endpoint,
+	// S3HTTPProxy routes S3 requests through a proxy
+	S3CABundle           string
+	S3InsecureSkipVerify bool
+	S3HTTPProxy          string
+
+	// MirrorS3Bucket enables copying every object written to a second
+	// bucket, at MirrorS3Endpoint. The mirror credentials default to the
+	// primary ones.
+	MirrorS3Bucket          string
+	MirrorS3Endpoint        string
+	MirrorS3Region          string
+	MirrorS3AccessKeyID     string
+	MirrorS3SecretAccessKey string
+
+	// HealthPollInterval enables runtime health checks of imgproxy when non-zero
+	HealthPollInterval         time.Duration
+	HealthPollFailureThreshold int
+	// S3ReadyInterval enables bucket probes failing /readyz when the bucket
+	// is slower than S3ReadyMaxLatency
+	S3ReadyInterval   time.Duration
+	S3ReadyMaxLatency time.Duration
+
+	PathRewrites pathRewrites
+	// CleanPaths collapses duplicate slashes and dot segments outside of the
+	// source and rejects traversal, instead of the mux's redirects
+	CleanPaths bool
+	// CanonicalizePath folds case and trailing slash variations of paths
+	CanonicalizePath pathCanonicalizer
+
+	// UpstreamConcurrency caps requests in flight to imgproxy, 0 means unlimited
+	UpstreamConcurrency  int
+	UpstreamQueueTimeout time.Duration
+	// UpstreamMetricHeaders are the numeric imgproxy headers aggregated in
+	// /stats, stripped from responses when StripUpstreamMetricHeaders is set
+	UpstreamMetricHeaders      []string
+	StripUpstreamMetricHeaders bool
+	// SlowRenderGrace sends 103 Early Hints at that interval while imgproxy
+	// hasn't answered yet, 0 disables it
+	SlowRenderGrace time.Duration
+
+	KeyGenerator KeyGenerator
+	// KeyShards spreads keys over subfolders of the folder
+	KeyShards keySharding
+	// DatePartitionKeys prefixes keys with the day they were written on,
+	// lookups searching the last DatePartitionLookupDays days
+	DatePartitionKeys       bool
+	DatePartitionLookupDays int
+	// LimiterBackend and CoordinatorBackend select the implementations of
+	// the upstream limiter and of the upload key locks
+	LimiterBackend     string
+	CoordinatorBackend string
+	// RateLimitFailOpen serves requests the limiter failed to decide on,
+	// instead of answering them with a 429
+	RateLimitFailOpen bool
+	// AllowedMethods are forwarded to imgproxy, others get a 405. OPTIONS
+	// preflights are always answered by the proxy.
+	AllowedMethods []string
+	// KeyIncludeMethod gives each HTTP method its own keyspace
+	KeyIncludeMethod bool
+	// KeyStripOptions are the imgproxy options, by full name, left out of
+	// keys as they change the response headers but not the image
+	KeyStripOptions map[string]bool
+	// CanonicalizePresets expands imgproxy presets before computing keys
+	CanonicalizePresets bool
+	Presets             presets
+	// NormalizeSourceURL decodes and normalizes source URLs before computing keys
+	NormalizeSourceURL bool
+	// OptionPolicy refuses processing options outside ALLOWED_OPTIONS or
+	// above OPTION_LIMITS
+	OptionPolicy optionPolicy
+	// NormalizeFormatSuffix keys on the requested output format whichever
+	// way it is given: format option, @ext or .ext suffix
+	NormalizeFormatSuffix bool
+	// KeyQueryInclude and KeyQueryExclude select the query parameters the
+	// hash-path+query generator keys on, so cache busters can be ignored
+	KeyQueryInclude []string
+	KeyQueryExclude []string
+	// CacheVersion namespaces keys under <folder><version>/, detected from
+	// imgproxy's UpstreamVersionHeader when set
+	CacheVersion          string
+	UpstreamVersionHeader string
+	// CacheKeyLength truncates the hash part of keys, 0 keeps it whole
+	CacheKeyLength int
+	// UpstreamErrorPassthrough forwards imgproxy's error bodies as is
+	// instead of the bare status text
+	UpstreamErrorPassthrough bool
+	// FollowUpstreamRedirects follows imgproxy's redirects, up to
+	// UpstreamMaxRedirects hops, instead of passing them to the client
+	FollowUpstreamRedirects bool
+	UpstreamMaxRedirects    int
+	// UpstreamQueryAllowed lists the query parameters forwarded to imgproxy,
+	// all of them when empty
+	UpstreamQueryAllowed []string
+	// ExposeCacheKey sends the object key of cached responses as X-Cache-Key.
+	// Off by default, it reveals the bucket layout.
+	ExposeCacheKey bool
+	// CacheRules override the caching settings for the paths they match
+	CacheRules []cacheRule
+	// NoCacheHeaders are the imgproxy response headers that keep a response
+	// out of the bucket
+	NoCacheHeaders []string
+	// VaryHeaders are request headers whose values are mixed into the key
+	VaryHeaders []string
+	// CORS* shape the answer to OPTIONS preflight requests, which are never
+	// forwarded to imgproxy
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	CORSMaxAge         time.Duration
+	// FallbackToSource serves the unprocessed source image of the allowed
+	// source URL prefixes when imgproxy fails
+	FallbackToSource      bool
+	FallbackSourceAllowed []string
+	ImgproxyBaseURL       string
+	// ResponseTransform rewrites served bodies, nil leaves them alone
+	ResponseTransform ResponseTransform
+	// CacheControl sets Cache-Control on rendered images, and the objects
+	// stored from them, from their content type
+	CacheControl cacheControlRules
+	// StrictImageOnly only caches bodies whose bytes are sniffed as an image,
+	// storing the detected content type instead of the upstream one
+	StrictImageOnly bool
+	// VerifyKeySource records what each key was derived from so colliding
+	// keys are detected on lookup
+	VerifyKeySource bool
+	// VerifyContentLength drops uploads whose body length differs from the
+	// declared Content-Length
+	VerifyContentLength bool
+
+	// MaintenanceMode answers misses with MaintenanceStatus/MaintenanceBody
+	// instead of forwarding them to imgproxy
+	MaintenanceMode   bool
+	MaintenanceStatus int
+	MaintenanceBody   string
+	// MaintenanceRetryAfter and SaturatedRetryAfter are sent as Retry-After
+	// with maintenance and UPSTREAM_CONCURRENCY rejections, 0 omitting it
+	MaintenanceRetryAfter time.Duration
+	SaturatedRetryAfter   time.Duration
+
+	// UploadSampleRate is the fraction of misses uploaded, UploadMinSeen the
+	// number of requests for a key before it gets uploaded
+	UploadSampleRate float64
+	UploadMinSeen    int
+	// UploadDebounce drops uploads of a key already uploaded within that window
+	UploadDebounce time.Duration
+	// UploadKeyLock drops uploads of a key already being uploaded
+	UploadKeyLock bool
+	// MaxTotalBufferBytes caps the memory held by all in-flight uploads, 0 means unlimited
+	MaxTotalBufferBytes int64
+	// CopyBufferSize is the size of the pooled buffers bodies are copied with
+	CopyBufferSize int
+	// MaxUploadBodySize rejects request bodies larger than that many bytes,
+	// 0 means unlimited
+	MaxUploadBodySize int64
+	// MinCacheObjectSize skips caching bodies smaller than that many bytes
+	MinCacheObjectSize int64
+	// SinglePutMaxSize is the largest body sent with a single PutObject
+	// rather than through the multipart uploader
+	SinglePutMaxSize int64
+	// MaxObjectSize skips caching bodies the bucket would refuse to store
+	MaxObjectSize int64
+	// ProvenanceMetadata tags objects with the imgproxy version and the host
+	// that rendered them
+	ProvenanceMetadata bool
+	// StoreUpstreamETag keeps imgproxy's ETag in the object metadata
+	StoreUpstreamETag bool
+	// ContentAddressed stores bodies up to ContentAddressedMaxSize under the
+	// hash of their bytes, the request key becoming a pointer to it
+	ContentAddressed        bool
+	ContentAddressedMaxSize int64
+	// ResumableUploads sends multipart uploads part by part, retrying a
+	// failed part instead of the whole upload
+	ResumableUploads bool
+	// CacheEventWebhookURL receives a JSON event for every cached object,
+	// disabled when empty
+	CacheEventWebhookURL string
+	// AdminAuditWebhook also posts admin audit events to the webhook
+	AdminAuditWebhook   bool
+	CacheEventQueueSize int
+	CacheEventTimeout   time.Duration
+}
+
+func loadConfig() (Config, error) {
+	if err := loadConfigFile(); err != nil {
+		return Config{}, err
+	}
+	// Every invalid setting is reported at once, not only the first one
+	var errs []error
+	cfg := Config{
+		S3Bucket:                getenv("S3_BUCKET"),
+		S3Folder:                getenv("S3_FOLDER"),
+		S3Endpoint:              envString("S3_ENDPOINT", "https://fly.storage.tigris.dev"),
+		TigrisProxyBind:         envString("IMGPROXY_BIND", ":8080"),
+		AdminToken:              getenv("ADMIN_TOKEN"),
+		UpstreamURL:             strings.TrimSuffix(envString("UPSTREAM_URL", "http://127.0.0.1:8081"), "/"),
+		UpstreamCABundle:        getenv("UPSTREAM_CA_BUNDLE"),
+		ImgproxyUnixSocket:      getenv("IMGPROXY_UNIX_SOCKET"),
+		SelftestPath:            getenv("SELFTEST_PATH"),
+		AccessLogFormat:         envString("ACCESS_LOG_FORMAT", accessLogNone),
+		MissingSourceBehavior:   envString("MISSING_SOURCE_BEHAVIOR", missingSourcePassthrough),
+		ErrorPixelFormat:        envString("ERROR_PIXEL_FORMAT", errorPixelGIF),
+		FallbackImagePath:       getenv("FALLBACK_IMAGE_PATH"),
+		S3ObjectACL:             types.ObjectCannedACL(getenv("S3_OBJECT_ACL")),
+		S3CABundle:              getenv("S3_CA_BUNDLE"),
+		S3HTTPProxy:             getenv("S3_HTTP_PROXY"),
+		MirrorS3Bucket:          getenv("MIRROR_S3_BUCKET"),
+		MirrorS3Endpoint:        getenv("MIRROR_S3_ENDPOINT"),
+		MirrorS3Region:          envString("MIRROR_S3_REGION", "auto"),
+		MirrorS3AccessKeyID:     getenv("MIRROR_AWS_ACCESS_KEY_ID"),
+		MirrorS3SecretAccessKey: getenv("MIRROR_AWS_SECRET_ACCESS_KEY"),
+		MaintenanceBody:         envString("MAINTENANCE_BODY", "Service under maintenance, please retry later"),
+		CacheEventWebhookURL:    getenv("CACHE_EVENT_WEBHOOK_URL"),
+	}
+	var err error
+	if cfg.CacheEnabled, err = envBool("CACHE_ENABLED", true); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CacheEnabled && cfg.S3Bucket == "" {
+		errs = append(errs, fmt.Errorf("missing required environment variable S3_BUCKET"))
+	}
+	if cfg.MirrorS3Bucket != "" && cfg.MirrorS3Endpoint == "" {
+		errs = append(errs, fmt.Errorf("MIRROR_S3_BUCKET requires MIRROR_S3_ENDPOINT"))
+	}
+	if (cfg.MirrorS3AccessKeyID == "") != (cfg.MirrorS3SecretAccessKey == "") {
+		errs = append(errs, fmt.Errorf("MIRROR_AWS_ACCESS_KEY_ID and MIRROR_AWS_SECRET_ACCESS_KEY must be set together"))
+	}
+
+	if u, err := url.Parse(cfg.UpstreamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid UPSTREAM_URL %q, expected http(s)://host[:port]", cfg.UpstreamURL))
+	}
+	if cfg.UpstreamInsecureSkipVerify, err = envBool("UPSTREAM_INSECURE_SKIP_VERIFY", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ShutdownDelay, err = envDuration("SHUTDOWN_DELAY", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ReadHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", 10*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ReadTimeout, err = envDuration("READ_TIMEOUT", time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.WriteTimeout, err = envDuration("WRITE_TIMEOUT", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.IdleTimeout, err = envDuration("IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxConnections, err = envInt("MAX_CONNECTIONS", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("MAX_CONNECTIONS must not be negative"))
+	}
+	if cfg.HealthCheckTimeout, err = envSeconds("HEALTH_CHECK_TIMEOUT_IN_SEC", 30*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthCheckAttemptTimeout, err = envDuration("HEALTH_CHECK_ATTEMPT_TIMEOUT", 2*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthCheckInterval, err = envDuration("HEALTH_CHECK_INTERVAL", 500*time.Millisecond); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("HEALTH_CHECK_INTERVAL must be positive"))
+	}
+	if cfg.HealthCheckSuccessThreshold, err = envInt("HEALTH_CHECK_SUCCESS_THRESHOLD", 1); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthCheckSuccessThreshold < 1 {
+		errs = append(errs, fmt.Errorf("HEALTH_CHECK_SUCCESS_THRESHOLD must be at least 1"))
+	}
+	if cfg.NegativeCacheTTL, err = envDuration("NEGATIVE_CACHE_TTL", time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadTeeBufferSize, err = envInt("UPLOAD_TEE_BUFFER_SIZE", 1024*1024); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.S3RetryMaxAttempts, err = envInt("S3_RETRY_MAX_ATTEMPTS", retry.DefaultMaxAttempts); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.S3RetryMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("S3_RETRY_MAX_ATTEMPTS must be at least 1"))
+	}
+	if cfg.S3RetryMaxBackoff, err = envDuration("S3_RETRY_MAX_BACKOFF", retry.DefaultMaxBackoff); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.S3InsecureSkipVerify, err = envBool("S3_INSECURE_SKIP_VERIFY", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthPollInterval, err = envDuration("HEALTH_POLL_INTERVAL", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthPollFailureThreshold, err = envInt("HEALTH_POLL_FAILURE_THRESHOLD", 3); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HealthPollFailureThreshold < 1 {
+		errs = append(errs, fmt.Errorf("HEALTH_POLL_FAILURE_THRESHOLD must be at least 1"))
+	}
+	if cfg.S3ReadyInterval, err = envDuration("S3_READY_INTERVAL", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.S3ReadyMaxLatency, err = envDuration("S3_READY_MAX_LATENCY", time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.S3ReadyMaxLatency <= 0 {
+		errs = append(errs, fmt.Errorf("S3_READY_MAX_LATENCY must be positive"))
+	}
+
+	if cfg.UpstreamConcurrency, err = envInt("UPSTREAM_CONCURRENCY", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UpstreamConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("UPSTREAM_CONCURRENCY must not be negative"))
+	}
+	if cfg.UpstreamQueueTimeout, err = envDuration("UPSTREAM_QUEUE_TIMEOUT", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaintenanceMode, err = envBool("MAINTENANCE_MODE", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaintenanceStatus, err = envInt("MAINTENANCE_STATUS", http.StatusServiceUnavailable); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaintenanceStatus < 200 || cfg.MaintenanceStatus > 599 {
+		errs = append(errs, fmt.Errorf("invalid MAINTENANCE_STATUS %d", cfg.MaintenanceStatus))
+	}
+	if cfg.MaintenanceRetryAfter, err = envDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SaturatedRetryAfter, err = envDuration("SATURATED_RETRY_AFTER", time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadSampleRate, err = envFloat("UPLOAD_SAMPLE_RATE", 1); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadSampleRate < 0 || cfg.UploadSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("UPLOAD_SAMPLE_RATE must be between 0 and 1"))
+	}
+	if cfg.UploadMinSeen, err = envInt("UPLOAD_MIN_SEEN", 1); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadMinSeen < 1 {
+		errs = append(errs, fmt.Errorf("UPLOAD_MIN_SEEN must be at least 1"))
+	}
+	if cfg.UploadDebounce, err = envDuration("UPLOAD_DEBOUNCE", 0); err != nil {
+		errs = append(errs, err)
+	}
+	maxBuffer, err := envInt("MAX_TOTAL_BUFFER_BYTES", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	cfg.MaxTotalBufferBytes = int64(maxBuffer)
+	if cfg.MaxTotalBufferBytes < 0 {
+		errs = append(errs, fmt.Errorf("MAX_TOTAL_BUFFER_BYTES must not be negative"))
+	}
+	if cfg.CopyBufferSize, err = envInt("COPY_BUFFER_SIZE", 32*1024); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CopyBufferSize < 512 {
+		errs = append(errs, fmt.Errorf("COPY_BUFFER_SIZE must be at least 512"))
+	}
+	if cfg.UploadTeeBufferSize < cfg.CopyBufferSize {
+		errs = append(errs, fmt.Errorf("UPLOAD_TEE_BUFFER_SIZE must be at least COPY_BUFFER_SIZE"))
+	}
+	maxBody, err := envInt("MAX_UPLOAD_BODY_SIZE", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if maxBody < 0 {
+		errs = append(errs, fmt.Errorf("MAX_UPLOAD_BODY_SIZE must not be negative"))
+	}
+	cfg.MaxUploadBodySize = int64(maxBody)
+	minSize, err := envInt("MIN_CACHE_OBJECT_SIZE", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if minSize < 0 {
+		errs = append(errs, fmt.Errorf("MIN_CACHE_OBJECT_SIZE must not be negative"))
+	}
+	cfg.MinCacheObjectSize = int64(minSize)
+	singlePutMax, err := envInt("SINGLE_PUT_MAX_SIZE", uploadPartSize)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if singlePutMax < 0 {
+		errs = append(errs, fmt.Errorf("SINGLE_PUT_MAX_SIZE must not be negative"))
+	}
+	cfg.SinglePutMaxSize = int64(singlePutMax)
+	maxObjectSize, err := envInt("TIGRIS_MAX_OBJECT_SIZE", maxMultipartObjectSize)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if maxObjectSize <= 0 {
+		errs = append(errs, fmt.Errorf("TIGRIS_MAX_OBJECT_SIZE must be positive"))
+	}
+	cfg.MaxObjectSize = int64(maxObjectSize)
+	if cfg.ContentAddressed, err = envBool("CONTENT_ADDRESSED", false); err != nil {
+		errs = append(errs, err)
+	}
+	contentMax, err := envInt("CONTENT_ADDRESSED_MAX_SIZE", uploadPartSize)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if contentMax <= 0 {
+		errs = append(errs, fmt.Errorf("CONTENT_ADDRESSED_MAX_SIZE must be positive"))
+	}
+	cfg.ContentAddressedMaxSize = int64(contentMax)
+	if cfg.ResumableUploads, err = envBool("RESUMABLE_UPLOADS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ProvenanceMetadata, err = envBool("PROVENANCE_METADATA", true); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.StoreUpstreamETag, err = envBool("STORE_UPSTREAM_ETAG", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.AdminIPAllowlist, err = parsePrefixes("ADMIN_IP_ALLOWLIST", envList("ADMIN_IP_ALLOWLIST")); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.TrustedProxies, err = parsePrefixes("TRUSTED_PROXIES", envList("TRUSTED_PROXIES")); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.AdminAuditWebhook, err = envBool("ADMIN_AUDIT_WEBHOOK", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.AdminAuditWebhook && cfg.CacheEventWebhookURL == "" {
+		errs = append(errs, fmt.Errorf("ADMIN_AUDIT_WEBHOOK requires CACHE_EVENT_WEBHOOK_URL"))
+	}
+	if cfg.CacheEventQueueSize, err = envInt("CACHE_EVENT_QUEUE_SIZE", 1000); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CacheEventQueueSize < 1 {
+		errs = append(errs, fmt.Errorf("CACHE_EVENT_QUEUE_SIZE must be at least 1"))
+	}
+	if cfg.CacheEventTimeout, err = envDuration("CACHE_EVENT_TIMEOUT", 5*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.PathRewrites, err = parsePathRewrites(getenv("UPSTREAM_PATH_REWRITES")); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CleanPaths, err = envBool("CLEAN_PATHS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CanonicalizePath, err = parsePathCanonicalizer(envList("CANONICALIZE_PATH")); err != nil {
+		errs = append(errs, err)
+	}
+
+	keyGeneratorName := envString("KEY_GENERATOR", defaultKeyGenerator)
+	if cfg.KeyGenerator = keyGenerators[keyGeneratorName]; cfg.KeyGenerator == nil {
+		errs = append(errs, fmt.Errorf("unknown KEY_GENERATOR %q", keyGeneratorName))
+	}
+
+	shardCount, err := envInt("KEY_SHARD_COUNT", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.KeyShards, err = newKeySharding(envString("KEY_SHARD_SCHEME", keyShardNone), shardCount); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.DatePartitionKeys, err = envBool("DATE_PARTITION_KEYS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DatePartitionLookupDays, err = envInt("DATE_PARTITION_LOOKUP_DAYS", 30); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DatePartitionLookupDays < 1 {
+		errs = append(errs, fmt.Errorf("DATE_PARTITION_LOOKUP_DAYS must be at least 1"))
+	}
+
+	cfg.LimiterBackend = envString("LIMITER_BACKEND", defaultBackend)
+	if limiterBackends[cfg.LimiterBackend] == nil {
+		errs = append(errs, fmt.Errorf("unknown LIMITER_BACKEND %q", cfg.LimiterBackend))
+	}
+	if cfg.RateLimitFailOpen, err = envBool("RATE_LIMIT_FAIL_OPEN", false); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.CoordinatorBackend = envString("COORDINATOR_BACKEND", defaultBackend)
+	if coordinatorBackends[cfg.CoordinatorBackend] == nil {
+		errs = append(errs, fmt.Errorf("unknown COORDINATOR_BACKEND %q", cfg.CoordinatorBackend))
+	}
+
+	if cfg.FallbackToSource, err = envBool("FALLBACK_TO_SOURCE", false); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.FallbackSourceAllowed = envList("FALLBACK_SOURCE_ALLOWED")
+	if cfg.FallbackToSource && len(cfg.FallbackSourceAllowed) == 0 {
+		errs = append(errs, fmt.Errorf("FALLBACK_SOURCE_ALLOWED is required when FALLBACK_TO_SOURCE is enabled"))
+	}
+	for _, prefix := range cfg.FallbackSourceAllowed {
+		if _, err := parseSourcePrefix(prefix); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	cfg.ImgproxyBaseURL = getenv("IMGPROXY_BASE_URL")
+
+	if name := getenv("RESPONSE_TRANSFORM"); name != "" {
+		if cfg.ResponseTransform = responseTransforms[name]; cfg.ResponseTransform == nil {
+			errs = append(errs, fmt.Errorf("unknown RESPONSE_TRANSFORM %q", name))
+		}
+	}
+
+	cfg.AllowedMethods = []string{http.MethodGet, http.MethodHead}
+	if methods := envList("ALLOWED_METHODS"); len(methods) > 0 {
+		cfg.AllowedMethods = nil
+		for _, m := range methods {
+			cfg.AllowedMethods = append(cfg.AllowedMethods, strings.ToUpper(m))
+		}
+	}
+	if cfg.KeyIncludeMethod, err = envBool("KEY_INCLUDE_METHOD", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CanonicalizePresets, err = envBool("CANONICALIZE_PRESETS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CanonicalizePresets {
+		if cfg.Presets, err = loadPresets(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, name := range envList("KEY_STRIP_OPTIONS") {
+		if cfg.KeyStripOptions == nil {
+			cfg.KeyStripOptions = make(map[string]bool)
+		}
+		cfg.KeyStripOptions[canonicalOptionName(name)] = true
+	}
+
+	if cfg.NormalizeSourceURL, err = envBool("NORMALIZE_SOURCE_URL", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.NormalizeFormatSuffix, err = envBool("NORMALIZE_FORMAT_SUFFIX", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.OptionPolicy, err = parseOptionPolicy(envList("ALLOWED_OPTIONS"), envList("OPTION_LIMITS")); err != nil {
+		errs = append(errs, err)
+	}
+
+	cfg.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+	if cfg.CORSAllowedMethods = envList("CORS_ALLOWED_METHODS"); len(cfg.CORSAllowedMethods) == 0 {
+		cfg.CORSAllowedMethods = []string{http.MethodGet, http.MethodHead}
+	}
+	cfg.CORSAllowedHeaders = envList("CORS_ALLOWED_HEADERS")
+	if cfg.CORSMaxAge, err = envDuration("CORS_MAX_AGE", 0); err != nil {
+		errs = append(errs, err)
+	}
+	for _, h := range envList("UPSTREAM_METRIC_HEADERS") {
+		cfg.UpstreamMetricHeaders = append(cfg.UpstreamMetricHeaders, http.CanonicalHeaderKey(h))
+	}
+	if cfg.UpstreamMetricHeaders == nil {
+		cfg.UpstreamMetricHeaders = defaultUpstreamMetricHeaders
+	}
+	if cfg.StripUpstreamMetricHeaders, err = envBool("STRIP_UPSTREAM_METRIC_HEADERS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SlowRenderGrace, err = envDuration("SLOW_RENDER_GRACE", 0); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.KeyQueryInclude = envList("KEY_QUERY_INCLUDE")
+	cfg.KeyQueryExclude = envList("KEY_QUERY_EXCLUDE")
+	if cfg.UploadKeyLock, err = envBool("UPLOAD_KEY_LOCK", true); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.CacheVersion = sanitizeCacheVersion(getenv("CACHE_VERSION"))
+	if cfg.CacheVersion != getenv("CACHE_VERSION") {
+		errs = append(errs, fmt.Errorf("invalid CACHE_VERSION %q, only letters, digits, '.', '_' and '-' are allowed", getenv("CACHE_VERSION")))
+	}
+	cfg.UpstreamVersionHeader = getenv("UPSTREAM_VERSION_HEADER")
+	if cfg.CacheKeyLength, err = envInt("CACHE_KEY_LENGTH", 0); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CacheKeyLength != 0 && (cfg.CacheKeyLength < minCacheKeyLength || cfg.CacheKeyLength > maxCacheKeyLength) {
+		errs = append(errs, fmt.Errorf("CACHE_KEY_LENGTH must be 0 or between %d and %d", minCacheKeyLength, maxCacheKeyLength))
+	}
+	if cfg.S3FoldersByType, err = parseFoldersByType(envList("S3_FOLDERS_BY_TYPE")); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CreateFolderMarker, err = envBool("CREATE_FOLDER_MARKER", false); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.S3FallbackFolders = envList("S3_FALLBACK_FOLDERS")
+	if cfg.S3FallbackPromote, err = envBool("S3_FALLBACK_PROMOTE", false); err != nil {
+		errs = append(errs, err)
+	}
+	overwriteCacheControl, err := envBool("CACHE_CONTROL_OVERWRITE", false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ttlJitter, err := envDuration("CACHE_TTL_JITTER", 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if ttlJitter < 0 {
+		errs = append(errs, fmt.Errorf("CACHE_TTL_JITTER must not be negative"))
+	}
+	if cfg.CacheControl, err = parseCacheControlRules(envList("CACHE_CONTROL_MAX_AGES"), overwriteCacheControl, ttlJitter); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.StrictImageOnly, err = envBool("STRICT_IMAGE_ONLY", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.VerifyKeySource, err = envBool("VERIFY_KEY_SOURCE", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.VerifyContentLength, err = envBool("VERIFY_CONTENT_LENGTH", false); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.UpstreamQueryAllowed = envList("UPSTREAM_QUERY_ALLOWED")
+	if cfg.FollowUpstreamRedirects, err = envBool("FOLLOW_UPSTREAM_REDIRECTS", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UpstreamMaxRedirects, err = envInt("UPSTREAM_MAX_REDIRECTS", 5); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UpstreamMaxRedirects < 1 {
+		errs = append(errs, fmt.Errorf("UPSTREAM_MAX_REDIRECTS must be at least 1"))
+	}
+	if cfg.UpstreamErrorPassthrough, err = envBool("UPSTREAM_ERROR_PASSTHROUGH", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ExposeCacheKey, err = envBool("EXPOSE_CACHE_KEY", false); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CacheRules, err = loadCacheRules(getenv("CACHE_RULES_FILE")); err != nil {
+		errs = append(errs, err)
+	}
+	for _, h := range envList("NO_CACHE_HEADERS") {
+		cfg.NoCacheHeaders = append(cfg.NoCacheHeaders, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range envList("VARY_HEADERS") {
+		cfg.VaryHeaders = append(cfg.VaryHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	switch cfg.AccessLogFormat {
+	case accessLogNone, accessLogCombined, accessLogJSON:
+	default:
+		errs = append(errs, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q", cfg.AccessLogFormat))
+	}
+
+	for _, v := range envList("ERROR_PIXEL_STATUSES") {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 400 || status > 599 {
+			errs = append(errs, fmt.Errorf("invalid ERROR_PIXEL_STATUSES entry %q, expected an error status", v))
+			continue
+		}
+		cfg.ErrorPixelStatuses = append(cfg.ErrorPixelStatuses, status)
+	}
+	if cfg.ErrorPixelFormat != errorPixelGIF && cfg.ErrorPixelFormat != errorPixelPNG {
+		errs = append(errs, fmt.Errorf("invalid ERROR_PIXEL_FORMAT %q, expected gif or png", cfg.ErrorPixelFormat))
+	}
+	switch cfg.MissingSourceBehavior {
+	case missingSourcePassthrough, missingSourceNegativeCache:
+	case missingSourceFallback:
+		if cfg.FallbackImagePath == "" {
+			errs = append(errs, fmt.Errorf("FALLBACK_IMAGE_PATH is required when MISSING_SOURCE_BEHAVIOR=%s", missingSourceFallback))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid MISSING_SOURCE_BEHAVIOR %q", cfg.MissingSourceBehavior))
+	}
+
+	if cfg.S3ObjectACL != "" && !slices.Contains(cfg.S3ObjectACL.Values(), cfg.S3ObjectACL) {
+		// An unsupported ACL would make every upload fail, upload without it instead
+		slog.Warn("Ignoring unknown S3_OBJECT_ACL", "acl", cfg.S3ObjectACL, "known", cfg.S3ObjectACL.Values())
+		cfg.S3ObjectACL = ""
+	}
+
+	// Last, once every variable was read
+	strict, err := envBool("STRICT_CONFIG", false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkEnvTypos(strict); err != nil {
+		errs = append(errs, err)
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+func envString(name, def string) string {
+	if v := getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt and the other env parsers return def along with the error, so the
+// settings derived from an invalid value don't report errors of their own
+func envInt(name string, def int) (int, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return i, nil
+}
+
+func envFloat(name string, def float64) (float64, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return f, nil
+}
+
+func envBool(name string, def bool) (bool, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// envList parses a comma separated list, ignoring blank entries
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envSeconds parses an integer number of seconds
+func envSeconds(name string, def time.Duration) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return time.Duration(t) * time.Second, nil
+}
+
+// envDuration parses a Go duration string such as "30s" or "5m"
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return d, nil
+}
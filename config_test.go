@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+	t.Setenv("S3_BUCKET", testBucket)
+	bad := map[string]string{
+		"CACHE_KEY_LENGTH":      "4",
+		"UPLOAD_SAMPLE_RATE":    "2",
+		"SHUTDOWN_TIMEOUT":      "soon",
+		"MAX_CONNECTIONS":       "many",
+		"ACCESS_LOG_FORMAT":     "xml",
+		"ERROR_PIXEL_STATUSES":  "200,abc",
+		"MIN_CACHE_OBJECT_SIZE": "big",
+	}
+	for name, value := range bad {
+		t.Setenv(name, value)
+	}
+
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig succeeded")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	for _, want := range []string{
+		"CACHE_KEY_LENGTH must be 0 or between",
+		"UPLOAD_SAMPLE_RATE must be between 0 and 1",
+		"failed to parse SHUTDOWN_TIMEOUT",
+		"failed to parse MAX_CONNECTIONS",
+		`invalid ACCESS_LOG_FORMAT "xml"`,
+		`invalid ERROR_PIXEL_STATUSES entry "200"`,
+		`invalid ERROR_PIXEL_STATUSES entry "abc"`,
+		"failed to parse MIN_CACHE_OBJECT_SIZE",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %q:\n%v", want, err)
+		}
+	}
+	// An unparsable value falls back to its default, it isn't validated again
+	if len(lines) != 8 {
+		t.Errorf("got %d errors, want 8:\n%v", len(lines), err)
+	}
+}
+
+func TestLoadConfigBounds(t *testing.T) {
+	tests := []struct {
+		name, value string
+		wantErr     bool
+	}{
+		{name: "UPSTREAM_CONCURRENCY", value: "0"},
+		{name: "UPSTREAM_CONCURRENCY", value: "4"},
+		{name: "UPSTREAM_CONCURRENCY", value: "-1", wantErr: true},
+		{name: "MAX_TOTAL_BUFFER_BYTES", value: "0"},
+		{name: "MAX_TOTAL_BUFFER_BYTES", value: "-1", wantErr: true},
+		{name: "UPLOAD_MIN_SEEN", value: "1"},
+		{name: "UPLOAD_MIN_SEEN", value: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+			t.Setenv("S3_BUCKET", testBucket)
+			t.Setenv(tt.name, tt.value)
+			_, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("error doesn't mention %s: %v", tt.name, err)
+			}
+		})
+	}
+}
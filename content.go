@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// contentKeyMetadataKey marks a pointer object, holding the key of the
+// content object it stands for
+const contentKeyMetadataKey = "content-key"
+
+// contentKey is where a body of type t is stored in CONTENT_ADDRESSED mode,
+// named after the hash of its bytes. Content objects are shared by every URL
+// rendering the same bytes, so they are neither date partitioned nor tied to
+// a request.
+func contentKey(cfg Config, t contentType, digest string) string {
+	key := "content/" + cfg.KeyShards.prefix(digest) + digest
+	if cfg.CacheVersion != "" {
+		key = cfg.CacheVersion + "/" + key
+	}
+	return objectFolder(cfg, t) + key
+}
+
+// uploadContentAddressed buffers a body of at most CONTENT_ADDRESSED_MAX_SIZE
+// to hash it, stores it under its content key unless an identical render is
+// already there, then makes key a pointer to it. Larger bodies are uploaded
+// under key as usual.
+func (s *server) uploadContentAddressed(ctx context.Context, r io.Reader, size int64, path, key string, t contentType, meta objectMeta) error {
+	cfg := s.config()
+	body, err := io.ReadAll(io.LimitReader(r, cfg.ContentAddressedMaxSize+1))
+	if err != nil {
+		return fmt.Errorf("read upload data failed: %w", err)
+	}
+	if int64(len(body)) > cfg.ContentAddressedMaxSize {
+		return s.uploadToS3(ctx, io.MultiReader(bytes.NewReader(body), r), size, path, key, meta)
+	}
+
+	sum := sha256.Sum256(body)
+	target := contentKey(*cfg, t, hex.EncodeToString(sum[:]))
+	_, err = s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(cfg.S3Bucket),
+		Key:    aws.String(target),
+	})
+	switch {
+	case err == nil:
+		s.stats.uploadsDeduplicated.Add(1)
+		slog.Info("Render already stored, only writing the pointer", "path", path, "key", key, "content_key", target)
+	case isNotFound(err):
+		// The content object is shared, what the request was derived from
+		// belongs on the pointer
+		contentMeta := meta
+		contentMeta.KeySource = ""
+		if err := s.uploadToS3(ctx, bytes.NewReader(body), int64(len(body)), path, target, contentMeta); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("head content object failed: %w", err)
+	}
+	return s.putPointer(ctx, key, target, meta)
+}
+
+// putPointer stores an empty object at key pointing to target, through its
+// metadata and a website redirect, which S3 website endpoints follow
+func (s *server) putPointer(ctx context.Context, key, target string, meta objectMeta) error {
+	cfg := s.config()
+	input := &s3.PutObjectInput{
+		Bucket:                  aws.String(cfg.S3Bucket),
+		Key:                     aws.String(key),
+		Body:                    bytes.NewReader(nil),
+		ContentLength:           aws.Int64(0),
+		ACL:                     cfg.S3ObjectACL,
+		WebsiteRedirectLocation: aws.String("/" + target),
+		Metadata: map[string]string{
+			statusMetadataKey:     strconv.Itoa(meta.StatusCode),
+			contentKeyMetadataKey: target,
+		},
+	}
+	if meta.KeySource != "" {
+		input.Metadata[keySourceMetadataKey] = meta.KeySource
+	}
+	// Kept so the admin lookup promotes the pointer to the right folder
+	if meta.ContentType != "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+	if meta.CacheControl != "" {
+		input.CacheControl = aws.String(meta.CacheControl)
+	}
+	if _, err := s.s3.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("put pointer failed: %w", err)
+	}
+	s.mirrorObject(key)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestContentAddressed(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxSize      int
+		sameBytes    bool
+		contentKeys  int
+		deduplicated int64
+	}{
+		{name: "identical renders", maxSize: len(testPNG), sameBytes: true, contentKeys: 1, deduplicated: 1},
+		{name: "different renders", maxSize: len(testPNG) + 1, contentKeys: 2},
+		{name: "above the size limit", maxSize: len(testPNG) - 1, sameBytes: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renders := 0
+			e := newTestEnv(t, map[string]string{
+				"ADMIN_TOKEN":                "secret",
+				"CONTENT_ADDRESSED":          "true",
+				"CONTENT_ADDRESSED_MAX_SIZE": strconv.Itoa(tt.maxSize),
+			}, func(w http.ResponseWriter, r *http.Request) {
+				body := testPNG
+				if renders++; !tt.sameBytes && renders > 1 {
+					body = append(bytes.Clone(testPNG), 0)
+				}
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(body)
+			})
+			paths := []string{renderPath("local:///a"), renderPath("local:///b")}
+			for _, path := range paths {
+				if resp := e.get(path); resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: status = %d", path, resp.StatusCode)
+				}
+			}
+
+			var content []string
+			for _, key := range e.s3.keys(testBucket) {
+				if strings.HasPrefix(key, "content/") {
+					content = append(content, key)
+				}
+			}
+			if len(content) != tt.contentKeys {
+				t.Errorf("content objects %v, want %d", content, tt.contentKeys)
+			}
+			if got := len(e.s3.keys(testBucket)); got != len(paths)+tt.contentKeys {
+				t.Errorf("bucket has %d objects, want %d", got, len(paths)+tt.contentKeys)
+			}
+			if got := e.srv.stats.uploadsDeduplicated.Load(); got != tt.deduplicated {
+				t.Errorf("uploads_deduplicated = %d, want %d", got, tt.deduplicated)
+			}
+
+			// The admin lookup follows a pointer to the body it stands for
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+paths[0]).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists || (status.ContentKey != "") != (tt.contentKeys > 0) {
+				t.Errorf("status = %+v", status)
+			}
+			if status.ContentKey != "" {
+				obj, ok := e.s3.object(status.ContentKey)
+				if !ok || !bytes.Equal(obj.body, testPNG) {
+					t.Errorf("content object %q doesn't hold the render", status.ContentKey)
+				}
+			}
+		})
+	}
+}
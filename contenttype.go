@@ -0,0 +1,49 @@
+package main
+
+import (
+	"mime"
+	"strings"
+)
+
+// contentType is a response content type normalized to a small known set so
+// per-type stats stay bounded whatever upstream sends
+type contentType int
+
+const (
+	contentTypeJPEG contentType = iota
+	contentTypePNG
+	contentTypeWebP
+	contentTypeAVIF
+	contentTypeGIF
+	contentTypeSVG
+	contentTypeOther
+	numContentTypes
+)
+
+var contentTypeNames = [numContentTypes]string{"jpeg", "png", "webp", "avif", "gif", "svg", "other"}
+
+func (t contentType) String() string {
+	return contentTypeNames[t]
+}
+
+func normalizeContentType(header string) contentType {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(header))
+	}
+	switch mediaType {
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return contentTypeJPEG
+	case "image/png":
+		return contentTypePNG
+	case "image/webp":
+		return contentTypeWebP
+	case "image/avif":
+		return contentTypeAVIF
+	case "image/gif":
+		return contentTypeGIF
+	case "image/svg+xml":
+		return contentTypeSVG
+	}
+	return contentTypeOther
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		header string
+		want   contentType
+	}{
+		{header: "image/jpeg", want: contentTypeJPEG},
+		{header: "image/pjpeg", want: contentTypeJPEG},
+		{header: "IMAGE/PNG; charset=binary", want: contentTypePNG},
+		{header: "image/webp", want: contentTypeWebP},
+		{header: "image/avif", want: contentTypeAVIF},
+		{header: "image/gif", want: contentTypeGIF},
+		{header: "image/svg+xml", want: contentTypeSVG},
+		{header: "image/heic", want: contentTypeOther},
+		{header: "", want: contentTypeOther},
+		{header: ";;", want: contentTypeOther},
+	}
+	for _, tt := range tests {
+		if got := normalizeContentType(tt.header); got != tt.want {
+			t.Errorf("normalizeContentType(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestStatsByContentType(t *testing.T) {
+	e := newTestEnv(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.Header.Get("X-Render-Type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(testPNG)))
+		w.Write(testPNG)
+	})
+	e.s3.setFail(func(r *http.Request) int {
+		if r.Method == http.MethodPut && r.Header.Get("Content-Type") == "image/avif" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	for i, ct := range []string{"image/webp", "image/webp", "image/avif", "image/x-unknown", "image/jpeg; q=1"} {
+		req := httptest.NewRequest(http.MethodGet, renderPath("local:///"+strconv.Itoa(i)), nil)
+		req.Header.Set("X-Render-Type", ct)
+		e.do(req)
+	}
+
+	var stats statsSnapshot
+	if err := json.NewDecoder(e.get("/stats").Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.ContentTypes) != int(numContentTypes) {
+		t.Errorf("got %d content types, want %d", len(stats.ContentTypes), numContentTypes)
+	}
+	want := map[string]contentTypeSnapshot{
+		"webp":  {Renders: 2, Uploads: 2},
+		"avif":  {Renders: 1, UploadFailures: 1},
+		"other": {Renders: 1, Uploads: 1},
+		"jpeg":  {Renders: 1, Uploads: 1},
+		"png":   {},
+	}
+	for name, w := range want {
+		if got := stats.ContentTypes[name]; got != w {
+			t.Errorf("%s = %+v, want %+v", name, got, w)
+		}
+	}
+}
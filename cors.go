@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// servePreflight answers CORS preflight requests itself: imgproxy has no use
+// for them and they must never reach the cache. Disallowed origins get no
+// CORS headers, which makes the browser refuse the actual request.
+func servePreflight(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin != "" && r.Header.Get("Access-Control-Request-Method") != "" && corsOriginAllowed(cfg.CORSAllowedOrigins, origin) {
+		h := w.Header()
+		if slices.Contains(cfg.CORSAllowedOrigins, "*") {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(cfg.CORSAllowedMethods, ", "))
+		if len(cfg.CORSAllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(cfg.CORSAllowedHeaders, ", "))
+		}
+		if cfg.CORSMaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func corsOriginAllowed(allowed []string, origin string) bool {
+	return slices.Contains(allowed, "*") || slices.Contains(allowed, origin)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	env := map[string]string{
+		"CORS_ALLOWED_ORIGINS": "https://app.example.com",
+		"CORS_ALLOWED_HEADERS": "X-Device-Type",
+		"CORS_MAX_AGE":         "10m",
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		origin  string
+		method  string
+		allowed string
+		methods string
+		headers string
+		maxAge  string
+	}{
+		{name: "allowed origin", env: env, origin: "https://app.example.com", method: "GET", allowed: "https://app.example.com", methods: "GET, HEAD", headers: "X-Device-Type", maxAge: "600"},
+		{name: "disallowed origin", env: env, origin: "https://evil.example.com", method: "GET"},
+		{name: "not a preflight", env: env, origin: "https://app.example.com"},
+		{name: "no origin", env: env, method: "GET"},
+		{name: "any origin", env: map[string]string{"CORS_ALLOWED_ORIGINS": "*", "CORS_ALLOWED_METHODS": "GET"}, origin: "https://other.example.com", method: "GET", allowed: "*", methods: "GET"},
+		{name: "no origins configured", env: nil, origin: "https://app.example.com", method: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.env, nil)
+			req := httptest.NewRequest(http.MethodOptions, testImagePath, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.method != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.method)
+			}
+			resp := e.do(req)
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", resp.StatusCode)
+			}
+			for name, want := range map[string]string{
+				"Access-Control-Allow-Origin":  tt.allowed,
+				"Access-Control-Allow-Methods": tt.methods,
+				"Access-Control-Allow-Headers": tt.headers,
+				"Access-Control-Max-Age":       tt.maxAge,
+				"Vary":                         "Origin",
+			} {
+				if got := resp.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if n := len(e.img.renders()); n != 0 {
+				t.Errorf("the preflight was forwarded to imgproxy %d times", n)
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 0 {
+				t.Errorf("uploaded %v", keys)
+			}
+		})
+	}
+}
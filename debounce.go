@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// uploadDebouncer drops uploads of a key that was already uploaded within the
+// window, coalescing the bursts of identical misses a page load produces.
+// The first upload isn't delayed: it's fed by the client stream, holding it
+// would hold the client too.
+type uploadDebouncer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	recent  map[string]time.Time
+	purgeAt int
+}
+
+func newUploadDebouncer(window time.Duration) *uploadDebouncer {
+	return &uploadDebouncer{window: window, recent: make(map[string]time.Time), purgeAt: 1024}
+}
+
+// allow reports whether key may be uploaded now
+func (d *uploadDebouncer) allow(key string) bool {
+	if d.window <= 0 {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := d.recent[key]; ok && now.Sub(last) < d.window {
+		return false
+	}
+	d.recent[key] = now
+
+	// Keep the map from growing with keys whose window is long gone
+	if len(d.recent) >= d.purgeAt {
+		for k, t := range d.recent {
+			if now.Sub(t) >= d.window {
+				delete(d.recent, k)
+			}
+		}
+		d.purgeAt = max(1024, 2*len(d.recent))
+	}
+	return true
+}
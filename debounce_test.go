@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUploadDebouncer(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		keys   []string
+		want   []bool
+	}{
+		{name: "disabled", window: 0, keys: []string{"a", "a", "a"}, want: []bool{true, true, true}},
+		{name: "rapid duplicates", window: time.Minute, keys: []string{"a", "a", "a"}, want: []bool{true, false, false}},
+		{name: "distinct keys", window: time.Minute, keys: []string{"a", "b", "a", "b"}, want: []bool{true, true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newUploadDebouncer(tt.window)
+			for i, key := range tt.keys {
+				if got := d.allow(key); got != tt.want[i] {
+					t.Errorf("allow(%q) #%d = %v, want %v", key, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUploadDebouncerWindowEnds(t *testing.T) {
+	d := newUploadDebouncer(20 * time.Millisecond)
+	d.allow("a")
+	time.Sleep(30 * time.Millisecond)
+	if !d.allow("a") {
+		t.Error("a key was still debounced after its window")
+	}
+}
+
+func TestUploadDebouncerPurges(t *testing.T) {
+	d := newUploadDebouncer(time.Millisecond)
+	for i := range 1023 {
+		d.allow(string(rune(i)))
+	}
+	time.Sleep(2 * time.Millisecond)
+	// The 1024th key triggers the purge of the expired ones
+	d.allow("last")
+	if n := len(d.recent); n != 1 {
+		t.Errorf("%d keys remembered, want only the last one", n)
+	}
+}
+
+func TestRapidDuplicateUploads(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"UPLOAD_DEBOUNCE": "1m"}, nil)
+	for range 5 {
+		if resp := e.get(testImagePath); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	if n := e.s3.calls("PUT"); n != 1 {
+		t.Errorf("%d uploads, want 1", n)
+	}
+	if got := e.srv.stats.uploadsDebounced.Load(); got != 4 {
+		t.Errorf("uploads_debounced = %d, want 4", got)
+	}
+}
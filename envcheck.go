@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readEnv records the environment variables the configuration reads, so
+// the ones set but never read can be told apart
+var readEnv struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// getenv is os.Getenv for configuration variables
+func getenv(name string) string {
+	readEnv.mu.Lock()
+	if readEnv.names == nil {
+		readEnv.names = make(map[string]bool)
+	}
+	readEnv.names[name] = true
+	readEnv.mu.Unlock()
+	return os.Getenv(name)
+}
+
+// foreignEnvPrefixes belong to the other programs sharing the environment
+var foreignEnvPrefixes = []string{"IMGPROXY_", "AWS_"}
+
+// checkEnvTypos reports the variables set in the environment that aren't
+// read but are a couple of edits away from one that is, like S3_BUCKETT. All
+// of them are logged, with strict they also fail the configuration. Must run
+// once every variable was read.
+func checkEnvTypos(strict bool) error {
+	readEnv.mu.Lock()
+	defer readEnv.mu.Unlock()
+
+	var typos []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if readEnv.names[name] || len(name) < 6 || hasAnyPrefix(name, foreignEnvPrefixes) {
+			continue
+		}
+		for known := range readEnv.names {
+			if editDistance(name, known) <= 2 {
+				slog.Warn("Unknown environment variable, possibly a typo", "name", name, "did_you_mean", known)
+				typos = append(typos, fmt.Sprintf("%s (did you mean %s?)", name, known))
+				break
+			}
+		}
+	}
+	if strict && len(typos) > 0 {
+		return fmt.Errorf("unknown environment variables: %s", strings.Join(typos, ", "))
+	}
+	return nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
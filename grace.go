@@ -0,0 +1,86 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// graceWriter sends a 103 Early Hints every interval until the response
+// starts, so intermediaries with idle timeouts keep the connection of a slow
+// render open. Headers set before the response starts are held back: the
+// hints must not leak them, nor race with their writer.
+type graceWriter struct {
+	http.ResponseWriter
+
+	mu      sync.Mutex
+	started bool
+	header  http.Header
+	done    chan struct{}
+}
+
+func newGraceWriter(w http.ResponseWriter, interval time.Duration) *graceWriter {
+	g := &graceWriter{ResponseWriter: w, header: make(http.Header), done: make(chan struct{})}
+	go g.hint(interval)
+	return g
+}
+
+func (g *graceWriter) hint(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+		g.mu.Lock()
+		if !g.started {
+			g.ResponseWriter.WriteHeader(http.StatusEarlyHints)
+		}
+		g.mu.Unlock()
+	}
+}
+
+// stop ends the hints, it must be called once the handler returns
+func (g *graceWriter) stop() {
+	close(g.done)
+}
+
+func (g *graceWriter) Header() http.Header {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.started {
+		return g.ResponseWriter.Header()
+	}
+	return g.header
+}
+
+func (g *graceWriter) start() {
+	if !g.started {
+		g.started = true
+		maps.Copy(g.ResponseWriter.Header(), g.header)
+	}
+}
+
+func (g *graceWriter) WriteHeader(code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if code >= 200 {
+		g.start()
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *graceWriter) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	g.start()
+	g.mu.Unlock()
+	return g.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the flusher of the connection
+func (g *graceWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowRenderGrace(t *testing.T) {
+	tests := []struct {
+		name   string
+		grace  string
+		render time.Duration
+		hints  bool
+	}{
+		{name: "slow render", grace: "20ms", render: 150 * time.Millisecond, hints: true},
+		{name: "fast render", grace: "1s", render: 0},
+		{name: "disabled", grace: "0s", render: 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"SLOW_RENDER_GRACE": tt.grace}, func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.render)
+				servePNG(w, r)
+			})
+			srv := httptest.NewServer(e.srv)
+			t.Cleanup(srv.Close)
+
+			var mu sync.Mutex
+			var hints []textproto.MIMEHeader
+			trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header)
+				}
+				return nil
+			}}
+			req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL+testImagePath, nil)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testPNG) {
+				t.Errorf("status = %d, the image wasn't served", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", got)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if (len(hints) > 0) != tt.hints {
+				t.Errorf("got %d early hints, want some = %v", len(hints), tt.hints)
+			}
+			// The final response's headers must not leak into the hints
+			for _, h := range hints {
+				if h.Get("Content-Type") != "" || h.Get("X-Cache") != "" {
+					t.Errorf("hint carried %v", h)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipHandler compresses the responses of the JSON endpoints for clients
+// accepting gzip. Never wrap the image path with it: rendered images carry
+// their own encoding, and are already compressed anyway.
+func gzipHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next(&gzipWriter{ResponseWriter: w, gz: gz}, r)
+	}
+}
+
+// acceptsGzip reports whether gzip is listed, or covered by "*", without a
+// zero quality. A gzip entry takes precedence over "*".
+func acceptsGzip(header string) bool {
+	wildcard := false
+	for _, enc := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		name = strings.TrimSpace(name)
+		switch {
+		case strings.EqualFold(name, "gzip"):
+			return encodingQuality(params) > 0
+		case name == "*":
+			wildcard = encodingQuality(params) > 0
+		}
+	}
+	return wildcard
+}
+
+// encodingQuality is the q parameter of an Accept-Encoding entry, 1 when
+// absent and 0 when it doesn't parse
+func encodingQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
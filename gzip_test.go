@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "br, GZIP;q=0.5", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "gzip; q=0.000", want: false},
+		{header: "gzip;q=0.00", want: false},
+		{header: "gzip; q=0", want: false},
+		{header: "gzip;q = 0.0", want: false},
+		{header: "gzip;q=0.001", want: true},
+		{header: "gzip;q=high", want: false},
+		{header: "deflate, br", want: false},
+		{header: "*", want: true},
+		{header: "br, *;q=0", want: false},
+		{header: "*;q=0, gzip", want: true},
+		{header: "gzip;q=0, *", want: false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestJSONEndpointsGzip(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		compressed bool
+	}{
+		{name: "stats", path: "/stats", accept: "gzip", compressed: true},
+		{name: "stats uncompressed", path: "/stats"},
+		{name: "stats gzip refused", path: "/stats", accept: "gzip;q=0"},
+		{name: "admin list", path: "/admin/list", accept: "gzip", compressed: true},
+		{name: "admin list uncompressed", path: "/admin/list"},
+		// The image path handles encoding on its own
+		{name: "image", path: testImagePath, accept: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			resp := e.do(req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.compressed {
+				t.Fatalf("compressed = %v, want %v", got, tt.compressed)
+			}
+			body := readAll(t, resp)
+			if tt.path == testImagePath {
+				if !bytes.Equal(body, testPNG) {
+					t.Error("the image was altered")
+				}
+				return
+			}
+			if tt.compressed {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !json.Valid(body) {
+				t.Errorf("body isn't JSON: %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const testBucket = "test-bucket"
+
+// testPNG is what the fake imgproxy renders unless told otherwise
+var testPNG = func() []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// fakeImgproxy answers /health and renders every other path with handler,
+// testPNG by default
+type fakeImgproxy struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newFakeImgproxy(t testing.TB, handler http.HandlerFunc) *fakeImgproxy {
+	t.Helper()
+	if handler == nil {
+		handler = servePNG
+	}
+	f := &fakeImgproxy{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.Write([]byte("imgproxy is running"))
+			return
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Clone(r.Context()))
+		f.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func servePNG(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(testPNG)))
+	w.Write(testPNG)
+}
+
+// renders returns the requests imgproxy received, /health excluded
+func (f *fakeImgproxy) renders() []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// scriptedHealth is an imgproxy whose health checks answer statuses in
+// turn, the last one repeating. checks counts the checks received.
+func scriptedHealth(t testing.TB, statuses ...int) (srv *httptest.Server, checks func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	n := 0
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		status := statuses[min(n, len(statuses)-1)]
+		n++
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+type fakeObject struct {
+	body     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// fakeS3 is an in-memory, path style S3 endpoint implementing what the
+// proxy calls: objects, multipart uploads, copies, listings and HeadBucket.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject // by bucket/key
+	uploads  map[string]map[int][]byte
+	initial  map[string]http.Header
+	nextID   int
+	requests []string
+	// fail, when set, answers a request with the returned status instead
+	// of handling it, 0 letting it through
+	fail func(r *http.Request) int
+	// delay, when set, is slept before handling each request
+	delay time.Duration
+}
+
+func newFakeS3(t testing.TB) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]map[int][]byte),
+		initial: make(map[string]http.Header),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// client returns an S3 client for the endpoint. The SDK doesn't retry, so
+// injected failures surface as they are.
+func (f *fakeS3) client() *s3.Client {
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(f.URL),
+		Region:       "auto",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+		Retryer:      aws.NopRetryer{},
+	})
+}
+
+// storedHeaders are the request headers kept with an object and sent back
+// on GET and HEAD
+func storedHeaders(h http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range h {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") || strings.HasPrefix(lower, "x-amz-website-") ||
+			lower == "content-type" || lower == "cache-control" || lower == "x-amz-acl" {
+			out[name] = values
+		}
+	}
+	// The SDK may frame streamed bodies with aws-chunked
+	var encodings []string
+	for _, e := range strings.Split(h.Get("Content-Encoding"), ",") {
+		if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+			encodings = append(encodings, e)
+		}
+	}
+	if len(encodings) > 0 {
+		out.Set("Content-Encoding", strings.Join(encodings, ","))
+	}
+	return out
+}
+
+// readBody returns the request payload, unframing aws-chunked bodies
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") &&
+		!strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	var body []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", line)
+		}
+		if size == 0 {
+			return body, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+key)
+	fail, delay := f.fail, f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+	if fail != nil {
+		if status := fail(r); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	var body []byte
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		var err error
+		if body, err = readBody(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := bucket + "/" + key
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, bucket, q)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		f.initial[id] = storedHeaders(r.Header)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		id := q.Get("uploadId")
+		parts, ok := f.uploads[id]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[name] = &fakeObject{body: data, header: f.initial[id], modified: time.Now()}
+		delete(f.uploads, id)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>"x"</ETag></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+		src, ok := f.objects[source]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		header := src.header
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			header = storedHeaders(r.Header)
+		}
+		f.objects[name] = &fakeObject{body: src.body, header: header, modified: time.Now()}
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"x"</ETag></CopyObjectResult>`)
+	case r.Method == http.MethodPut:
+		f.objects[name] = &fakeObject{body: body, header: storedHeaders(r.Header), modified: time.Now()}
+		w.Header().Set("ETag", `"x"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := f.objects[name]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range o.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.body)))
+		w.Header().Set("ETag", `"x"`)
+		if r.Method == http.MethodGet {
+			w.Write(o.body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, q url.Values) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		KeyCount              int
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, q.Get("prefix")) && key > q.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var out result
+	if max, err := strconv.Atoi(q.Get("max-keys")); err == nil && max < len(keys) {
+		keys = keys[:max]
+		out.IsTruncated, out.NextContinuationToken = true, keys[max-1]
+	}
+	for _, key := range keys {
+		o := f.objects[bucket+"/"+key]
+		out.Contents = append(out.Contents, content{key, len(o.body), o.modified.UTC().Format(time.RFC3339)})
+	}
+	out.KeyCount = len(keys)
+	xml.NewEncoder(w).Encode(out)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// object returns what is stored under key in the test bucket
+func (f *fakeS3) object(key string) (*fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[testBucket+"/"+key]
+	return o, ok
+}
+
+// keys lists the keys stored in bucket
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) put(key string, body []byte, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[testBucket+"/"+key] = &fakeObject{body: body, header: header, modified: time.Now()}
+}
+
+// calls counts the requests received with method, optionally on key
+func (f *fakeS3) calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeS3) setFail(fail func(r *http.Request) int) {
+	f.mu.Lock()
+	f.fail = fail
+	f.mu.Unlock()
+}
+
+func (f *fakeS3) setDelay(d time.Duration) {
+	f.mu.Lock()
+	f.delay = d
+	f.mu.Unlock()
+}
+
+// testEnv is a server wired to a fake imgproxy and a fake S3, plus a second
+// one as the mirror when MIRROR_S3_BUCKET is set
+type testEnv struct {
+	t      testing.TB
+	img    *fakeImgproxy
+	s3     *fakeS3
+	mirror *fakeS3
+	srv    *server
+}
+
+// testConfig loads the configuration from env like main does, on top of
+// the settings every configuration needs
+func testConfig(t testing.TB, env map[string]string) Config {
+	t.Helper()
+	t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+	t.Setenv("S3_BUCKET", testBucket)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// newTestEnv configures the server through the environment, env overriding
+// the defaults pointing it at the fakes
+func newTestEnv(t testing.TB, env map[string]string, handler http.HandlerFunc) *testEnv {
+	t.Helper()
+	e := &testEnv{t: t, img: newFakeImgproxy(t, handler), s3: newFakeS3(t)}
+	defaults := map[string]string{"UPSTREAM_URL": e.img.URL, "S3_ENDPOINT": e.s3.URL}
+	var mirrorClient *s3.Client
+	if env["MIRROR_S3_BUCKET"] != "" {
+		e.mirror = newFakeS3(t)
+		defaults["MIRROR_S3_ENDPOINT"] = e.mirror.URL
+		mirrorClient = e.mirror.client()
+	}
+	cfg := testConfig(t, mergeEnv(defaults, env))
+	target, _ := url.Parse(cfg.UpstreamURL)
+	upstream, err := upstreamTransport(cfg)
+	if err != nil {
+		t.Fatalf("upstreamTransport: %v", err)
+	}
+	if e.srv, err = newServer(cfg, e.s3.client(), mirrorClient, target, upstream); err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	t.Cleanup(e.srv.uploads.Wait)
+	return e
+}
+
+func mergeEnv(base, overrides map[string]string) map[string]string {
+	env := maps.Clone(base)
+	maps.Copy(env, overrides)
+	return env
+}
+
+// do serves req and waits for the uploads it started
+func (e *testEnv) do(req *http.Request) *http.Response {
+	e.t.Helper()
+	rec := httptest.NewRecorder()
+	e.srv.ServeHTTP(rec, req)
+	e.srv.uploads.Wait()
+	return rec.Result()
+}
+
+func (e *testEnv) get(path string) *http.Response {
+	return e.do(httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// admin sends an authenticated admin request, ADMIN_TOKEN being "secret"
+func (e *testEnv) admin(method, path string) *http.Response {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	return e.do(req)
+}
+
+func readAll(t *testing.T, resp *http.Response) []byte {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return b
+}
+
+// renderPath is a processing path rendering src, encoded as imgproxy
+// base64 sources are
+func renderPath(src string) string {
+	return "/insecure/rs:fit:100:100/" + base64.RawURLEncoding.EncodeToString([]byte(src))
+}
+
+// freeAddr returns a loopback address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// noKeepAlive opens a connection per request: an idle connection dialed by
+// the transport but never used holds up Shutdown for seconds
+var noKeepAlive = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// waitReady waits for the server on addr to report ready
+func waitReady(t *testing.T, addr string) {
+	t.Helper()
+	for range 100 {
+		if resp, err := noKeepAlive.Get("http://" + addr + "/readyz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never got ready", addr)
+}
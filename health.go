@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// upstreamHealth tracks whether imgproxy is currently answering its health checks
+type upstreamHealth struct {
+	healthy atomic.Bool
+}
+
+// newUpstreamHealth starts healthy since it is created once the startup check passed
+func newUpstreamHealth() *upstreamHealth {
+	h := &upstreamHealth{}
+	h.healthy.Store(true)
+	return h
+}
+
+func (h *upstreamHealth) Healthy() bool {
+	return h.healthy.Load()
+}
+
+// poll checks imgproxy every interval (with up to 10% jitter so several
+// instances don't probe in lockstep). It flips to unhealthy after threshold
+// consecutive failures and back to healthy after HEALTH_CHECK_SUCCESS_THRESHOLD
+// consecutive successes.
+func (h *upstreamHealth) poll(ctx context.Context, target string, transport http.RoundTripper, cfg Config) {
+	client := &http.Client{Transport: transport, Timeout: cfg.HealthCheckAttemptTimeout}
+	interval, threshold := cfg.HealthPollInterval, cfg.HealthPollFailureThreshold
+	failures, successes := 0, 0
+
+	for {
+		jitter := time.Duration(rand.Int64N(int64(interval/10) + 1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + jitter):
+		}
+
+		if err := checkHealth(client, target); err != nil {
+			failures++
+			successes = 0
+			if failures == threshold {
+				slog.Error("imgproxy became unhealthy", "failures", failures, "error", err)
+				h.healthy.Store(false)
+			}
+			continue
+		}
+
+		if failures < threshold {
+			failures = 0
+			continue
+		}
+		successes++
+		if successes == cfg.HealthCheckSuccessThreshold {
+			slog.Info("imgproxy recovered")
+			h.healthy.Store(true)
+			failures, successes = 0, 0
+		}
+	}
+}
+
+// readyzHandler ignores imgproxy's health during maintenance, since it is
+// expected to be down and misses are answered without it
+func readyzHandler(health *upstreamHealth, bucket *bucketHealth, maint *maintenance, draining *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if !health.Healthy() && !maint.Enabled() {
+			http.Error(w, "imgproxy unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !bucket.Healthy() {
+			http.Error(w, "bucket unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// bucketHealth tracks whether the bucket answers promptly enough for the
+// proxy to count as ready, a slow bucket backing up every upload
+type bucketHealth struct {
+	healthy atomic.Bool
+}
+
+func newBucketHealth() *bucketHealth {
+	h := &bucketHealth{}
+	h.healthy.Store(true)
+	return h
+}
+
+func (h *bucketHealth) Healthy() bool {
+	return h.healthy.Load()
+}
+
+// poll sends a HeadBucket every S3_READY_INTERVAL. A probe failing or taking
+// longer than S3_READY_MAX_LATENCY counts as a failure, with the same
+// thresholds as imgproxy's checks.
+func (h *bucketHealth) poll(ctx context.Context, client *s3.Client, cfg Config) {
+	threshold := cfg.HealthPollFailureThreshold
+	failures, successes := 0, 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.S3ReadyInterval):
+		}
+
+		start := time.Now()
+		probeCtx, cancel := context.WithTimeout(ctx, cfg.S3ReadyMaxLatency)
+		_, err := client.HeadBucket(probeCtx, &s3.HeadBucketInput{Bucket: aws.String(cfg.S3Bucket)})
+		cancel()
+		latency := time.Since(start)
+		if err == nil && latency > cfg.S3ReadyMaxLatency {
+			err = fmt.Errorf("took %s, above S3_READY_MAX_LATENCY", latency.Round(time.Millisecond))
+		}
+
+		if err != nil {
+			failures++
+			successes = 0
+			if failures == threshold {
+				slog.Error("Bucket became too slow or unreachable", "failures", failures, "error", err)
+				h.healthy.Store(false)
+			}
+			continue
+		}
+
+		if failures < threshold {
+			failures = 0
+			continue
+		}
+		successes++
+		if successes == cfg.HealthCheckSuccessThreshold {
+			slog.Info("Bucket recovered", "latency", latency)
+			h.healthy.Store(true)
+			failures, successes = 0, 0
+		}
+	}
+}
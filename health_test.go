@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthRecovery(t *testing.T) {
+	const ok, down = http.StatusOK, http.StatusServiceUnavailable
+	tests := []struct {
+		name     string
+		statuses []int
+		healthy  bool
+	}{
+		{name: "recovered", statuses: []int{down, down, ok, ok}, healthy: true},
+		{name: "flapping", statuses: []int{down, down, ok, down, ok, down}},
+		{name: "single failure", statuses: []int{ok, down, ok}, healthy: true},
+		{name: "down", statuses: []int{ok, down, down}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, checks := scriptedHealth(t, tt.statuses...)
+			cfg := testConfig(t, map[string]string{
+				"HEALTH_POLL_INTERVAL":           "1ms",
+				"HEALTH_POLL_FAILURE_THRESHOLD":  "2",
+				"HEALTH_CHECK_SUCCESS_THRESHOLD": "2",
+			})
+			h := newUpstreamHealth()
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan struct{})
+			go func() {
+				h.poll(ctx, img.URL, http.DefaultTransport, cfg)
+				close(done)
+			}()
+			// Past the script, the last status repeats
+			for checks() < len(tt.statuses)+3 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			if h.Healthy() != tt.healthy {
+				t.Errorf("healthy = %v, want %v", h.Healthy(), tt.healthy)
+			}
+		})
+	}
+}
+
+func TestBucketReadiness(t *testing.T) {
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		status int
+		ready  bool
+	}{
+		{name: "fast", ready: true},
+		{name: "slow", delay: 50 * time.Millisecond},
+		{name: "failing", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{
+				"S3_READY_INTERVAL":              "1ms",
+				"S3_READY_MAX_LATENCY":           "20ms",
+				"HEALTH_POLL_FAILURE_THRESHOLD":  "2",
+				"HEALTH_CHECK_SUCCESS_THRESHOLD": "2",
+			}, nil)
+			e.s3.setDelay(tt.delay)
+			if tt.status != 0 {
+				e.s3.setFail(func(r *http.Request) int { return tt.status })
+			}
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan struct{})
+			go func() {
+				e.srv.bucketHealth.poll(ctx, e.s3.client(), *e.srv.config())
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+			for e.s3.calls(http.MethodHead) < 3 {
+				time.Sleep(time.Millisecond)
+			}
+			want := http.StatusOK
+			if !tt.ready {
+				want = http.StatusServiceUnavailable
+			}
+			if resp := e.get("/readyz"); resp.StatusCode != want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, want)
+			}
+			if tt.ready {
+				return
+			}
+
+			// Back to ready once the bucket answers promptly again
+			e.s3.setDelay(0)
+			e.s3.setFail(nil)
+			deadline := time.Now().Add(5 * time.Second)
+			for e.get("/readyz").StatusCode != http.StatusOK {
+				if time.Now().After(deadline) {
+					t.Fatal("readiness never recovered")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestReadyzFollowsUpstreamHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		healthy bool
+	}{
+		{name: "up", status: http.StatusOK, healthy: true},
+		{name: "down", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, checks := scriptedHealth(t, tt.status)
+			e := newTestEnv(t, map[string]string{
+				"HEALTH_POLL_INTERVAL":          "1ms",
+				"HEALTH_POLL_FAILURE_THRESHOLD": "2",
+			}, nil)
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan struct{})
+			go func() {
+				e.srv.health.poll(ctx, img.URL, http.DefaultTransport, *e.srv.config())
+				close(done)
+			}()
+			for checks() < 3 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+
+			want := http.StatusOK
+			if !tt.healthy {
+				want = http.StatusServiceUnavailable
+			}
+			if resp := e.get("/readyz"); resp.StatusCode != want {
+				t.Errorf("/readyz status = %d, want %d", resp.StatusCode, want)
+			}
+			var stats statsSnapshot
+			if err := json.NewDecoder(e.get("/stats").Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats.UpstreamHealthy != tt.healthy {
+				t.Errorf("upstream_healthy = %v, want %v", stats.UpstreamHealthy, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		healthy     bool
+		maintenance bool
+		bucketDown  bool
+		draining    bool
+		status      int
+	}{
+		{name: "healthy", healthy: true, status: http.StatusOK},
+		{name: "unhealthy", status: http.StatusServiceUnavailable},
+		// imgproxy is expected to be down during maintenance
+		{name: "unhealthy in maintenance", maintenance: true, status: http.StatusOK},
+		{name: "bucket unhealthy", healthy: true, bucketDown: true, status: http.StatusServiceUnavailable},
+		{name: "draining", healthy: true, draining: true, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newUpstreamHealth()
+			h.healthy.Store(tt.healthy)
+			maint := newMaintenance(testConfig(t, nil))
+			maint.enabled.Store(tt.maintenance)
+			bucket := newBucketHealth()
+			bucket.healthy.Store(!tt.bucketDown)
+			var draining atomic.Bool
+			draining.Store(tt.draining)
+
+			rec := httptest.NewRecorder()
+			readyzHandler(h, bucket, maint, &draining)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status {
+				t.Errorf("/readyz status = %d, want %d", rec.Code, tt.status)
+			}
+
+			rec = httptest.NewRecorder()
+			statsHandler(h, newUpstreamLimiter(0, 0), maint, newBufferBudget(0), &counters{}, newUpstreamHeaderStats(nil), false)(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+			var stats statsSnapshot
+			if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+				t.Fatalf("decoding /stats: %v", err)
+			}
+			if stats.UpstreamHealthy != tt.healthy || stats.MaintenanceMode != tt.maintenance {
+				t.Errorf("stats = %+v, want upstream_healthy %v and maintenance_mode %v", stats, tt.healthy, tt.maintenance)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	healthzCheckTimeout = 2 * time.Second
+	// healthzCacheTTL keeps dashboards polling /healthz from hammering
+	// imgproxy and the bucket
+	healthzCacheTTL = 5 * time.Second
+)
+
+type dependencyStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthzReport struct {
+	Status           string            `json:"status"`
+	Imgproxy         dependencyStatus  `json:"imgproxy"`
+	S3               *dependencyStatus `json:"s3,omitempty"`
+	UpstreamInFlight int64             `json:"upstream_in_flight"`
+	// UpstreamSaturated is set when every UPSTREAM_CONCURRENCY slot is taken
+	UpstreamSaturated bool      `json:"upstream_saturated"`
+	MaintenanceMode   bool      `json:"maintenance_mode"`
+	Draining          bool      `json:"draining"`
+	CheckedAt         time.Time `json:"checked_at"`
+}
+
+// healthzChecker probes imgproxy and the bucket for /healthz, reusing the
+// last results for healthzCacheTTL. A single probe runs at a time, without
+// holding mu, the others serving the last results meanwhile.
+type healthzChecker struct {
+	client *http.Client
+	target string
+	s3     *s3.Client // nil when caching is disabled
+	bucket string
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	imgproxy  dependencyStatus
+	bucketS3  *dependencyStatus
+	// refreshing is closed once the running probe stored its results, nil
+	// when none is running
+	refreshing chan struct{}
+}
+
+func newHealthzChecker(cfg Config, target string, transport http.RoundTripper, client *s3.Client) *healthzChecker {
+	return &healthzChecker{
+		client: &http.Client{Transport: transport, Timeout: healthzCheckTimeout},
+		target: target,
+		s3:     client,
+		bucket: cfg.S3Bucket,
+	}
+}
+
+func (c *healthzChecker) check(ctx context.Context) (dependencyStatus, *dependencyStatus, time.Time) {
+	c.mu.Lock()
+	if time.Since(c.checkedAt) < healthzCacheTTL || (c.refreshing != nil && !c.checkedAt.IsZero()) {
+		defer c.mu.Unlock()
+		return c.imgproxy, c.bucketS3, c.checkedAt
+	}
+	if done := c.refreshing; done != nil {
+		// Nothing to serve before the first probe, which the check timeouts
+		// keep short
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.imgproxy, c.bucketS3, c.checkedAt
+	}
+	done := make(chan struct{})
+	c.refreshing = done
+	c.mu.Unlock()
+
+	// The results are shared, a client going away mustn't fail them
+	imgproxy := toDependencyStatus(checkHealth(c.client, c.target))
+	var bucket *dependencyStatus
+	if c.s3 != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthzCheckTimeout)
+		_, err := c.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucket)})
+		cancel()
+		status := toDependencyStatus(err)
+		bucket = &status
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.imgproxy, c.bucketS3, c.checkedAt = imgproxy, bucket, time.Now()
+	c.refreshing = nil
+	close(done)
+	return c.imgproxy, c.bucketS3, c.checkedAt
+}
+
+func toDependencyStatus(err error) dependencyStatus {
+	if err != nil {
+		return dependencyStatus{Error: err.Error()}
+	}
+	return dependencyStatus{OK: true}
+}
+
+// healthzHandler summarizes the state of the proxy and its dependencies.
+// It answers 503 when a dependency is down, imgproxy being expected down
+// during maintenance, or while shutting down.
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	report := healthzReport{
+		UpstreamInFlight: s.limiter.InFlight(),
+		MaintenanceMode:  s.maint.Enabled(),
+		Draining:         s.draining.Load(),
+	}
+	report.Imgproxy, report.S3, report.CheckedAt = s.healthz.check(r.Context())
+	report.UpstreamSaturated = cfg.UpstreamConcurrency > 0 && report.UpstreamInFlight >= int64(cfg.UpstreamConcurrency)
+
+	healthy := (report.Imgproxy.OK || report.MaintenanceMode) && (report.S3 == nil || report.S3.OK) && !report.Draining
+	report.Status = "ok"
+	status := http.StatusOK
+	if !healthy {
+		report.Status, status = "degraded", http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
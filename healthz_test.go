@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		imgproxyDown bool
+		bucketDown   bool
+		draining     bool
+		status       int
+	}{
+		{name: "healthy", status: http.StatusOK},
+		{name: "imgproxy down", imgproxyDown: true, status: http.StatusServiceUnavailable},
+		{name: "bucket down", bucketDown: true, status: http.StatusServiceUnavailable},
+		{name: "imgproxy down for maintenance", env: map[string]string{"MAINTENANCE_MODE": "true"}, imgproxyDown: true, status: http.StatusOK},
+		{name: "draining", draining: true, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.env, nil)
+			if tt.imgproxyDown {
+				e.img.Close()
+			}
+			if tt.bucketDown {
+				e.s3.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+			}
+			e.srv.draining.Store(tt.draining)
+
+			resp := e.get("/healthz")
+			var report healthzReport
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			wantStatus := "ok"
+			if tt.status != http.StatusOK {
+				wantStatus = "degraded"
+			}
+			if report.Status != wantStatus || report.Imgproxy.OK == tt.imgproxyDown || report.S3 == nil || report.S3.OK == tt.bucketDown {
+				t.Errorf("report = %+v", report)
+			}
+			if report.MaintenanceMode != (tt.env["MAINTENANCE_MODE"] == "true") || report.Draining != tt.draining {
+				t.Errorf("report = %+v", report)
+			}
+		})
+	}
+}
+
+func TestHealthzCachesChecks(t *testing.T) {
+	e := newTestEnv(t, nil, nil)
+	first := e.get("/healthz")
+	e.s3.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+	second := e.get("/healthz")
+	if first.StatusCode != http.StatusOK || second.StatusCode != http.StatusOK {
+		t.Errorf("statuses %d and %d, want the first result reused", first.StatusCode, second.StatusCode)
+	}
+	if n := e.s3.calls(http.MethodHead); n != 1 {
+		t.Errorf("%d bucket probes, want 1", n)
+	}
+}
+
+func TestHealthzServesStaleWhileProbing(t *testing.T) {
+	const delay = 500 * time.Millisecond
+	e := newTestEnv(t, nil, nil)
+	if resp := e.get("/healthz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	c := e.srv.healthz
+	c.mu.Lock()
+	c.checkedAt = c.checkedAt.Add(-healthzCacheTTL)
+	c.mu.Unlock()
+	e.s3.setDelay(delay)
+
+	probed := make(chan *http.Response)
+	go func() { probed <- e.get("/healthz") }()
+	for {
+		c.mu.Lock()
+		refreshing := c.refreshing != nil
+		c.mu.Unlock()
+		if refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	resp := e.get("/healthz")
+	if elapsed := time.Since(start); elapsed >= delay/2 {
+		t.Errorf("/healthz took %v during a probe, want the last report right away", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want the last report's 200", resp.StatusCode)
+	}
+	if resp := <-probed; resp.StatusCode != http.StatusOK {
+		t.Errorf("probing request: status = %d, want 200", resp.StatusCode)
+	}
+	if n := e.s3.calls(http.MethodHead); n != 2 {
+		t.Errorf("%d bucket probes, want 2", n)
+	}
+}
+
+func TestHealthzUpstreamSaturated(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"UPSTREAM_CONCURRENCY": "1"}, nil)
+	if ok, err := e.srv.limiter.Acquire(t.Context()); !ok || err != nil {
+		t.Fatalf("Acquire = %v, %v", ok, err)
+	}
+	defer e.srv.limiter.Release()
+	var report healthzReport
+	if err := json.NewDecoder(e.get("/healthz").Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.UpstreamSaturated || report.UpstreamInFlight != 1 {
+		t.Errorf("report = %+v, want saturated", report)
+	}
+}
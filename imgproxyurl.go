@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// imgproxyPath is a parsed imgproxy processing path:
+//
+//	/<signature>/<option>/.../<source>
+//
+// where options are name:arg1:arg2 segments and the source is either
+// plain/<url>[@ext] or a base64 encoded URL optionally split by slashes and
+// suffixed with .ext
+type imgproxyPath struct {
+	Signature string
+	Options   []string
+	Source    string
+}
+
+// parseImgproxyPath splits a processing path. It reports false for paths that
+// don't look like processing URLs (e.g. /health).
+func parseImgproxyPath(path string) (imgproxyPath, bool) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) < 2 || segments[0] == "" {
+		return imgproxyPath{}, false
+	}
+
+	p := imgproxyPath{Signature: segments[0]}
+	i := 1
+	// Option segments always contain a colon, which is neither part of the
+	// base64url alphabet nor of the "plain" marker
+	for ; i < len(segments) && segments[i] != "plain" && strings.Contains(segments[i], ":"); i++ {
+		p.Options = append(p.Options, segments[i])
+	}
+	if i == len(segments) {
+		return imgproxyPath{}, false
+	}
+	p.Source = strings.Join(segments[i:], "/")
+	return p, true
+}
+
+func (p imgproxyPath) String() string {
+	var b strings.Builder
+	b.WriteString("/")
+	b.WriteString(p.Signature)
+	for _, o := range p.Options {
+		b.WriteString("/")
+		b.WriteString(o)
+	}
+	b.WriteString("/")
+	b.WriteString(p.Source)
+	return b.String()
+}
+
+// optionName returns the name of a name:arg1:arg2 option segment
+func optionName(option string) string {
+	name, _, _ := strings.Cut(option, ":")
+	return name
+}
+
+// optionAliases maps imgproxy's short option names to their full form
+var optionAliases = map[string]string{
+	"rs":   "resize",
+	"s":    "size",
+	"rt":   "resizing_type",
+	"ra":   "resizing_algorithm",
+	"w":    "width",
+	"h":    "height",
+	"mw":   "min-width",
+	"mh":   "min-height",
+	"z":    "zoom",
+	"el":   "enlarge",
+	"ex":   "extend",
+	"exar": "extend_aspect_ratio",
+	"g":    "gravity",
+	"c":    "crop",
+	"t":    "trim",
+	"pd":   "padding",
+	"ar":   "auto_rotate",
+	"rot":  "rotate",
+	"bg":   "background",
+	"bga":  "background_alpha",
+	"bl":   "blur",
+	"sh":   "sharpen",
+	"pix":  "pixelate",
+	"wm":   "watermark",
+	"q":    "quality",
+	"fq":   "format_quality",
+	"mb":   "max_bytes",
+	"f":    "format",
+	"ext":  "format",
+	"sm":   "strip_metadata",
+	"kcr":  "keep_copyright",
+	"scp":  "strip_color_profile",
+	"eth":  "enforce_thumbnail",
+	"att":  "return_attachment",
+	"fn":   "filename",
+	"exp":  "expires",
+	"cb":   "cachebuster",
+	"pr":   "preset",
+}
+
+// canonicalOptionName returns the full name of an option given by its alias
+func canonicalOptionName(name string) string {
+	if full, ok := optionAliases[name]; ok {
+		return full
+	}
+	return name
+}
+
+// canonicalOptions spells every option with its full name
+func canonicalOptions(options []string) []string {
+	out := make([]string, len(options))
+	for i, o := range options {
+		name, args, _ := strings.Cut(o, ":")
+		out[i] = canonicalOption(canonicalOptionName(name), args)
+	}
+	return out
+}
+
+func canonicalOption(name, args string) string {
+	if args == "" {
+		return name
+	}
+	return name + ":" + args
+}
+
+var errEncryptedSource = errors.New("encrypted source URLs can't be decoded")
+
+// decodeSource returns the source image URL and the requested output
+// extension (if any) of a plain/<url>[@ext] or <base64>[.ext] source
+func decodeSource(source string) (string, string, error) {
+	if rest, ok := strings.CutPrefix(source, "plain/"); ok {
+		var ext string
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			rest, ext = rest[:i], rest[i+1:]
+		}
+		u, err := url.PathUnescape(rest)
+		return u, ext, err
+	}
+	if strings.HasPrefix(source, "enc/") {
+		return "", "", errEncryptedSource
+	}
+
+	encoded := strings.ReplaceAll(source, "/", "")
+	var ext string
+	if i := strings.LastIndex(encoded, "."); i >= 0 {
+		encoded, ext = encoded[:i], encoded[i+1:]
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	return string(decoded), ext, err
+}
+
+// normalizeSource rewrites a source into a single plain form so that
+// equivalent encodings (base64 vs plain, escaped vs unescaped characters,
+// letter case of the scheme and host, default ports) compare equal
+func normalizeSource(source string) string {
+	src, ext, err := decodeSource(source)
+	if err != nil {
+		return source
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return source
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	// Let the path be re-escaped canonically, unless it encodes a slash which
+	// would then become a different path
+	if !strings.Contains(strings.ToUpper(u.RawPath), "%2F") {
+		u.RawPath = ""
+	}
+
+	normalized := "plain/" + u.String()
+	if ext != "" {
+		normalized += "@" + strings.ToLower(ext)
+	}
+	return normalized
+}
+
+// formatAliases maps the spellings imgproxy accepts for the same output format
+var formatAliases = map[string]string{
+	"jpg": "jpeg",
+	"tif": "tiff",
+}
+
+// normalizeFormat moves the requested output format, given by a format
+// option or by the source's extension suffix, into a single trailing
+// format option. The suffix wins over the option as it does in imgproxy.
+func normalizeFormat(p imgproxyPath) imgproxyPath {
+	var format string
+	options := make([]string, 0, len(p.Options))
+	for _, o := range p.Options {
+		name, args, _ := strings.Cut(o, ":")
+		if canonicalOptionName(name) != "format" {
+			options = append(options, o)
+			continue
+		}
+		if args != "" {
+			format = args
+		}
+	}
+
+	source, ext := splitFormatSuffix(p.Source)
+	if ext != "" {
+		format = ext
+	}
+	if format == "" {
+		return p
+	}
+	format = strings.ToLower(format)
+	if full, ok := formatAliases[format]; ok {
+		format = full
+	}
+	p.Options = append(options, "format:"+format)
+	p.Source = source
+	return p
+}
+
+// stripOptions drops the options named in names, given by their full name
+func stripOptions(options []string, names map[string]bool) []string {
+	out := make([]string, 0, len(options))
+	for _, o := range options {
+		name, _, _ := strings.Cut(o, ":")
+		if !names[canonicalOptionName(name)] {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// splitFormatSuffix cuts the @ext of a plain source or the .ext of an
+// encoded one, the base64url alphabet having no dot
+func splitFormatSuffix(source string) (string, string) {
+	sep := "."
+	if strings.HasPrefix(source, "plain/") {
+		sep = "@"
+	}
+	if i := strings.LastIndex(source, sep); i >= 0 {
+		return source[:i], source[i+1:]
+	}
+	return source, ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSourceURLKeys(t *testing.T) {
+	b64 := func(src string) string { return base64.RawURLEncoding.EncodeToString([]byte(src)) }
+	const plain = "/sig/rs:fit:100:100/plain/https://example.com/cat.jpg"
+	tests := []struct {
+		name      string
+		normalize string
+		a, b      string
+		same      bool
+	}{
+		{name: "base64 and plain", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/" + b64("https://example.com/cat.jpg"), same: true},
+		{name: "padded base64", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/" + base64.URLEncoding.EncodeToString([]byte("https://example.com/cat.jpg")), same: true},
+		{name: "split base64", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/" + b64("https://example.com/cat.jpg")[:8] + "/" + b64("https://example.com/cat.jpg")[8:], same: true},
+		{name: "host case and default port", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/plain/HTTPS://Example.COM:443/cat.jpg", same: true},
+		{name: "escaped path", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/plain/https://example.com/c%2561t.jpg", same: true},
+		{name: "option aliases", normalize: "true", a: plain, b: "/sig/resize:fit:100:100/plain/https://example.com/cat.jpg", same: true},
+		{name: "extension case", normalize: "true", a: plain + "@png", b: "/sig/rs:fit:100:100/" + b64("https://example.com/cat.jpg") + ".PNG", same: true},
+		{name: "other port", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/plain/https://example.com:8443/cat.jpg", same: false},
+		{name: "other path", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/plain/https://example.com/Cat.jpg", same: false},
+		{name: "disabled", normalize: "false", a: plain, b: "/sig/rs:fit:100:100/" + b64("https://example.com/cat.jpg"), same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"NORMALIZE_SOURCE_URL": tt.normalize})
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.a, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.b, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestParseImgproxyPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		ok      bool
+		options int
+		source  string
+	}{
+		{path: "/sig/rs:fit:1:1/q:80/plain/local:///a.png", ok: true, options: 2, source: "plain/local:///a.png"},
+		{path: "/insecure/YWJj.png", ok: true, options: 0, source: "YWJj.png"},
+		{path: "/insecure/rs:fit:1:1", ok: false},
+		{path: "/health", ok: false},
+		{path: "//rs:fit:1:1/YWJj", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p, ok := parseImgproxyPath(tt.path)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(p.Options) != tt.options || p.Source != tt.source {
+				t.Errorf("got %+v", p)
+			}
+			if p.String() != tt.path {
+				t.Errorf("String() = %q, want %q", p.String(), tt.path)
+			}
+		})
+	}
+}
+
+func TestNormalizeFormatSuffixKeys(t *testing.T) {
+	const plain = "/sig/rs:fit:100:100/plain/https://example.com/cat.jpg"
+	const b64 = "/sig/rs:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn"
+	tests := []struct {
+		name      string
+		normalize string
+		a, b      string
+		same      bool
+	}{
+		{name: "plain suffix and option", normalize: "true", a: plain + "@webp", b: "/sig/rs:fit:100:100/f:webp/plain/https://example.com/cat.jpg", same: true},
+		{name: "base64 suffix and option", normalize: "true", a: b64 + ".webp", b: "/sig/rs:fit:100:100/format:webp/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", same: true},
+		{name: "option position", normalize: "true", a: "/sig/f:webp/rs:fit:100:100/plain/https://example.com/cat.jpg", b: plain + "@webp", same: true},
+		{name: "alias", normalize: "true", a: plain + "@jpg", b: plain + "@JPEG", same: true},
+		{name: "suffix wins over option", normalize: "true", a: "/sig/rs:fit:100:100/f:png/plain/https://example.com/cat.jpg@webp", b: plain + "@webp", same: true},
+		{name: "other format", normalize: "true", a: plain + "@webp", b: plain + "@avif", same: false},
+		{name: "no format", normalize: "true", a: plain, b: plain + "@webp", same: false},
+		// The source's own extension isn't a requested format
+		{name: "source extension kept", normalize: "true", a: plain, b: "/sig/rs:fit:100:100/plain/https://example.com/cat", same: false},
+		{name: "disabled", normalize: "false", a: plain + "@webp", b: "/sig/rs:fit:100:100/f:webp/plain/https://example.com/cat.jpg", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"NORMALIZE_FORMAT_SUFFIX": tt.normalize})
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.a, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.b, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestKeyStripOptions(t *testing.T) {
+	const src = "/plain/https://example.com/cat.jpg"
+	tests := []struct {
+		name  string
+		strip string
+		a, b  string
+		same  bool
+	}{
+		{name: "stripped option", strip: "filename", a: "/sig/rs:fit:100:100/fn:cat" + src, b: "/sig/rs:fit:100:100/fn:dog" + src, same: true},
+		{name: "stripped against absent", strip: "filename", a: "/sig/rs:fit:100:100/filename:cat" + src, b: "/sig/rs:fit:100:100" + src, same: true},
+		{name: "by alias", strip: "att,fn", a: "/sig/rs:fit:100:100/att:1/fn:cat" + src, b: "/sig/rs:fit:100:100/return_attachment:0" + src, same: true},
+		{name: "other options kept", strip: "filename", a: "/sig/rs:fit:100:100/fn:cat" + src, b: "/sig/rs:fit:200:200/fn:cat" + src, same: false},
+		{name: "not listed", strip: "return_attachment", a: "/sig/rs:fit:100:100/fn:cat" + src, b: "/sig/rs:fit:100:100/fn:dog" + src, same: false},
+		{name: "disabled", a: "/sig/rs:fit:100:100/fn:cat" + src, b: "/sig/rs:fit:100:100" + src, same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"KEY_STRIP_OPTIONS": tt.strip})
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.a, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.b, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestKeyStripOptionsServed(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"KEY_STRIP_OPTIONS": "filename"}, func(w http.ResponseWriter, r *http.Request) {
+		for _, o := range strings.Split(r.URL.Path, "/") {
+			if name, ok := strings.CutPrefix(o, "fn:"); ok {
+				w.Header().Set("Content-Disposition", `inline; filename="`+name+`.png"`)
+			}
+		}
+		servePNG(w, r)
+	})
+	for _, name := range []string{"cat", "dog"} {
+		resp := e.get("/insecure/rs:fit:100:100/fn:" + name + "/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn")
+		// imgproxy still gets the option and sets the header it asks for
+		if want := `inline; filename="` + name + `.png"`; resp.Header.Get("Content-Disposition") != want {
+			t.Errorf("Content-Disposition = %q, want %q", resp.Header.Get("Content-Disposition"), want)
+		}
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 1 {
+		t.Errorf("bucket has %v, want both renders under one key", keys)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const keyLockShards = 64
+
+// keyLocks is the in-memory Coordinator, tracking the keys being uploaded so
+// a key is only ever written by one upload at a time. Locking never waits:
+// the upload is fed by the client stream, waiting for the lock would stall
+// the client. The loser is dropped, the winner is writing the same object
+// anyway.
+type keyLocks struct {
+	shards [keyLockShards]keyLockShard
+}
+
+type keyLockShard struct {
+	mu   sync.Mutex
+	held map[string]struct{}
+}
+
+func newKeyLocks() *keyLocks {
+	l := &keyLocks{}
+	for i := range l.shards {
+		l.shards[i].held = make(map[string]struct{})
+	}
+	return l
+}
+
+func (l *keyLocks) shard(key string) *keyLockShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%keyLockShards]
+}
+
+// TryLock reports whether key was free, in which case it is now held
+func (l *keyLocks) TryLock(key string) bool {
+	sh := l.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, busy := sh.held[key]; busy {
+		return false
+	}
+	sh.held[key] = struct{}{}
+	return true
+}
+
+func (l *keyLocks) Unlock(key string) {
+	sh := l.shard(key)
+	sh.mu.Lock()
+	delete(sh.held, key)
+	sh.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyLocks(t *testing.T) {
+	l := newKeyLocks()
+	if !l.TryLock("a") {
+		t.Fatal("TryLock of a free key failed")
+	}
+	if l.TryLock("a") {
+		t.Error("TryLock of a held key succeeded")
+	}
+	if !l.TryLock("b") {
+		t.Error("TryLock of another key failed")
+	}
+	l.Unlock("a")
+	if !l.TryLock("a") {
+		t.Error("TryLock after Unlock failed")
+	}
+}
+
+func TestConcurrentUploadsOfAKey(t *testing.T) {
+	tests := []struct {
+		lock string
+		// uploads is how many of the two overlapping responses are uploaded
+		uploads    int
+		concurrent int64
+	}{
+		{lock: "true", uploads: 1, concurrent: 1},
+		{lock: "false", uploads: 2, concurrent: 0},
+	}
+	for _, tt := range tests {
+		t.Run("UPLOAD_KEY_LOCK="+tt.lock, func(t *testing.T) {
+			// Renders hang after their headers, so the first upload holds the
+			// key until the second response arrives
+			release := make(chan struct{})
+			e := newTestEnv(t, map[string]string{"UPLOAD_KEY_LOCK": tt.lock}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+				w.Write(testPNG)
+			})
+			cfg := e.srv.config()
+			perUpload := uploadBufferSize(cfg, -1) + int64(cfg.UploadTeeBufferSize)
+
+			var wg sync.WaitGroup
+			for range 2 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					e.srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, testImagePath, nil))
+				}()
+			}
+			// Both responses are in once every upload started holds its buffers
+			// and the other one was dropped
+			deadline := time.Now().Add(5 * time.Second)
+			for (e.srv.buffers.Used() != int64(tt.uploads)*perUpload || e.srv.stats.uploadsConcurrent.Load() != tt.concurrent) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			wg.Wait()
+			e.srv.uploads.Wait()
+
+			if got := e.srv.stats.uploadsConcurrent.Load(); got != tt.concurrent {
+				t.Errorf("uploads_concurrent = %d, want %d", got, tt.concurrent)
+			}
+			if got := e.s3.calls(http.MethodPut); got != tt.uploads {
+				t.Errorf("%d PUTs, want %d", got, tt.uploads)
+			}
+		})
+	}
+}
+
+func TestKeyLocksExclusive(t *testing.T) {
+	l := newKeyLocks()
+	var held, overlaps, wins atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if !l.TryLock("key") {
+					continue
+				}
+				wins.Add(1)
+				if held.Add(1) > 1 {
+					overlaps.Add(1)
+				}
+				held.Add(-1)
+				l.Unlock("key")
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps.Load() != 0 {
+		t.Errorf("the key was held by two writers %d times", overlaps.Load())
+	}
+	if wins.Load() == 0 {
+		t.Error("no writer ever got the key")
+	}
+}
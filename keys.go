@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyGenerator derives the hash part of the cache key of an imgproxy request
+type KeyGenerator interface {
+	Key(r *http.Request) string
+}
+
+// KeyGeneratorFunc adapts a plain function to the KeyGenerator interface
+type KeyGeneratorFunc func(r *http.Request) string
+
+func (f KeyGeneratorFunc) Key(r *http.Request) string {
+	return f(r)
+}
+
+const defaultKeyGenerator = "hash-path"
+
+// minCacheKeyLength keeps truncated keys at 64 bits, past which collisions
+// between live objects stop being negligible
+const minCacheKeyLength = 16
+
+// maxCacheKeyLength is the length of the MD5 hex keys, which can't be
+// truncated to anything longer
+const maxCacheKeyLength = 32
+
+// keyGenerators holds the generators selectable through KEY_GENERATOR
+var keyGenerators = map[string]KeyGenerator{
+	"hash-path": KeyGeneratorFunc(func(r *http.Request) string {
+		return generateS3Key(r.URL.Path)
+	}),
+	"hash-path+query": hashPathQuery{},
+}
+
+// hashPathQuery is the hash-path+query generator, a type of its own so that
+// keySource can tell the key covers the query. Requests without a query keep
+// the same key as with hash-path.
+type hashPathQuery struct{}
+
+func (hashPathQuery) Key(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return generateS3Key(r.URL.Path)
+	}
+	return generateS3Key(r.URL.Path + "?" + r.URL.RawQuery)
+}
+
+// RegisterKeyGenerator makes a custom generator selectable through
+// KEY_GENERATOR. Call it from the init function of a file dropped into the
+// package at build time.
+func RegisterKeyGenerator(name string, g KeyGenerator) {
+	if _, exists := keyGenerators[name]; exists {
+		panic(fmt.Sprintf("key generator %q already registered", name))
+	}
+	keyGenerators[name] = g
+}
+
+// objectKey returns the full S3 object key (folder included) for an imgproxy
+// request rendered as t, written now
+func objectKey(cfg Config, r *http.Request, t contentType) string {
+	return objectKeyOn(cfg, r, t, time.Now())
+}
+
+// objectKeyOn is the key of an object written on day, which only matters
+// with DATE_PARTITION_KEYS
+func objectKeyOn(cfg Config, r *http.Request, t contentType, day time.Time) string {
+	key := cfg.KeyGenerator.Key(keyRequest(cfg, r))
+	if cfg.KeyIncludeMethod {
+		key = generateS3Key(r.Method + " " + key)
+	}
+	if len(cfg.VaryHeaders) > 0 {
+		key = generateS3Key(key + varySuffix(cfg.VaryHeaders, r.Header))
+	}
+	if cfg.CacheKeyLength > 0 && len(key) > cfg.CacheKeyLength {
+		key = key[:cfg.CacheKeyLength]
+	}
+	folder := objectFolder(cfg, t)
+	key = cfg.KeyShards.prefix(key) + key
+	if cfg.DatePartitionKeys {
+		key = day.UTC().Format(datePartitionLayout) + key
+	}
+	if cfg.CacheVersion != "" {
+		return fmt.Sprintf("%s%s/%s", folder, cfg.CacheVersion, key)
+	}
+	return fmt.Sprintf("%s%s", folder, key)
+}
+
+const (
+	keyShardNone = "none"
+	keyShardHex  = "hex"
+	keyShardMod  = "mod"
+)
+
+// keySharding spreads keys over subfolders, either named after the first
+// two characters of the key (hex) or numbered after a hash of it (mod)
+type keySharding struct {
+	scheme string
+	count  int
+	width  int
+}
+
+func newKeySharding(scheme string, count int) (keySharding, error) {
+	switch scheme {
+	case keyShardNone, keyShardHex:
+		return keySharding{scheme: scheme}, nil
+	case keyShardMod:
+		if count < 2 {
+			return keySharding{}, fmt.Errorf("KEY_SHARD_COUNT must be at least 2 with KEY_SHARD_SCHEME=mod")
+		}
+		return keySharding{scheme: scheme, count: count, width: max(3, len(strconv.Itoa(count-1)))}, nil
+	}
+	return keySharding{}, fmt.Errorf("invalid KEY_SHARD_SCHEME %q, expected none, hex or mod", scheme)
+}
+
+// prefix is the shard folder of key, empty when sharding is off
+func (s keySharding) prefix(key string) string {
+	switch s.scheme {
+	case keyShardHex:
+		if len(key) < 2 {
+			return ""
+		}
+		return key[:2] + "/"
+	case keyShardMod:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return fmt.Sprintf("%0*d/", s.width, h.Sum32()%uint32(s.count))
+	}
+	return ""
+}
+
+// objectFolder is the folder objects of type t are stored in, S3_FOLDER
+// unless S3_FOLDERS_BY_TYPE maps the type elsewhere
+func objectFolder(cfg Config, t contentType) string {
+	if folder, ok := cfg.S3FoldersByType[t]; ok {
+		return folder
+	}
+	return cfg.S3Folder
+}
+
+// datePartitionLayout prefixes keys with the UTC day they were written on
+const datePartitionLayout = "2006/01/02/"
+
+// objectKeys lists the distinct keys the object for r may be stored under
+// when the rendered type isn't known. With DATE_PARTITION_KEYS that is in
+// each of the last DATE_PARTITION_LOOKUP_DAYS partitions, newest first.
+func objectKeys(cfg Config, r *http.Request) []string {
+	days := 1
+	if cfg.DatePartitionKeys {
+		days = cfg.DatePartitionLookupDays
+	}
+	now := time.Now()
+	var keys []string
+	for d := range days {
+		day := now.AddDate(0, 0, -d)
+		for t := range numContentTypes {
+			if key := objectKeyOn(cfg, r, t, day); !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// fallbackKeys lists the keys the object for r had under the folders of
+// S3_FALLBACK_FOLDERS, which don't split objects by type
+func fallbackKeys(cfg Config, r *http.Request) []string {
+	var keys []string
+	for _, folder := range cfg.S3FallbackFolders {
+		former := cfg
+		former.S3Folder, former.S3FoldersByType = folder, nil
+		keys = append(keys, objectKeys(former, r)...)
+	}
+	return keys
+}
+
+// parseFoldersByType parses a comma separated list of type=folder pairs
+// such as "avif=avif/,webp=webp/", the types being those of the per content
+// type stats
+func parseFoldersByType(rules []string) (map[contentType]string, error) {
+	folders := make(map[contentType]string)
+	for _, rule := range rules {
+		name, folder, ok := strings.Cut(rule, "=")
+		if !ok || folder == "" {
+			return nil, fmt.Errorf("invalid folder rule %q, expected type=folder", rule)
+		}
+		t := contentTypeByName(name)
+		if t < 0 {
+			return nil, fmt.Errorf("invalid folder rule %q, unknown type %q", rule, name)
+		}
+		if !strings.HasSuffix(folder, "/") {
+			folder += "/"
+		}
+		folders[t] = folder
+	}
+	return folders, nil
+}
+
+// varySuffix lists the values of the vary headers, one per line so values
+// can't be shifted from one header to the next. Accept-Language is reduced to
+// the primary subtag of the preferred language, so en-US and en share a key.
+func varySuffix(names []string, h http.Header) string {
+	var b strings.Builder
+	for _, name := range names {
+		value := strings.Join(h.Values(name), ",")
+		if name == "Accept-Language" {
+			value = primaryLanguage(value)
+		}
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// primaryLanguage returns the lowercased primary subtag of the language an
+// Accept-Language value prefers most, the first one listed on a tie
+func primaryLanguage(accept string) string {
+	var best string
+	bestQ := 0.0
+	for _, lang := range strings.Split(accept, ",") {
+		tag, params, _ := strings.Cut(lang, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		tag = strings.TrimSpace(tag)
+		if tag == "" || q <= bestQ {
+			continue
+		}
+		primary, _, _ := strings.Cut(tag, "-")
+		best, bestQ = strings.ToLower(primary), q
+	}
+	return best
+}
+
+// keySource identifies what a key was derived from. Stored next to the
+// object, it tells apart two requests whose keys collide. It only covers
+// what the key covers, the query with hash-path+query and the method with
+// KEY_INCLUDE_METHOD, or requests sharing an object would count as colliding.
+func keySource(cfg Config, r *http.Request) string {
+	kr := keyRequest(cfg, r)
+	src := kr.URL.Path
+	if _, ok := cfg.KeyGenerator.(hashPathQuery); ok && kr.URL.RawQuery != "" {
+		src += "?" + kr.URL.RawQuery
+	}
+	if cfg.KeyIncludeMethod {
+		src = r.Method + " " + src
+	}
+	if len(cfg.VaryHeaders) > 0 {
+		src += varySuffix(cfg.VaryHeaders, r.Header)
+	}
+	hash := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyRequest returns the request the key is derived from: r itself, or a
+// copy with a canonical path when canonicalization is enabled
+func keyRequest(cfg Config, r *http.Request) *http.Request {
+	if len(cfg.KeyQueryInclude) > 0 || len(cfg.KeyQueryExclude) > 0 {
+		r = withQuery(r, filterQuery(r.URL.Query(), cfg.KeyQueryInclude, cfg.KeyQueryExclude))
+	}
+	if !cfg.CanonicalizePresets && !cfg.NormalizeSourceURL && !cfg.NormalizeFormatSuffix && cfg.KeyStripOptions == nil {
+		return r
+	}
+	p, ok := parseImgproxyPath(r.URL.Path)
+	if !ok {
+		return r
+	}
+	if cfg.CanonicalizePresets {
+		p.Options = cfg.Presets.canonicalize(p.Options)
+	}
+	if cfg.KeyStripOptions != nil {
+		p.Options = stripOptions(p.Options, cfg.KeyStripOptions)
+	}
+	if cfg.NormalizeSourceURL {
+		p.Options = canonicalOptions(p.Options)
+		p.Source = normalizeSource(p.Source)
+	}
+	if cfg.NormalizeFormatSuffix {
+		p = normalizeFormat(p)
+	}
+	// Equivalent URLs are signed differently, the signature can't be part of
+	// the key. imgproxy has already checked it by the time we upload.
+	p.Signature = "_"
+	return withPath(r, p.String())
+}
+
+func withPath(r *http.Request, path string) *http.Request {
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	return r2
+}
+
+// filterQuery keeps the include parameters when any is given, then drops the
+// exclude ones. The result is sorted so parameter order doesn't matter.
+func filterQuery(q url.Values, include, exclude []string) string {
+	for name := range q {
+		if (len(include) > 0 && !slices.Contains(include, name)) || slices.Contains(exclude, name) {
+			delete(q, name)
+		}
+	}
+	return q.Encode()
+}
+
+func withQuery(r *http.Request, rawQuery string) *http.Request {
+	u := *r.URL
+	u.RawQuery = rawQuery
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	return r2
+}
+
+// sanitizeCacheVersion keeps the characters safe in a key prefix
+func sanitizeCacheVersion(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, strings.TrimSpace(v))
+}
+
+// generateS3Key creates a hash from the imgproxy URL path
+func generateS3Key(path string) string {
+	hash := md5.Sum([]byte(path))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectKeyMethod(t *testing.T) {
+	tests := []struct {
+		name          string
+		includeMethod string
+		same          bool
+	}{
+		{name: "default", includeMethod: "false", same: true},
+		{name: "KEY_INCLUDE_METHOD", includeMethod: "true", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"KEY_INCLUDE_METHOD": tt.includeMethod})
+			get := objectKey(cfg, httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+			head := objectKey(cfg, httptest.NewRequest(http.MethodHead, testImagePath, nil), contentTypePNG)
+			if (get == head) != tt.same {
+				t.Errorf("GET key %q, HEAD key %q, want same = %v", get, head, tt.same)
+			}
+		})
+	}
+}
+
+func TestObjectKeyVaryHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		vary string
+		a, b http.Header
+		same bool
+	}{
+		{name: "same value", vary: "x-device-type", a: http.Header{"X-Device-Type": {"mobile"}}, b: http.Header{"X-Device-Type": {"mobile"}}, same: true},
+		{name: "different values", vary: "x-device-type", a: http.Header{"X-Device-Type": {"mobile"}}, b: http.Header{"X-Device-Type": {"desktop"}}, same: false},
+		{name: "missing header", vary: "x-device-type", a: http.Header{"X-Device-Type": {"mobile"}}, b: http.Header{}, same: false},
+		{name: "unlisted header", vary: "x-device-type", a: http.Header{"X-Other": {"a"}}, b: http.Header{"X-Other": {"b"}}, same: true},
+		// One header's value can't be shifted into the next one's
+		{name: "values don't shift", vary: "X-A,X-B", a: http.Header{"X-A": {"1\nX-B: 2"}}, b: http.Header{"X-A": {"1"}, "X-B": {"2"}}, same: false},
+		{name: "disabled", vary: "", a: http.Header{"X-Device-Type": {"mobile"}}, b: http.Header{"X-Device-Type": {"desktop"}}, same: true},
+		{name: "other language", vary: "accept-language", a: http.Header{"Accept-Language": {"en-US"}}, b: http.Header{"Accept-Language": {"fr-FR"}}, same: false},
+		{name: "same primary language", vary: "accept-language", a: http.Header{"Accept-Language": {"en-US"}}, b: http.Header{"Accept-Language": {"en"}}, same: true},
+		{name: "preferred language", vary: "accept-language", a: http.Header{"Accept-Language": {"fr;q=0.5, en-GB"}}, b: http.Header{"Accept-Language": {"EN"}}, same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"VARY_HEADERS": tt.vary})
+			a := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			a.Header = tt.a
+			b := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			b.Header = tt.b
+			if ka, kb := objectKey(cfg, a, contentTypePNG), objectKey(cfg, b, contentTypePNG); (ka == kb) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", ka, kb, tt.same)
+			}
+		})
+	}
+}
+
+func TestPrimaryLanguage(t *testing.T) {
+	tests := []struct{ accept, want string }{
+		{accept: "", want: ""},
+		{accept: "en-US", want: "en"},
+		{accept: "fr-FR,fr;q=0.9,en;q=0.8", want: "fr"},
+		{accept: "en;q=0.2, de-CH;q=0.7", want: "de"},
+		{accept: "en;q=x, it", want: "it"},
+		{accept: "*", want: "*"},
+	}
+	for _, tt := range tests {
+		if got := primaryLanguage(tt.accept); got != tt.want {
+			t.Errorf("primaryLanguage(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestVaryHeaderEmitted(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"VARY_HEADERS": "x-device-type,x-dpr"}, nil)
+	for _, device := range []string{"mobile", "desktop"} {
+		req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+		req.Header.Set("X-Device-Type", device)
+		resp := e.do(req)
+		if got := resp.Header.Values("Vary"); !slices.Equal(got, []string{"X-Device-Type", "X-Dpr"}) {
+			t.Errorf("Vary = %v", got)
+		}
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 2 {
+		t.Errorf("bucket has %v, want one object per variant", keys)
+	}
+}
+
+func TestVaryAcceptLanguage(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"VARY_HEADERS": "accept-language"}, nil)
+	for _, lang := range []string{"en-US", "en", "fr-FR"} {
+		req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+		req.Header.Set("Accept-Language", lang)
+		if got := e.do(req).Header.Get("Vary"); got != "Accept-Language" {
+			t.Errorf("Vary = %q, want Accept-Language", got)
+		}
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 2 {
+		t.Errorf("bucket has %v, want an object for en and one for fr", keys)
+	}
+}
+
+func init() {
+	// Every request collides, standing for a weak custom key scheme
+	RegisterKeyGenerator("constant", KeyGeneratorFunc(func(r *http.Request) string { return "collision" }))
+}
+
+func TestVerifyKeySource(t *testing.T) {
+	a, b := renderPath("local:///a.png"), renderPath("local:///b.png")
+	tests := []struct {
+		verify string
+		// status of the lookup of b, a being stored under the shared key
+		status   int
+		mismatch bool
+	}{
+		{verify: "false", status: http.StatusOK},
+		{verify: "true", status: http.StatusNotFound, mismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run("VERIFY_KEY_SOURCE="+tt.verify, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{
+				"ADMIN_TOKEN":       "secret",
+				"KEY_GENERATOR":     "constant",
+				"VERIFY_KEY_SOURCE": tt.verify,
+			}, nil)
+			lookup := func(path string) (int, cacheStatus) {
+				resp := e.admin(http.MethodGet, "/admin/cache?path="+path)
+				var status cacheStatus
+				if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+					t.Fatal(err)
+				}
+				return resp.StatusCode, status
+			}
+
+			e.get(a)
+			if code, _ := lookup(a); code != http.StatusOK {
+				t.Errorf("lookup of the stored path: status = %d, want 200", code)
+			}
+			code, status := lookup(b)
+			if code != tt.status || status.SourceMismatch != tt.mismatch {
+				t.Errorf("lookup of the colliding path: status = %d, source_mismatch = %v, want %d, %v", code, status.SourceMismatch, tt.status, tt.mismatch)
+			}
+
+			// Rendering b overwrites the object, which then belongs to b
+			e.get(b)
+			if code, _ := lookup(b); code != http.StatusOK {
+				t.Errorf("lookup after re-rendering: status = %d, want 200", code)
+			}
+			if code, _ := lookup(a); code != tt.status {
+				t.Errorf("lookup of the overwritten path: status = %d, want %d", code, tt.status)
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 1 {
+				t.Errorf("bucket has %v, want the single colliding key", keys)
+			}
+		})
+	}
+}
+
+// TestKeySourceFollowsKey checks that two requests get the same key source
+// exactly when they share a key, so that VERIFY_KEY_SOURCE only reports real
+// collisions
+func TestKeySourceFollowsKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		a, b   *http.Request
+		shared bool
+	}{
+		{
+			name:   "query ignored by hash-path",
+			a:      httptest.NewRequest(http.MethodGet, testImagePath+"?v=1", nil),
+			b:      httptest.NewRequest(http.MethodGet, testImagePath+"?v=2", nil),
+			shared: true,
+		},
+		{
+			name: "query keyed by hash-path+query",
+			env:  map[string]string{"KEY_GENERATOR": "hash-path+query"},
+			a:    httptest.NewRequest(http.MethodGet, testImagePath+"?v=1", nil),
+			b:    httptest.NewRequest(http.MethodGet, testImagePath+"?v=2", nil),
+		},
+		{
+			name:   "method ignored by default",
+			a:      httptest.NewRequest(http.MethodGet, testImagePath, nil),
+			b:      httptest.NewRequest(http.MethodPost, testImagePath, nil),
+			shared: true,
+		},
+		{
+			name: "method keyed with KEY_INCLUDE_METHOD",
+			env:  map[string]string{"KEY_INCLUDE_METHOD": "true"},
+			a:    httptest.NewRequest(http.MethodGet, testImagePath, nil),
+			b:    httptest.NewRequest(http.MethodPost, testImagePath, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.env)
+			if got := objectKey(cfg, tt.a, contentTypePNG) == objectKey(cfg, tt.b, contentTypePNG); got != tt.shared {
+				t.Fatalf("shared key = %v, want %v", got, tt.shared)
+			}
+			if got := keySource(cfg, tt.a) == keySource(cfg, tt.b); got != tt.shared {
+				t.Errorf("shared key source = %v, want %v", got, tt.shared)
+			}
+		})
+	}
+}
+
+func TestCacheKeyLength(t *testing.T) {
+	tests := []struct {
+		length  string
+		want    int
+		wantErr bool
+	}{
+		{length: "0", want: 32},
+		{length: "16", want: 16},
+		{length: "20", want: 20},
+		{length: "32", want: 32},
+		{length: "33", wantErr: true},
+		{length: "64", wantErr: true},
+		{length: "15", wantErr: true},
+		{length: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.length, func(t *testing.T) {
+			t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+			t.Setenv("S3_BUCKET", testBucket)
+			t.Setenv("S3_FOLDER", "")
+			t.Setenv("CACHE_KEY_LENGTH", tt.length)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			full := generateS3Key(testImagePath)
+			key := objectKey(cfg, httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+			if len(key) != tt.want || !strings.HasPrefix(full, key) {
+				t.Errorf("key = %q, want the first %d characters of %q", key, tt.want, full)
+			}
+		})
+	}
+}
+
+func TestCacheKeyLengthLookup(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "CACHE_KEY_LENGTH": "16"}, nil)
+	e.get(testImagePath)
+	keys := e.s3.keys(testBucket)
+	if len(keys) != 1 || len(path.Base(keys[0])) != 16 {
+		t.Fatalf("bucket has %v, want one 16 character key", keys)
+	}
+	resp := e.admin(http.MethodGet, "/admin/cache?path="+testImagePath)
+	var status cacheStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || status.Key != keys[0] {
+		t.Errorf("lookup: status = %d, key = %q, want the uploaded %q", resp.StatusCode, status.Key, keys[0])
+	}
+}
+
+func TestKeyQueryFilter(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude string
+		a, b             string
+		same             bool
+	}{
+		{name: "buster excluded", exclude: "v", a: "?w=100&v=1", b: "?w=100&v=2", same: true},
+		{name: "buster only", exclude: "v", a: "?v=1", b: "", same: true},
+		{name: "transform param kept", exclude: "v", a: "?w=100&v=1", b: "?w=200&v=1", same: false},
+		{name: "include only transform params", include: "w,h", a: "?w=100&utm_source=x", b: "?w=100", same: true},
+		{name: "included param varies", include: "w,h", a: "?w=100&h=1", b: "?w=100&h=2", same: false},
+		{name: "exclude wins over include", include: "w,v", exclude: "v", a: "?w=100&v=1", b: "?w=100&v=2", same: true},
+		{name: "parameter order", a: "?w=100&h=50", b: "?h=50&w=100", include: "w,h", same: true},
+		{name: "no filter", a: "?w=100&v=1", b: "?w=100&v=2", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{
+				"KEY_GENERATOR":     "hash-path+query",
+				"KEY_QUERY_INCLUDE": tt.include,
+				"KEY_QUERY_EXCLUDE": tt.exclude,
+			})
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, testImagePath+tt.a, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, testImagePath+tt.b, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestKeyQueryFilterForwardsQuery(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"KEY_GENERATOR": "hash-path+query", "KEY_QUERY_EXCLUDE": "v"}, nil)
+	e.get(testImagePath + "?v=1")
+	e.get(testImagePath + "?v=2")
+	for _, r := range e.img.renders() {
+		if !r.URL.Query().Has("v") {
+			t.Errorf("imgproxy received %q, the buster only stays out of the key", r.URL)
+		}
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 1 {
+		t.Errorf("bucket has %v, want one object", keys)
+	}
+}
+
+func TestParseFoldersByType(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		want    map[contentType]string
+		wantErr bool
+	}{
+		{rules: nil, want: map[contentType]string{}},
+		{rules: []string{"avif=avif", "webp=img/webp/"}, want: map[contentType]string{contentTypeAVIF: "avif/", contentTypeWebP: "img/webp/"}},
+		{rules: []string{"avif"}, wantErr: true},
+		{rules: []string{"avif="}, wantErr: true},
+		{rules: []string{"tiff=tiff"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.rules, ","), func(t *testing.T) {
+			got, err := parseFoldersByType(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldersByType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		folder      string
+	}{
+		{contentType: "image/avif", folder: "avif/"},
+		{contentType: "image/webp", folder: "webp/"},
+		{contentType: "image/jpeg", folder: "jpeg/"},
+		{contentType: "image/png", folder: "images/"},
+		{contentType: "image/x-unknown", folder: "images/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			env := map[string]string{
+				"ADMIN_TOKEN":        "secret",
+				"S3_FOLDER":          "images/",
+				"S3_FOLDERS_BY_TYPE": "avif=avif,webp=webp,jpeg=jpeg",
+			}
+			e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write(testPNG)
+			})
+			e.get(testImagePath)
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 || !strings.HasPrefix(keys[0], tt.folder) {
+				t.Fatalf("bucket has %v, want one key under %s", keys, tt.folder)
+			}
+
+			// The lookup doesn't know the type and must find it all the same
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists || status.Key != keys[0] {
+				t.Errorf("lookup: exists = %v, key = %q, want %q", status.Exists, status.Key, keys[0])
+			}
+		})
+	}
+}
+
+func TestKeySharding(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		count   int
+		pattern string
+		wantErr bool
+	}{
+		{scheme: "none", pattern: `^$`},
+		{scheme: "hex", pattern: `^[0-9a-f]{2}/$`},
+		{scheme: "mod", count: 16, pattern: `^0(0\d|1[0-5])/$`},
+		{scheme: "mod", count: 10000, pattern: `^\d{4}/$`},
+		{scheme: "mod", count: 1, wantErr: true},
+		{scheme: "md5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.scheme, tt.count), func(t *testing.T) {
+			s, err := newKeySharding(tt.scheme, tt.count)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			shards := make(map[string]bool)
+			for i := range 200 {
+				key := generateS3Key(strconv.Itoa(i))
+				prefix := s.prefix(key)
+				if !regexp.MustCompile(tt.pattern).MatchString(prefix) {
+					t.Fatalf("prefix(%q) = %q, want a match of %s", key, prefix, tt.pattern)
+				}
+				// Reads and writes agree
+				if again := s.prefix(key); again != prefix {
+					t.Fatalf("prefix(%q) = %q then %q", key, prefix, again)
+				}
+				shards[prefix] = true
+			}
+			if spread := len(shards) > 1; spread != (tt.scheme != "none") {
+				t.Errorf("200 keys over %d shards", len(shards))
+			}
+		})
+	}
+}
+
+func TestKeyShardingLookup(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		pattern string
+	}{
+		{env: map[string]string{"KEY_SHARD_SCHEME": "hex"}, pattern: `^[0-9a-f]{2}/[0-9a-f]{32}$`},
+		{env: map[string]string{"KEY_SHARD_SCHEME": "mod", "KEY_SHARD_COUNT": "100"}, pattern: `^\d{3}/[0-9a-f]{32}$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env["KEY_SHARD_SCHEME"], func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{"ADMIN_TOKEN": "secret"}, tt.env), nil)
+			e.get(testImagePath)
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 || !regexp.MustCompile(tt.pattern).MatchString(keys[0]) {
+				t.Fatalf("bucket has %v, want a key matching %s", keys, tt.pattern)
+			}
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists || status.Key != keys[0] {
+				t.Errorf("lookup: exists = %v, key = %q, want %q", status.Exists, status.Key, keys[0])
+			}
+		})
+	}
+}
+
+func TestDatePartitionKeys(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"DATE_PARTITION_KEYS": "true", "S3_FOLDER": "img/"}, nil)
+	before := time.Now().UTC()
+	e.get(testImagePath)
+	keys := e.s3.keys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("bucket has %v, want one object", keys)
+	}
+	// Written around midnight, the day may have just turned
+	day, nextDay := "img/"+before.Format(datePartitionLayout), "img/"+time.Now().UTC().Format(datePartitionLayout)
+	if !strings.HasPrefix(keys[0], day) && !strings.HasPrefix(keys[0], nextDay) {
+		t.Errorf("key %q isn't under %s", keys[0], day)
+	}
+}
+
+func TestDatePartitionLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		age   int
+		found bool
+	}{
+		{name: "today", age: 0, found: true},
+		{name: "within the lookup window", age: 2, found: true},
+		{name: "past the lookup window", age: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "DATE_PARTITION_KEYS": "true", "DATE_PARTITION_LOOKUP_DAYS": "3"}, nil)
+			req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			key := objectKeyOn(*e.srv.config(), req, contentTypePNG, time.Now().AddDate(0, 0, -tt.age))
+			e.s3.put(key, testPNG, http.Header{"Content-Type": {"image/png"}})
+
+			resp := e.admin(http.MethodGet, "/admin/cache?path="+testImagePath)
+			var status cacheStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Exists != tt.found {
+				t.Fatalf("status = %d, exists = %v, want %v", resp.StatusCode, status.Exists, tt.found)
+			}
+			if tt.found && status.Key != key {
+				t.Errorf("key = %q, want %q", status.Key, key)
+			}
+		})
+	}
+}
+
+func TestExposeCacheKey(t *testing.T) {
+	tests := []struct {
+		expose string
+		want   bool
+	}{
+		{expose: "", want: false},
+		{expose: "false", want: false},
+		{expose: "true", want: true},
+	}
+	for _, tt := range tests {
+		t.Run("EXPOSE_CACHE_KEY="+tt.expose, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"EXPOSE_CACHE_KEY": tt.expose}, nil)
+			got := e.get(testImagePath).Header.Get("X-Cache-Key")
+			if !tt.want {
+				if got != "" {
+					t.Errorf("X-Cache-Key = %q, want none", got)
+				}
+				return
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 1 || got != keys[0] {
+				t.Errorf("X-Cache-Key = %q, bucket has %v", got, keys)
+			}
+		})
+	}
+}
+
+func TestKeyGenerators(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator string
+		a, b      string
+		same      bool
+	}{
+		{name: "default ignores the query", a: testImagePath, b: testImagePath + "?v=2", same: true},
+		{name: "hash-path", generator: "hash-path", a: testImagePath + "?v=1", b: testImagePath + "?v=2", same: true},
+		{name: "hash-path+query", generator: "hash-path+query", a: testImagePath + "?v=1", b: testImagePath + "?v=2", same: false},
+		{name: "registered", generator: "constant", a: testImagePath, b: "/insecure/aHR0cHM6Ly9leGFtcGxlLmNvbS9kb2cuanBn", same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			if tt.generator != "" {
+				env["KEY_GENERATOR"] = tt.generator
+			}
+			cfg := testConfig(t, env)
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.a, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.b, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+	// Without a query hash-path+query keeps the hash-path keys
+	hashPath := testConfig(t, map[string]string{"KEY_GENERATOR": "hash-path"})
+	withQuery := testConfig(t, map[string]string{"KEY_GENERATOR": "hash-path+query"})
+	r := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+	if objectKey(hashPath, r, contentTypePNG) != objectKey(withQuery, r, contentTypePNG) {
+		t.Error("hash-path+query changed the keys of requests without a query")
+	}
+}
+
+func TestUnknownKeyGenerator(t *testing.T) {
+	t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+	t.Setenv("S3_BUCKET", testBucket)
+	t.Setenv("KEY_GENERATOR", "sha3")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "KEY_GENERATOR") {
+		t.Errorf("loadConfig error = %v, want an unknown KEY_GENERATOR", err)
+	}
+}
+
+func TestRegisterKeyGeneratorTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering hash-path again didn't panic")
+		}
+	}()
+	RegisterKeyGenerator("hash-path", KeyGeneratorFunc(func(r *http.Request) string { return "" }))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamLimiter is the in-memory Limiter, capping how many requests are
+// forwarded to imgproxy at once.
+// imgproxy is CPU bound, so queueing here beats over-parallelizing renders.
+type upstreamLimiter struct {
+	slots    chan struct{} // nil when unlimited
+	timeout  time.Duration
+	inFlight atomic.Int64
+}
+
+func newUpstreamLimiter(concurrency int, timeout time.Duration) *upstreamLimiter {
+	l := &upstreamLimiter{timeout: timeout}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// Acquire waits up to the queue timeout for a free slot and reports whether
+// one was obtained. Callers must release the slot once done. It never fails.
+func (l *upstreamLimiter) Acquire(ctx context.Context) (bool, error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.timeout <= 0 {
+				return false, nil
+			}
+			timer := time.NewTimer(l.timeout)
+			defer timer.Stop()
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				return false, nil
+			case <-ctx.Done():
+				return false, nil
+			}
+		}
+	}
+	l.inFlight.Add(1)
+	return true, nil
+}
+
+func (l *upstreamLimiter) Release() {
+	l.inFlight.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *upstreamLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
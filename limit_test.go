@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingLimiter stands for a limiter whose store is unreachable
+type failingLimiter struct{}
+
+func (failingLimiter) Acquire(ctx context.Context) (bool, error) {
+	return false, errors.New("store unreachable")
+}
+func (failingLimiter) Release()        { panic("no slot was acquired") }
+func (failingLimiter) InFlight() int64 { return 0 }
+
+func init() {
+	RegisterLimiter("failing", func(cfg Config) (Limiter, error) { return failingLimiter{}, nil })
+}
+
+func TestUpstreamLimiter(t *testing.T) {
+	l := newUpstreamLimiter(1, 10*time.Millisecond)
+	if ok, err := l.Acquire(t.Context()); !ok || err != nil {
+		t.Fatalf("first Acquire = %v, %v, want a slot", ok, err)
+	}
+	if ok, err := l.Acquire(t.Context()); ok || err != nil {
+		t.Fatalf("Acquire while full = %v, %v, want a timeout", ok, err)
+	}
+	if got := l.InFlight(); got != 1 {
+		t.Errorf("InFlight = %d, want 1", got)
+	}
+	l.Release()
+	if ok, _ := l.Acquire(t.Context()); !ok {
+		t.Error("Acquire after Release failed")
+	}
+}
+
+func TestLimiterFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		failOpen   string
+		status     int
+		retryAfter string
+	}{
+		{name: "fails closed by default", status: http.StatusTooManyRequests, retryAfter: "2"},
+		{name: "fail open", failOpen: "true", status: http.StatusOK},
+		{name: "fail closed", failOpen: "false", status: http.StatusTooManyRequests, retryAfter: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{
+				"LIMITER_BACKEND":       "failing",
+				"RATE_LIMIT_FAIL_OPEN":  tt.failOpen,
+				"SATURATED_RETRY_AFTER": "2s",
+			}, nil)
+			resp := e.get(testImagePath)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			if rendered := len(e.img.renders()) > 0; rendered != (tt.status == http.StatusOK) {
+				t.Errorf("rendered = %v", rendered)
+			}
+		})
+	}
+}
+
+func TestUpstreamConcurrency(t *testing.T) {
+	tests := []struct {
+		name         string
+		queueTimeout string
+		status       int
+		retryAfter   string
+	}{
+		{name: "rejected when full", queueTimeout: "0s", status: http.StatusServiceUnavailable, retryAfter: "2"},
+		{name: "queued until a slot frees", queueTimeout: "5s", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}, 2), make(chan struct{})
+			e := newTestEnv(t, map[string]string{
+				"UPSTREAM_CONCURRENCY":   "1",
+				"UPSTREAM_QUEUE_TIMEOUT": tt.queueTimeout,
+				"SATURATED_RETRY_AFTER":  "1500ms",
+			}, func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+				servePNG(w, r)
+			})
+
+			first := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				e.srv.ServeHTTP(first, httptest.NewRequest(http.MethodGet, testImagePath, nil))
+				close(done)
+			}()
+			<-started
+
+			stats := httptest.NewRecorder()
+			e.srv.ServeHTTP(stats, httptest.NewRequest(http.MethodGet, "/stats", nil))
+			var snapshot statsSnapshot
+			if err := json.NewDecoder(stats.Body).Decode(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.UpstreamInFlight != 1 {
+				t.Errorf("upstream_in_flight = %d, want 1", snapshot.UpstreamInFlight)
+			}
+
+			second := httptest.NewRecorder()
+			secondDone := make(chan struct{})
+			go func() {
+				e.srv.ServeHTTP(second, httptest.NewRequest(http.MethodGet, renderPath("local:///dog.png"), nil))
+				close(secondDone)
+			}()
+			if tt.status == http.StatusOK {
+				// Queued, the second render only starts once the first is done
+				select {
+				case <-started:
+					t.Fatal("the second render started while the first held the slot")
+				case <-time.After(50 * time.Millisecond):
+				}
+			} else {
+				<-secondDone
+			}
+			close(release)
+			<-done
+			<-secondDone
+
+			if first.Code != http.StatusOK {
+				t.Errorf("first: status = %d, want 200", first.Code)
+			}
+			if second.Code != tt.status {
+				t.Errorf("second: status = %d, want %d", second.Code, tt.status)
+			}
+			if got := second.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("second: Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			if got := e.srv.limiter.InFlight(); got != 0 {
+				t.Errorf("InFlight after both = %d, want 0", got)
+			}
+		})
+	}
+}
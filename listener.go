@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener accepts at most max connections at once. Accept blocks
+// while the limit is reached, leaving further clients in the kernel backlog.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func newLimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{Listener: l, slots: make(chan struct{}, max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// limitConn frees its slot once, however many times it is closed
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReadHeaderTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	tests := []struct {
+		name     string
+		request  string
+		answered bool
+	}{
+		{name: "complete headers", request: "GET /readyz HTTP/1.1\r\nHost: x\r\n\r\n", answered: true},
+		{name: "slow headers", request: "GET /readyz HTTP/1.1\r\nHost: x\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			e := newTestEnv(t, map[string]string{"IMGPROXY_BIND": addr, "READ_HEADER_TIMEOUT": timeout.String()}, nil)
+			go e.srv.serve(t.Context())
+			waitReady(t, addr)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			start := time.Now()
+			io.WriteString(conn, tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tt.answered {
+				if err != nil || resp.StatusCode != http.StatusOK {
+					t.Fatalf("resp = %v, err = %v", resp, err)
+				}
+				return
+			}
+			// The server may answer 408 before closing, either way the
+			// connection is cut once the headers are late
+			if err == nil && resp.StatusCode != http.StatusRequestTimeout {
+				t.Fatalf("status = %d, want the connection cut", resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed < timeout || elapsed > time.Second {
+				t.Errorf("cut off after %v, want about %v", elapsed, timeout)
+			}
+		})
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for range 2 {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("a second connection was accepted over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Closing twice frees a single slot
+	first.Close()
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the freed slot wasn't reused")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr := freeAddr(t)
+	e := newTestEnv(t, map[string]string{"IMGPROXY_BIND": addr, "MAX_CONNECTIONS": "1"}, nil)
+	go e.srv.serve(t.Context())
+	waitReady(t, addr)
+
+	// An idle keep-alive connection holds the only slot
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(idle, "GET /readyz HTTP/1.1\r\nHost: x\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(idle), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := noKeepAlive.Get("http://" + addr + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("a second connection was served while the slot was held, err = %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	idle.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued connection was never served")
+	}
+}
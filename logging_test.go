@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestSetupLogger(t *testing.T) {
+	tests := []struct {
+		format, level string
+		json          bool
+		debug, warn   bool
+		wantErr       bool
+	}{
+		{format: "", level: "", json: false, warn: true},
+		{format: "text", level: "debug", json: false, debug: true, warn: true},
+		{format: "json", level: "info", json: true, warn: true},
+		{format: "json", level: "error", json: true},
+		{format: "logfmt", wantErr: true},
+		{format: "text", level: "verbose", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.level, func(t *testing.T) {
+			defer slog.SetDefault(slog.Default())
+			t.Setenv("LOG_FORMAT", tt.format)
+			t.Setenv("LOG_LEVEL", tt.level)
+			err := setupLogger()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			h := slog.Default().Handler()
+			if _, ok := h.(*slog.JSONHandler); ok != tt.json {
+				t.Errorf("handler is %T", h)
+			}
+			if _, ok := h.(*slog.TextHandler); ok == tt.json {
+				t.Errorf("handler is %T", h)
+			}
+			ctx := context.Background()
+			if got := h.Enabled(ctx, slog.LevelDebug); got != tt.debug {
+				t.Errorf("debug enabled = %v, want %v", got, tt.debug)
+			}
+			if got := h.Enabled(ctx, slog.LevelWarn); got != tt.warn {
+				t.Errorf("warn enabled = %v, want %v", got, tt.warn)
+			}
+		})
+	}
+}
@@ -3,167 +3,254 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-type Config struct {
-	S3Bucket           string
-	S3Folder           string
-	TigrisProxyBind    string
-	HealthCheckTimeout time.Duration
-}
-
-func waitForHealth(target string, timeout time.Duration) error {
-	client := &http.Client{Timeout: 2 * time.Second}
-	endTime := time.Now().Add(timeout)
+// waitForHealth returns once HEALTH_CHECK_SUCCESS_THRESHOLD consecutive
+// checks passed, so a flapping start isn't taken for a ready imgproxy
+func waitForHealth(target string, transport http.RoundTripper, cfg Config) error {
+	client := &http.Client{Transport: transport, Timeout: cfg.HealthCheckAttemptTimeout}
+	endTime := time.Now().Add(cfg.HealthCheckTimeout)
 
+	successes := 0
 	for time.Now().Before(endTime) {
-		resp, err := client.Get(fmt.Sprintf("%s/health", target))
-		if err == nil {
-			if resp.StatusCode == http.StatusOK {
-				resp.Body.Close()
+		if checkHealth(client, target) == nil {
+			successes++
+			if successes == cfg.HealthCheckSuccessThreshold {
 				return nil
 			}
-			resp.Body.Close()
+		} else {
+			successes = 0
 		}
-		time.Sleep(500 * time.Millisecond)
+		time.Sleep(cfg.HealthCheckInterval)
 	}
-	return fmt.Errorf("health check failed after %v", timeout)
+	return fmt.Errorf("health check failed after %v", cfg.HealthCheckTimeout)
 }
 
-func main() {
-	healthCheckTimeout := 30 * time.Second
-	if os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC") != "" {
-		t, err := strconv.ParseInt(os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC"), 10, 64)
-		if err != nil {
-			slog.Error("Failed to parse HEALTH_CHECK_TIMEOUT_IN_SEC", "error", err)
-			os.Exit(1)
-		}
-		healthCheckTimeout = time.Duration(t) * time.Second
+const maxHealthBodySize = 4096
+
+// checkHealth probes imgproxy's health endpoint once
+func checkHealth(client *http.Client, target string) error {
+	resp, err := client.Get(fmt.Sprintf("%s/health", target))
+	if err != nil {
+		return err
+	}
+	// Drain a bounded amount so the connection can be reused without ever
+	// buffering a misbehaving endpoint's huge body
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBodySize))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// detectCacheVersion reads imgproxy's version from the health endpoint's
+// UPSTREAM_VERSION_HEADER, falling back to CACHE_VERSION when it isn't there
+func detectCacheVersion(target string, transport http.RoundTripper, cfg Config) string {
+	client := &http.Client{Transport: transport, Timeout: cfg.HealthCheckAttemptTimeout}
+	resp, err := client.Get(fmt.Sprintf("%s/health", target))
+	if err != nil {
+		slog.Warn("Failed to detect imgproxy version, using CACHE_VERSION", "error", err)
+		return cfg.CacheVersion
 	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBodySize))
+	resp.Body.Close()
 
-	cfg := Config{
-		S3Bucket:           os.Getenv("S3_BUCKET"),
-		S3Folder:           os.Getenv("S3_FOLDER"),
-		TigrisProxyBind:    os.Getenv("IMGPROXY_BIND"),
-		HealthCheckTimeout: healthCheckTimeout,
+	version := sanitizeCacheVersion(resp.Header.Get(cfg.UpstreamVersionHeader))
+	if version == "" {
+		slog.Warn("imgproxy doesn't expose its version, using CACHE_VERSION", "header", cfg.UpstreamVersionHeader)
+		return cfg.CacheVersion
 	}
-	if cfg.S3Bucket == "" {
-		slog.Error("Missing required environment variable(s)", "config", cfg)
+	slog.Info("Using imgproxy version as cache namespace", "version", version)
+	return version
+}
+
+func main() {
+	selftest := flag.Bool("selftest", false, "render SELFTEST_PATH, check it round-trips through the bucket and exit")
+	flag.Parse()
+
+	if err := setupLogger(); err != nil {
+		slog.Error("Invalid logging configuration", "error", err)
 		os.Exit(1)
 	}
-	if cfg.TigrisProxyBind == "" {
-		cfg.TigrisProxyBind = ":8080"
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
 	}
 
-	// Initialize S3 uploader
-	uploader := manager.NewUploader(initS3Client(), func(u *manager.Uploader) {
-		u.PartSize = 5 * 1024 * 1024
-		u.BufferProvider = manager.NewBufferedReadSeekerWriteToPool(10 * 1024 * 1024)
-	})
+	// Initialize S3 client
+	var s3Client, mirrorClient *s3.Client
+	if cfg.CacheEnabled {
+		s3Client = initS3Client(cfg)
+		if cfg.CreateFolderMarker {
+			createFolderMarkers(context.Background(), s3Client, cfg)
+		}
+		if cfg.MirrorS3Bucket != "" {
+			mirrorClient = initMirrorS3Client(cfg)
+			slog.Info("Mirroring objects", "bucket", cfg.MirrorS3Bucket, "endpoint", cfg.MirrorS3Endpoint)
+		}
+	} else {
+		slog.Info("Caching is disabled, running as a plain reverse proxy")
+	}
 
 	// Initialize the proxy
-	targetURL := "http://127.0.0.1:8081"
+	targetURL := cfg.UpstreamURL
 	target, err := url.Parse(targetURL)
 	if err != nil {
-		slog.Error("Failed to parse imgproxy local endpoint", "error", err)
+		slog.Error("Failed to parse imgproxy endpoint", "error", err)
 		os.Exit(1)
 	}
-
-	// Wait for the health endpoint to be ready
-	slog.Info("Waiting for imgproxy to be ready...")
-	if err := waitForHealth(targetURL, cfg.HealthCheckTimeout); err != nil {
-		slog.Error("Health check failed", "error", err)
+	upstream, err := upstreamTransport(cfg)
+	if err != nil {
+		slog.Error("Failed to initialize imgproxy transport", "error", err)
 		os.Exit(1)
 	}
-	slog.Info("imgproxy is ready")
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		if resp.StatusCode == http.StatusOK {
-			// Read the entire response body into a buffer
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				slog.Error("Failed to read response body", "error", err)
-				return err
-			}
-
-			// Create two separate readers from the same bytes
-			// One for the response and one for S3 upload
-			respReader := bytes.NewReader(bodyBytes)
-			s3Reader := bytes.NewReader(bodyBytes)
-
-			// Replace the response body with our buffered copy
-			resp.Body = io.NopCloser(respReader)
+	// Wait for the health endpoint to be ready. imgproxy may be offline on
+	// purpose when starting in maintenance mode, so don't wait for it then.
+	if cfg.MaintenanceMode {
+		slog.Info("Starting in maintenance mode, not waiting for imgproxy")
+	} else {
+		slog.Info("Waiting for imgproxy to be ready...")
+		if err := waitForHealth(targetURL, upstream, cfg); err != nil {
+			slog.Error("Health check failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("imgproxy is ready")
 
-			// Upload the complete file to S3 in a goroutine
-			go func() {
-				if err := uploadToS3(context.Background(), uploader, cfg, s3Reader, resp.Request.URL.Path); err != nil {
-					slog.Error("S3 upload failed", "error", err)
-				}
-			}()
+		if cfg.UpstreamVersionHeader != "" {
+			cfg.CacheVersion = detectCacheVersion(targetURL, upstream, cfg)
 		}
-		return nil
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		proxy.ServeHTTP(w, r)
-	})
+	srv, err := newServer(cfg, s3Client, mirrorClient, target, upstream)
+	if err != nil {
+		slog.Error("Failed to initialize server", "error", err)
+		os.Exit(1)
+	}
+	if *selftest {
+		if err := runSelftest(context.Background(), srv); err != nil {
+			slog.Error("Self-test failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Self-test passed")
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if cfg.HealthPollInterval > 0 {
+		go srv.health.poll(ctx, targetURL, upstream, cfg)
+	}
+	if cfg.S3ReadyInterval > 0 && s3Client != nil {
+		go srv.bucketHealth.poll(ctx, s3Client, cfg)
+	}
+	if cfg.CacheEventWebhookURL != "" {
+		go srv.events.run(context.Background())
+	}
 
-	if err := http.ListenAndServe(fmt.Sprintf("%s", cfg.TigrisProxyBind), nil); err != nil {
+	if err := srv.serve(ctx); err != nil {
 		slog.Error("Server failed", "error", err)
+		os.Exit(1)
 	}
 }
 
-func uploadToS3(ctx context.Context, uploader *manager.Uploader, cfg Config, r io.Reader, path string) error {
-	key := generateS3Key(path)
-
-	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(cfg.S3Bucket),
-		Key:    aws.String(fmt.Sprintf("%s%s", cfg.S3Folder, key)),
-		Body:   r,
-	})
-
-	if err != nil {
-		slog.Error("Upload failed", "path", path, "key", key, "error", err)
-		return err
+// createFolderMarkers puts a zero-byte object at each configured folder
+// missing one, so the folders show up in bucket consoles before the first
+// upload. Failing is only logged, objects can be stored without markers.
+func createFolderMarkers(ctx context.Context, client *s3.Client, cfg Config) {
+	folders := []string{cfg.S3Folder}
+	for _, folder := range cfg.S3FoldersByType {
+		if !slices.Contains(folders, folder) {
+			folders = append(folders, folder)
+		}
+	}
+	for _, folder := range folders {
+		if strings.Trim(folder, "/") == "" {
+			continue
+		}
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(cfg.S3Bucket), Key: aws.String(folder)})
+		if err == nil {
+			continue
+		}
+		if !isNotFound(err) {
+			slog.Warn("Failed to check folder marker", "folder", folder, "error", err)
+			continue
+		}
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(cfg.S3Bucket),
+			Key:           aws.String(folder),
+			Body:          bytes.NewReader(nil),
+			ContentLength: aws.Int64(0),
+		})
+		if err != nil {
+			slog.Warn("Failed to create folder marker", "folder", folder, "error", err)
+			continue
+		}
+		slog.Info("Created folder marker", "folder", folder)
 	}
+}
 
-	slog.Info("Uploaded to S3", "path", path, "bucket", cfg.S3Bucket, "key", key)
-	return nil
+func initS3Client(cfg Config) *s3.Client {
+	return newS3Client(cfg, cfg.S3Endpoint, "auto")
 }
 
-// generateS3Key creates a hash from the imgproxy URL path
-func generateS3Key(path string) string {
-	hash := md5.Sum([]byte(path))
-	return hex.EncodeToString(hash[:])
+// initMirrorS3Client shares the primary client's transport and retry
+// settings, with the mirror's own credentials when set
+func initMirrorS3Client(cfg Config) *s3.Client {
+	var opts []func(*config.LoadOptions) error
+	if cfg.MirrorS3AccessKeyID != "" {
+		creds := aws.Credentials{AccessKeyID: cfg.MirrorS3AccessKeyID, SecretAccessKey: cfg.MirrorS3SecretAccessKey, Source: "MirrorConfig"}
+		opts = append(opts, config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return creds, nil
+		})))
+	}
+	return newS3Client(cfg, cfg.MirrorS3Endpoint, cfg.MirrorS3Region, opts...)
 }
 
-func initS3Client() *s3.Client {
-	sdkConfig, err := config.LoadDefaultConfig(context.Background())
+func newS3Client(cfg Config, endpoint, region string, opts ...func(*config.LoadOptions) error) *s3.Client {
+	httpClient, err := s3HTTPClient(cfg)
+	if err != nil {
+		slog.Error("Failed to initialize S3 HTTP client", "error", err)
+		os.Exit(1)
+	}
+
+	opts = append([]func(*config.LoadOptions) error{
+		config.WithHTTPClient(httpClient),
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = cfg.S3RetryMaxAttempts
+				o.MaxBackoff = cfg.S3RetryMaxBackoff
+			})
+		}),
+	}, opts...)
+	sdkConfig, err := config.LoadDefaultConfig(context.Background(), opts...)
 	if err != nil {
 		slog.Error("Failed to initialize AWS config", "error", err)
 		os.Exit(1)
 	}
 
 	svc := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String("https://fly.storage.tigris.dev")
-		o.Region = "auto"
+		o.BaseEndpoint = aws.String(endpoint)
+		o.Region = region
 		o.UsePathStyle = true
 	})
 
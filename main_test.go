@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestS3ClientRetries(t *testing.T) {
+	tests := []struct {
+		maxAttempts string
+		want        int
+	}{
+		{maxAttempts: "1", want: 1},
+		{maxAttempts: "4", want: 4},
+	}
+	for _, tt := range tests {
+		t.Run("S3_RETRY_MAX_ATTEMPTS="+tt.maxAttempts, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "test")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+			fake := newFakeS3(t)
+			fake.setFail(func(r *http.Request) int { return http.StatusServiceUnavailable })
+			cfg := testConfig(t, map[string]string{
+				"S3_ENDPOINT":           fake.URL,
+				"S3_RETRY_MAX_ATTEMPTS": tt.maxAttempts,
+				"S3_RETRY_MAX_BACKOFF":  "1ms",
+			})
+
+			client := initS3Client(cfg)
+			if got := client.Options().Retryer.MaxAttempts(); got != tt.want {
+				t.Errorf("MaxAttempts = %d, want %d", got, tt.want)
+			}
+			_, err := client.PutObject(t.Context(), &s3.PutObjectInput{
+				Bucket: aws.String(testBucket),
+				Key:    aws.String("key"),
+				Body:   bytes.NewReader([]byte("x")),
+			})
+			if err == nil {
+				t.Fatal("PutObject succeeded")
+			}
+			if got := fake.calls(http.MethodPut); got != tt.want {
+				t.Errorf("%d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectCacheVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		down    bool
+		want    string
+	}{
+		{name: "exposed", version: "v3.24.1", want: "v3.24.1"},
+		{name: "sanitized", version: " v3/24 ", want: "v324"},
+		{name: "not exposed", want: "manual"},
+		{name: "unreachable", down: true, want: "manual"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health" {
+					http.NotFound(w, r)
+					return
+				}
+				if tt.version != "" {
+					w.Header().Set("X-Imgproxy-Version", tt.version)
+				}
+				w.Write([]byte("imgproxy is running"))
+			}))
+			defer img.Close()
+			if tt.down {
+				img.Close()
+			}
+			cfg := testConfig(t, map[string]string{"CACHE_VERSION": "manual", "UPSTREAM_VERSION_HEADER": "X-Imgproxy-Version"})
+			if got := detectCacheVersion(img.URL, http.DefaultTransport, cfg); got != tt.want {
+				t.Errorf("detectCacheVersion = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheVersionNamespacesKeys(t *testing.T) {
+	cfg := testConfig(t, nil)
+	req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+	keys := make(map[string]bool)
+	for _, version := range []string{"", "v3.24.0", "v3.24.1"} {
+		cfg.CacheVersion = version
+		key := objectKey(cfg, req, contentTypePNG)
+		if version != "" && !strings.Contains(key, version+"/") {
+			t.Errorf("key %q isn't under %s/", key, version)
+		}
+		keys[key] = true
+	}
+	if len(keys) != 3 {
+		t.Errorf("keys %v, want one keyspace per version", keys)
+	}
+}
+
+func TestWaitForHealthSuccessThreshold(t *testing.T) {
+	const ok, down = http.StatusOK, http.StatusServiceUnavailable
+	tests := []struct {
+		name      string
+		threshold string
+		statuses  []int
+		checks    int
+		wantErr   bool
+	}{
+		{name: "first success", threshold: "1", statuses: []int{down, ok}, checks: 2},
+		{name: "consecutive successes", threshold: "3", statuses: []int{ok, ok, ok}, checks: 3},
+		{name: "flapping start", threshold: "3", statuses: []int{ok, down, ok, ok, down, ok, ok, ok}, checks: 8},
+		{name: "never steady", threshold: "3", statuses: []int{ok, ok, down}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := tt.statuses
+			if tt.wantErr {
+				// Keep flapping until the timeout
+				for len(statuses) < 1000 {
+					statuses = append(statuses, tt.statuses...)
+				}
+			}
+			img, checks := scriptedHealth(t, statuses...)
+			cfg := testConfig(t, map[string]string{
+				"HEALTH_CHECK_SUCCESS_THRESHOLD": tt.threshold,
+				"HEALTH_CHECK_INTERVAL":          "1ms",
+				"HEALTH_CHECK_TIMEOUT_IN_SEC":    "1",
+			})
+			err := waitForHealth(img.URL, http.DefaultTransport, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && checks() != tt.checks {
+				t.Errorf("ready after %d checks, want %d", checks(), tt.checks)
+			}
+		})
+	}
+}
+
+func TestCheckHealthAttempt(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{name: "healthy", handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }},
+		{name: "unhealthy", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) }, wantErr: true},
+		{name: "too slow", handler: func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}, wantErr: true},
+		// Only the first bytes of the body are read
+		{name: "endless body", handler: func(w http.ResponseWriter, r *http.Request) {
+			chunk := make([]byte, maxHealthBodySize)
+			for r.Context().Err() == nil {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := httptest.NewServer(tt.handler)
+			defer img.Close()
+			cfg := testConfig(t, map[string]string{"HEALTH_CHECK_ATTEMPT_TIMEOUT": "100ms"})
+			client := &http.Client{Timeout: cfg.HealthCheckAttemptTimeout}
+			start := time.Now()
+			err := checkHealth(client, img.URL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("check took %v, want it bounded by the attempt timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestCreateFolderMarkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		existing string
+		want     []string
+		puts     int
+	}{
+		{name: "bucket root", want: nil},
+		{name: "folder", env: map[string]string{"S3_FOLDER": "images/"}, want: []string{"images/"}, puts: 1},
+		{name: "folders by type", env: map[string]string{"S3_FOLDER": "images/", "S3_FOLDERS_BY_TYPE": "webp=webp,avif=images"}, want: []string{"images/", "webp/"}, puts: 2},
+		{name: "marker already there", env: map[string]string{"S3_FOLDER": "images/"}, existing: "images/", want: []string{"images/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.env, nil)
+			if tt.existing != "" {
+				e.s3.put(tt.existing, nil, http.Header{})
+			}
+			createFolderMarkers(t.Context(), e.s3.client(), *e.srv.config())
+			if got := e.s3.keys(testBucket); !slices.Equal(got, tt.want) {
+				t.Errorf("bucket has %v, want %v", got, tt.want)
+			}
+			if got := e.s3.calls(http.MethodPut); got != tt.puts {
+				t.Errorf("%d markers put, want %d", got, tt.puts)
+			}
+		})
+	}
+}
+
+func TestCreateFolderMarkersFailing(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"S3_FOLDER": "images/"}, nil)
+	e.s3.setFail(func(r *http.Request) int { return http.StatusForbidden })
+	createFolderMarkers(t.Context(), e.s3.client(), *e.srv.config())
+	// A failing check is only logged, no marker is forced over it
+	if got := e.s3.calls(http.MethodPut); got != 0 {
+		t.Errorf("%d markers put after a failed check", got)
+	}
+}
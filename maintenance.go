@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maintenance answers cache misses itself while imgproxy is taken offline.
+// Hits keep being served straight from the bucket.
+type maintenance struct {
+	enabled    atomic.Bool
+	status     int
+	body       string
+	retryAfter time.Duration
+}
+
+func newMaintenance(cfg Config) *maintenance {
+	m := &maintenance{status: cfg.MaintenanceStatus, body: cfg.MaintenanceBody, retryAfter: cfg.MaintenanceRetryAfter}
+	m.enabled.Store(cfg.MaintenanceMode)
+	return m
+}
+
+func (m *maintenance) Enabled() bool {
+	return m.enabled.Load()
+}
+
+func (m *maintenance) serve(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	setRetryAfter(w.Header(), m.status, m.retryAfter)
+	w.WriteHeader(m.status)
+	w.Write([]byte(m.body))
+}
+
+// adminMaintenanceHandler reports the maintenance mode on GET and toggles it
+// on POST ?enabled=true|false
+func adminMaintenanceHandler(m *maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "enabled must be true or false"})
+				return
+			}
+			m.enabled.Store(enabled)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": m.Enabled()})
+	}
+}
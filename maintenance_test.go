@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status int
+		body   string
+	}{
+		{name: "default", status: http.StatusServiceUnavailable, body: "Service under maintenance, please retry later"},
+		{name: "configured", env: map[string]string{"MAINTENANCE_STATUS": "404", "MAINTENANCE_BODY": "gone fishing"}, status: http.StatusNotFound, body: "gone fishing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{"MAINTENANCE_MODE": "true"}, tt.env), nil)
+			resp := e.get(testImagePath)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if body := string(readAll(t, resp)); body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			if n := len(e.img.renders()); n != 0 {
+				t.Errorf("imgproxy received %d requests", n)
+			}
+		})
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		status  int
+		enabled bool
+	}{
+		{name: "report", method: http.MethodGet, path: "/admin/maintenance", status: http.StatusOK},
+		{name: "enable", method: http.MethodPost, path: "/admin/maintenance?enabled=true", status: http.StatusOK, enabled: true},
+		{name: "disable", method: http.MethodPost, path: "/admin/maintenance?enabled=false", status: http.StatusOK},
+		{name: "invalid", method: http.MethodPost, path: "/admin/maintenance?enabled=maybe", status: http.StatusBadRequest},
+		{name: "wrong method", method: http.MethodDelete, path: "/admin/maintenance", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+			resp := e.admin(tt.method, tt.path)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				var got map[string]bool
+				if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got["enabled"] != tt.enabled {
+					t.Errorf("enabled = %v, want %v", got["enabled"], tt.enabled)
+				}
+			}
+			// Toggled at runtime, misses follow right away
+			want := http.StatusOK
+			if tt.enabled {
+				want = http.StatusServiceUnavailable
+			}
+			if resp := e.get(testImagePath); resp.StatusCode != want {
+				t.Errorf("image status = %d, want %d", resp.StatusCode, want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceServe(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status int
+		body   string
+	}{
+		{name: "default", status: http.StatusServiceUnavailable, body: "Service under maintenance, please retry later"},
+		{name: "configured", env: map[string]string{"MAINTENANCE_STATUS": "404", "MAINTENANCE_BODY": "gone fishing"}, status: http.StatusNotFound, body: "gone fishing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMaintenance(testConfig(t, tt.env))
+			rec := httptest.NewRecorder()
+			m.serve(rec)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if body := rec.Body.String(); body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+}
+
+func TestAdminMaintenanceHandler(t *testing.T) {
+	m := newMaintenance(testConfig(t, nil))
+	handler := adminMaintenanceHandler(m)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		status  int
+		enabled bool
+	}{
+		{name: "report", method: http.MethodGet, path: "/admin/maintenance", status: http.StatusOK},
+		{name: "enable", method: http.MethodPost, path: "/admin/maintenance?enabled=true", status: http.StatusOK, enabled: true},
+		{name: "still enabled", method: http.MethodGet, path: "/admin/maintenance", status: http.StatusOK, enabled: true},
+		{name: "invalid", method: http.MethodPost, path: "/admin/maintenance?enabled=maybe", status: http.StatusBadRequest, enabled: true},
+		{name: "wrong method", method: http.MethodDelete, path: "/admin/maintenance", status: http.StatusMethodNotAllowed, enabled: true},
+		{name: "disable", method: http.MethodPost, path: "/admin/maintenance?enabled=false", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				var got map[string]bool
+				if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got["enabled"] != tt.enabled {
+					t.Errorf("reported enabled = %v, want %v", got["enabled"], tt.enabled)
+				}
+			}
+			if m.Enabled() != tt.enabled {
+				t.Errorf("enabled = %v, want %v", m.Enabled(), tt.enabled)
+			}
+		})
+	}
+}
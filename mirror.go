@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// mirrorConcurrency bounds the copies to the mirror in flight, the ones
+	// above it are dropped
+	mirrorConcurrency = 4
+	mirrorTimeout     = 5 * time.Minute
+)
+
+// mirror copies every object written to the bucket to a second one, possibly
+// at another provider. Copies are best effort: they run after the write they
+// follow, read the object back from the primary bucket, and are dropped when
+// too many are in flight.
+type mirror struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	acl      types.ObjectCannedACL
+	slots    chan struct{}
+}
+
+func newMirror(cfg Config, client *s3.Client) *mirror {
+	return &mirror{
+		client:   client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) { u.PartSize = uploadPartSize }),
+		bucket:   cfg.MirrorS3Bucket,
+		acl:      cfg.S3ObjectACL,
+		slots:    make(chan struct{}, mirrorConcurrency),
+	}
+}
+
+// mirrorObject schedules the copy of key to the mirror, if there is one
+func (s *server) mirrorObject(key string) {
+	if s.mirror == nil {
+		return
+	}
+	select {
+	case s.mirror.slots <- struct{}{}:
+	default:
+		s.stats.mirrorDropped.Add(1)
+		slog.Warn("Skipping mirror copy, too many in flight", "key", key)
+		return
+	}
+	bucket := s.config().S3Bucket
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		defer func() { <-s.mirror.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+		if err := s.mirror.copy(ctx, s.s3, bucket, key); err != nil {
+			s.stats.mirrorFailures.Add(1)
+			slog.Error("Mirror copy failed", "key", key, "error", err)
+			return
+		}
+		s.stats.mirrorWrites.Add(1)
+		slog.Debug("Mirrored object", "key", key, "bucket", s.mirror.bucket)
+	}()
+}
+
+// copy streams key from the primary bucket to the mirror, metadata included
+func (m *mirror) copy(ctx context.Context, primary *s3.Client, bucket, key string) error {
+	out, err := primary.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("read from primary failed: %w", err)
+	}
+	defer out.Body.Close()
+
+	_, err = m.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:                  aws.String(m.bucket),
+		Key:                     aws.String(key),
+		Body:                    out.Body,
+		ACL:                     m.acl,
+		Metadata:                out.Metadata,
+		ContentType:             out.ContentType,
+		ContentEncoding:         out.ContentEncoding,
+		CacheControl:            out.CacheControl,
+		WebsiteRedirectLocation: out.WebsiteRedirectLocation,
+	})
+	if err != nil {
+		return fmt.Errorf("write to mirror failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// The mirror is another fake S3, under the same bucket name
+func TestMirrorWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		mirrorDown bool
+	}{
+		{name: "mirrored"},
+		// The mirror is best effort, the primary write stands
+		{name: "mirror down", mirrorDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"MIRROR_S3_BUCKET": testBucket}, nil)
+			if tt.mirrorDown {
+				e.mirror.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+			}
+			if resp := e.get(testImagePath); resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("primary has %v, want one object", keys)
+			}
+			mirrored := e.mirror.keys(testBucket)
+			if tt.mirrorDown {
+				if len(mirrored) != 0 || e.srv.stats.mirrorFailures.Load() != 1 {
+					t.Errorf("mirror has %v, %d failures", mirrored, e.srv.stats.mirrorFailures.Load())
+				}
+				return
+			}
+			if len(mirrored) != 1 || mirrored[0] != keys[0] || e.srv.stats.mirrorWrites.Load() != 1 {
+				t.Fatalf("mirror has %v, %d writes, want %v", mirrored, e.srv.stats.mirrorWrites.Load(), keys)
+			}
+			primary, _ := e.s3.object(keys[0])
+			copied, _ := e.mirror.object(keys[0])
+			if !bytes.Equal(copied.body, primary.body) || copied.header.Get("Content-Type") != primary.header.Get("Content-Type") {
+				t.Errorf("mirror copy differs from the primary object")
+			}
+			if got, want := copied.header.Get("X-Amz-Meta-Status"), primary.header.Get("X-Amz-Meta-Status"); got != want {
+				t.Errorf("mirror status metadata = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMirrorFallbackLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		mirrored bool
+		status   int
+	}{
+		{name: "only in the mirror", mirrored: true, status: http.StatusOK},
+		{name: "in neither", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "MIRROR_S3_BUCKET": testBucket}, nil)
+			if !tt.mirrored {
+				e.mirror.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+			}
+			e.get(testImagePath)
+			e.mirror.setFail(nil)
+			// The object is lost from the primary bucket
+			key := e.s3.keys(testBucket)[0]
+			if _, err := e.s3.client().DeleteObject(t.Context(), &s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key)}); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := e.admin(http.MethodGet, "/admin/cache?path="+testImagePath)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			var status cacheStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Exists != tt.mirrored || status.InMirror != tt.mirrored || status.Key != key {
+				t.Errorf("status = %+v", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	missingSourcePassthrough   = "passthrough"
+	missingSourceFallback      = "fallback"
+	missingSourceNegativeCache = "negative-cache"
+)
+
+// negativeCacheMaxEntries bounds the memory used to remember missing sources
+const negativeCacheMaxEntries = 10000
+
+// negativeCache remembers the paths imgproxy recently answered 404 for, so
+// repeated requests for a known-missing source don't reach imgproxy again.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, entries: make(map[string]time.Time)}
+}
+
+func (c *negativeCache) Add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= negativeCacheMaxEntries {
+		for p, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, p)
+			}
+		}
+		if len(c.entries) >= negativeCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[path] = now.Add(c.ttl)
+}
+
+func (c *negativeCache) Contains(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[path]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.entries, path)
+		return false
+	}
+	return true
+}
+
+// serveFallbackImage replaces an upstream response with the fallback image
+func serveFallbackImage(resp *http.Response, img []byte) {
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Status = http.StatusText(http.StatusOK)
+	resp.Body = io.NopCloser(bytes.NewReader(img))
+	resp.ContentLength = int64(len(img))
+	resp.Header.Set("Content-Type", http.DetectContentType(img))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(img)))
+	// The source may show up later, don't let clients keep the placeholder
+	resp.Header.Set("Cache-Control", "no-cache")
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("ETag")
+}
+
+// sanitizeErrorResponse replaces an imgproxy error body, which may name
+// source URLs or internal paths, with the bare status text
+func sanitizeErrorResponse(resp *http.Response) {
+	resp.Body.Close()
+	body := http.StatusText(resp.StatusCode) + "\n"
+	resp.Body = io.NopCloser(strings.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("ETag")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissingSourceBehavior(t *testing.T) {
+	fallback := filepath.Join(t.TempDir(), "fallback.png")
+	if err := os.WriteFile(fallback, testPNG, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		behavior string
+		status   int
+		body     []byte
+		// renders is how many of the two requests reached imgproxy
+		renders     int
+		secondCache string
+	}{
+		{behavior: missingSourcePassthrough, status: http.StatusNotFound, renders: 2, secondCache: cacheBypass},
+		{behavior: missingSourceFallback, status: http.StatusOK, body: testPNG, renders: 2, secondCache: cacheBypass},
+		{behavior: missingSourceNegativeCache, status: http.StatusNotFound, renders: 1, secondCache: cacheNegative},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behavior, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{
+				"MISSING_SOURCE_BEHAVIOR": tt.behavior,
+				"FALLBACK_IMAGE_PATH":     fallback,
+			}, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "source image not found", http.StatusNotFound)
+			})
+
+			var resp *http.Response
+			for range 2 {
+				resp = e.get(testImagePath)
+				if resp.StatusCode != tt.status {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+				}
+			}
+			if tt.body != nil && !bytes.Equal(readAll(t, resp), tt.body) {
+				t.Error("the fallback image wasn't served")
+			}
+			if got := resp.Header.Get("X-Cache"); got != tt.secondCache {
+				t.Errorf("X-Cache = %q, want %q", got, tt.secondCache)
+			}
+			if got := len(e.img.renders()); got != tt.renders {
+				t.Errorf("imgproxy received %d requests, want %d", got, tt.renders)
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 0 {
+				t.Errorf("uploaded %v", keys)
+			}
+		})
+	}
+}
+
+func TestNegativeCacheExpires(t *testing.T) {
+	c := newNegativeCache(20 * time.Millisecond)
+	c.Add("/missing")
+	if !c.Contains("/missing") {
+		t.Fatal("the path wasn't remembered")
+	}
+	if c.Contains("/other") {
+		t.Error("an unknown path was reported missing")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if c.Contains("/missing") {
+		t.Error("the entry outlived its TTL")
+	}
+}
+
+func TestServeFallbackImage(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header: http.Header{
+			"Content-Type":     {"text/plain"},
+			"Content-Encoding": {"gzip"},
+			"Etag":             {`"missing"`},
+		},
+		Body: io.NopCloser(strings.NewReader("source image not found")),
+	}
+	serveFallbackImage(resp, testPNG)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if b, _ := io.ReadAll(resp.Body); !bytes.Equal(b, testPNG) {
+		t.Error("the body isn't the fallback image")
+	}
+	want := http.Header{
+		"Content-Type":   {"image/png"},
+		"Content-Length": {strconv.Itoa(len(testPNG))},
+		"Cache-Control":  {"no-cache"},
+	}
+	if !reflect.DeepEqual(resp.Header, want) {
+		t.Errorf("headers = %v, want %v", resp.Header, want)
+	}
+}
+
+func TestMissingSourceConfig(t *testing.T) {
+	t.Setenv("UPSTREAM_URL", "http://imgproxy.invalid")
+	t.Setenv("S3_BUCKET", testBucket)
+	for _, env := range []map[string]string{
+		{"MISSING_SOURCE_BEHAVIOR": "ignore"},
+		{"MISSING_SOURCE_BEHAVIOR": missingSourceFallback, "FALLBACK_IMAGE_PATH": ""},
+	} {
+		for name, value := range env {
+			t.Setenv(name, value)
+		}
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("loadConfig accepted %v", env)
+		}
+	}
+}
+
+func TestUpstreamErrorPassthrough(t *testing.T) {
+	const detail = "Source image is unreachable: GET https://internal.example/cat.jpg: dial tcp 10.0.0.3:443"
+	tests := []struct {
+		name        string
+		passthrough string
+		status      int
+		want        string
+	}{
+		{name: "sanitized client error", passthrough: "false", status: http.StatusUnprocessableEntity, want: "Unprocessable Entity\n"},
+		{name: "sanitized server error", passthrough: "false", status: http.StatusInternalServerError, want: "Internal Server Error\n"},
+		{name: "passed through", passthrough: "true", status: http.StatusUnprocessableEntity, want: detail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"UPSTREAM_ERROR_PASSTHROUGH": tt.passthrough}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", `"error"`)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(detail))
+			})
+			resp := e.get(testImagePath)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := string(readAll(t, resp)); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(tt.want)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(tt.want))
+			}
+			if sanitized := resp.Header.Get("ETag") == ""; sanitized != (tt.passthrough == "false") {
+				t.Errorf("ETag = %q", resp.Header.Get("ETag"))
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 0 {
+				t.Errorf("errors were cached: %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	uploadPartAttempts = 3
+	uploadPartBackoff  = time.Second
+)
+
+// resumableUpload sends input.Body part by part through the low level
+// multipart API. A part that fails is retried on its own, keeping the parts
+// already sent, instead of the whole upload starting over. Parts are sent one
+// at a time, the next one being read meanwhile, so two part buffers are held.
+func (s *server) resumableUpload(ctx context.Context, input *s3.PutObjectInput) error {
+	created, err := s.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		ACL:             input.ACL,
+		Metadata:        input.Metadata,
+		ContentType:     input.ContentType,
+		CacheControl:    input.CacheControl,
+		ContentEncoding: input.ContentEncoding,
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload failed: %w", err)
+	}
+	uploadID := created.UploadId
+
+	parts, err := s.uploadParts(ctx, input, uploadID)
+	if err == nil {
+		_, err = s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("complete multipart upload failed: %w", err)
+	}
+
+	// Abort even when the upload was cancelled so the parts don't linger
+	abortCtx := context.WithoutCancel(ctx)
+	if _, abortErr := s.s3.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: uploadID,
+	}); abortErr != nil {
+		slog.Warn("Failed to abort multipart upload", "key", aws.ToString(input.Key), "upload_id", aws.ToString(uploadID), "error", abortErr)
+	}
+	return err
+}
+
+// filledPart is a part read from the body, last when the body ended with it
+type filledPart struct {
+	number int32
+	data   []byte
+	last   bool
+	err    error
+}
+
+func (s *server) uploadParts(ctx context.Context, input *s3.PutObjectInput, uploadID *string) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	free := make(chan []byte, 2)
+	free <- make([]byte, uploadPartSize)
+	free <- make([]byte, uploadPartSize)
+	filled := make(chan filledPart)
+	go readParts(ctx, input.Body, free, filled)
+
+	var parts []types.CompletedPart
+	for part := range filled {
+		if part.err != nil {
+			return nil, part.err
+		}
+		etag, err := s.uploadPart(ctx, input, uploadID, part.number, part.data)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, types.CompletedPart{ETag: etag, PartNumber: aws.Int32(part.number)})
+		if part.last {
+			return parts, nil
+		}
+		free <- part.data[:cap(part.data)]
+	}
+	// The reader also stops early when ctx is done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// readParts fills the free buffers from r and hands them over in order,
+// so the body keeps being read while a part is being uploaded, until r ends
+// or fails
+func readParts(ctx context.Context, r io.Reader, free <-chan []byte, filled chan<- filledPart) {
+	defer close(filled)
+	for number := int32(1); ; number++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-ctx.Done():
+			return
+		}
+		n, err := io.ReadFull(r, buf)
+		part := filledPart{number: number, data: buf[:n]}
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF) && number > 1:
+			// The previous part was the last one
+			return
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			part.last = true
+		default:
+			part.err = fmt.Errorf("read upload data failed: %w", err)
+		}
+		select {
+		case filled <- part:
+		case <-ctx.Done():
+			return
+		}
+		if part.last || part.err != nil {
+			return
+		}
+	}
+}
+
+// uploadPart sends one part, retrying it with backoff on failure
+func (s *server) uploadPart(ctx context.Context, input *s3.PutObjectInput, uploadID *string, number int32, data []byte) (*string, error) {
+	backoff := uploadPartBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := s.s3.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        input.Bucket,
+			Key:           input.Key,
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(number),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+		})
+		if err == nil {
+			return out.ETag, nil
+		}
+		if attempt == uploadPartAttempts {
+			return nil, fmt.Errorf("upload part %d failed after %d attempts: %w", number, attempt, err)
+		}
+		slog.Warn("Upload part failed, retrying", "key", aws.ToString(input.Key), "part", number, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResumableUploadRetriesFailedPart(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), (2*uploadPartSize+uploadPartSize/5)/10)
+	// The tee buffer holds the whole body, what is tested is the retry and
+	// not whether the upload keeps up with the client
+	env := map[string]string{"RESUMABLE_UPLOADS": "true", "EXPOSE_CACHE_KEY": "true", "UPLOAD_TEE_BUFFER_SIZE": strconv.Itoa(3 * uploadPartSize)}
+	e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length, so the body goes through the multipart path
+		w.Header().Set("Content-Type", "image/png")
+		for chunk := range slices.Chunk(body, 64*1024) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+	var attempts [4]atomic.Int32
+	e.s3.setFail(func(r *http.Request) int {
+		if r.Method != http.MethodPut || !r.URL.Query().Has("uploadId") {
+			return 0
+		}
+		number, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if attempts[number].Add(1) == 1 && number == 2 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+
+	resp := e.get(testImagePath)
+	if got := readAll(t, resp); !bytes.Equal(got, body) {
+		t.Fatalf("client read %d bytes, want %d", len(got), len(body))
+	}
+	o, ok := e.s3.object(resp.Header.Get("X-Cache-Key"))
+	if !ok {
+		t.Fatalf("nothing stored, bucket has %v", e.s3.keys(testBucket))
+	}
+	if !bytes.Equal(o.body, body) {
+		t.Errorf("stored %d bytes, want %d", len(o.body), len(body))
+	}
+	for number, want := range []int32{0, 1, 2, 1} {
+		if got := attempts[number].Load(); got != want {
+			t.Errorf("part %d sent %d times, want %d", number, got, want)
+		}
+	}
+	if got := e.s3.calls(http.MethodDelete); got != 0 {
+		t.Errorf("upload aborted %d times, want it resumed", got)
+	}
+}
+
+func TestReadParts(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		parts []int
+	}{
+		{name: "empty", size: 0, parts: []int{0}},
+		{name: "one partial part", size: 10, parts: []int{10}},
+		{name: "exact parts", size: 2 * uploadPartSize, parts: []int{uploadPartSize, uploadPartSize}},
+		{name: "trailing part", size: uploadPartSize + 1, parts: []int{uploadPartSize, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			free := make(chan []byte, 2)
+			free <- make([]byte, uploadPartSize)
+			free <- make([]byte, uploadPartSize)
+			filled := make(chan filledPart)
+			go readParts(t.Context(), bytes.NewReader(make([]byte, tt.size)), free, filled)
+
+			var sizes []int
+			for part := range filled {
+				if part.err != nil {
+					t.Fatal(part.err)
+				}
+				if int(part.number) != len(sizes)+1 {
+					t.Errorf("part %d numbered %d", len(sizes)+1, part.number)
+				}
+				sizes = append(sizes, len(part.data))
+				free <- part.data[:cap(part.data)]
+			}
+			if !slices.Equal(sizes, tt.parts) {
+				t.Errorf("parts = %v, want %v", sizes, tt.parts)
+			}
+		})
+	}
+}
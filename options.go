@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// optionPolicy restricts the processing options clients may request, so
+// expensive renders are refused before reaching imgproxy
+type optionPolicy struct {
+	allowed map[string]bool // nil allows every option
+	limits  map[string]float64
+}
+
+// parseOptionPolicy reads ALLOWED_OPTIONS, option names in any of their
+// spellings, and OPTION_LIMITS, name=max pairs capping the first argument
+// of an option. The width and height limits also cap the resize and size
+// dimensions.
+func parseOptionPolicy(allowed, limits []string) (optionPolicy, error) {
+	var p optionPolicy
+	if len(allowed) > 0 {
+		p.allowed = make(map[string]bool, len(allowed))
+		for _, name := range allowed {
+			p.allowed[canonicalOptionName(name)] = true
+		}
+	}
+	for _, limit := range limits {
+		name, value, ok := strings.Cut(limit, "=")
+		max, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || max < 0 {
+			return p, fmt.Errorf("invalid option limit %q, expected name=max", limit)
+		}
+		if p.limits == nil {
+			p.limits = make(map[string]float64)
+		}
+		p.limits[canonicalOptionName(name)] = max
+	}
+	return p, nil
+}
+
+func (p optionPolicy) enabled() bool {
+	return p.allowed != nil || p.limits != nil
+}
+
+// check reports the first option of an imgproxy path the policy refuses.
+// Paths that aren't processing URLs are left to imgproxy.
+func (p optionPolicy) check(path string) error {
+	parsed, ok := parseImgproxyPath(path)
+	if !ok {
+		return nil
+	}
+	for _, o := range parsed.Options {
+		name, args, _ := strings.Cut(o, ":")
+		name = canonicalOptionName(name)
+		if p.allowed != nil && !p.allowed[name] {
+			return fmt.Errorf("option %s is not allowed", name)
+		}
+		values := strings.Split(args, ":")
+		switch name {
+		case "resize":
+			// resize:type:width:height
+			if err := p.checkDimensions(values[min(1, len(values)):]); err != nil {
+				return err
+			}
+		case "size":
+			if err := p.checkDimensions(values); err != nil {
+				return err
+			}
+		default:
+			if err := p.checkLimit(name, values[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p optionPolicy) checkDimensions(values []string) error {
+	if len(values) > 0 {
+		if err := p.checkLimit("width", values[0]); err != nil {
+			return err
+		}
+	}
+	if len(values) > 1 {
+		return p.checkLimit("height", values[1])
+	}
+	return nil
+}
+
+// checkLimit leaves unparsable values to imgproxy, which rejects them itself
+func (p optionPolicy) checkLimit(name, value string) error {
+	max, ok := p.limits[name]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= max {
+		return nil
+	}
+	return fmt.Errorf("%s %s exceeds the maximum of %s", name, value, strconv.FormatFloat(max, 'f', -1, 64))
+}
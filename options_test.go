@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOptionPolicy(t *testing.T) {
+	const src = "/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn"
+	allowed := []string{"rs", "size", "quality", "w", "h", "format"}
+	limits := []string{"width=2000", "height=2000", "q=90"}
+	tests := []struct {
+		name    string
+		path    string
+		allowed []string
+		limits  []string
+		wantErr bool
+	}{
+		{name: "allowed", path: "/sig/rs:fit:800:600/q:80", allowed: allowed, limits: limits},
+		{name: "full names", path: "/sig/resize:fit:800:600/quality:80/format:webp", allowed: allowed, limits: limits},
+		{name: "disallowed option", path: "/sig/rs:fit:800:600/bl:10", allowed: allowed, limits: limits, wantErr: true},
+		{name: "resize width over", path: "/sig/rs:fit:4000:600", allowed: allowed, limits: limits, wantErr: true},
+		{name: "resize height over", path: "/sig/rs:fit:800:4000", allowed: allowed, limits: limits, wantErr: true},
+		{name: "size over", path: "/sig/s:800:4000", allowed: allowed, limits: limits, wantErr: true},
+		{name: "width option over", path: "/sig/w:2001", allowed: allowed, limits: limits, wantErr: true},
+		{name: "at the limit", path: "/sig/w:2000/q:90", allowed: allowed, limits: limits},
+		{name: "quality over", path: "/sig/q:95", allowed: allowed, limits: limits, wantErr: true},
+		{name: "unparsable left to imgproxy", path: "/sig/w:wide", allowed: allowed, limits: limits},
+		{name: "limits only", path: "/sig/bl:10/rs:fit:800:600", limits: limits},
+		{name: "allowlist only", path: "/sig/rs:fit:9000:9000", allowed: allowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseOptionPolicy(tt.allowed, tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.check(tt.path + src); (err != nil) != tt.wantErr {
+				t.Errorf("check(%q) = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOptionPolicyInvalid(t *testing.T) {
+	for _, limit := range []string{"width", "width=big", "width=-1"} {
+		if _, err := parseOptionPolicy(nil, []string{limit}); err == nil {
+			t.Errorf("%q was accepted", limit)
+		}
+	}
+}
+
+func TestOptionPolicyRejectsBeforeForwarding(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: testImagePath, status: http.StatusOK},
+		{path: "/insecure/rs:fit:5000:5000/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusBadRequest},
+		{path: "/insecure/rs:fit:100:100/bl:5/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ALLOWED_OPTIONS": "rs", "OPTION_LIMITS": "width=2000,height=2000"}, nil)
+			if resp := e.get(tt.path); resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if forwarded := len(e.img.renders()) == 1; forwarded != (tt.status == http.StatusOK) {
+				t.Errorf("forwarded = %v", forwarded)
+			}
+		})
+	}
+}
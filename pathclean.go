@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+var errPathTraversal = errors.New("path traversal")
+
+// cleanRequestPath collapses duplicate slashes and "." segments in the
+// routing portion of an escaped path (signature and options) and rejects
+// ".." there. The source is kept verbatim: a plain source URL legitimately
+// contains "//" and its own dot segments are the origin's business, other
+// sources can't contain any.
+// Non-processing paths are cleaned as a whole.
+func cleanRequestPath(escaped string) (string, error) {
+	var routing []string
+	segments := strings.Split(strings.TrimPrefix(escaped, "/"), "/")
+	for i, seg := range segments {
+		decoded, err := url.PathUnescape(seg)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case decoded == "..":
+			return "", errPathTraversal
+		case decoded == "" || decoded == ".":
+			continue
+		}
+		// The first segment after the signature that isn't an option starts the source
+		if len(routing) > 0 && (decoded == "plain" || !strings.Contains(decoded, ":")) {
+			// Base64 sources can't contain dot segments, only plain URLs can
+			if decoded != "plain" && slices.Contains(segments[i:], "..") {
+				return "", errPathTraversal
+			}
+			return "/" + strings.Join(append(routing, segments[i:]...), "/"), nil
+		}
+		routing = append(routing, seg)
+	}
+	return path.Clean("/" + strings.Join(routing, "/")), nil
+}
+
+// cleanURLPath replaces the path of u with its cleanRequestPath form
+func cleanURLPath(u *url.URL) error {
+	cleaned, err := cleanRequestPath(u.EscapedPath())
+	if err != nil || cleaned == u.EscapedPath() {
+		return err
+	}
+	if u.Path, err = url.PathUnescape(cleaned); err != nil {
+		return err
+	}
+	u.RawPath = cleaned
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCleanRequestPath(t *testing.T) {
+	const src = "aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn"
+	tests := []struct {
+		name, path, want string
+		traversal        bool
+	}{
+		{name: "clean", path: "/insecure/rs:fit:100:100/" + src, want: "/insecure/rs:fit:100:100/" + src},
+		{name: "duplicate slashes", path: "//insecure//rs:fit:100:100///" + src, want: "/insecure/rs:fit:100:100/" + src},
+		{name: "dot segments", path: "/./insecure/./rs:fit:100:100/" + src, want: "/insecure/rs:fit:100:100/" + src},
+		{name: "plain source kept verbatim", path: "/insecure//plain/https://example.com//a/./b.jpg", want: "/insecure/plain/https://example.com//a/./b.jpg"},
+		{name: "non-processing path", path: "//stats/", want: "/stats"},
+		{name: "traversal in options", path: "/insecure/../rs:fit:100:100/" + src, traversal: true},
+		{name: "escaped traversal", path: "/insecure/%2E%2E/" + src, traversal: true},
+		{name: "traversal after a base64 source", path: "/insecure/rs:fit:100:100/" + src + "/../x", traversal: true},
+		{name: "plain source dot segments", path: "/insecure/plain/https://example.com/../b.jpg", want: "/insecure/plain/https://example.com/../b.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanRequestPath(tt.path)
+			if tt.traversal {
+				if !errors.Is(err, errPathTraversal) {
+					t.Errorf("cleanRequestPath(%q) = %q, %v, want a traversal error", tt.path, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("cleanRequestPath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		clean     string
+		path      string
+		status    int
+		forwarded bool
+	}{
+		{name: "duplicate slashes", clean: "true", path: "/insecure//rs:fit:100:100//aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusOK, forwarded: true},
+		{name: "traversal", clean: "true", path: "/insecure/../rs:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusBadRequest},
+		{name: "api path", clean: "true", path: "/stats/.", status: http.StatusOK},
+		// The mux redirects to its own cleaned form
+		{name: "disabled", clean: "false", path: "/insecure//rs:fit:100:100//aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"CLEAN_PATHS": tt.clean}, nil)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path, req.URL.RawPath = tt.path, ""
+			resp := e.do(req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !tt.forwarded {
+				if n := len(e.img.renders()); n != 0 {
+					t.Errorf("imgproxy received %d requests, want none", n)
+				}
+				return
+			}
+			renders := e.img.renders()
+			if len(renders) != 1 || renders[0].URL.Path != testImagePath {
+				t.Fatalf("imgproxy received %v, want %s", renders, testImagePath)
+			}
+			// The cleaned path is cached under the key of the clean one
+			want := objectKey(*e.srv.config(), httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+			if keys := e.s3.keys(testBucket); len(keys) != 1 || keys[0] != want {
+				t.Errorf("bucket has %v, want %s", keys, want)
+			}
+		})
+	}
+}
+
+// TestCleanPathsAdminLookup looks up the paths CLEAN_PATHS cleans or rejects
+// through /admin/cache, which must find the object they are served from
+func TestCleanPathsAdminLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{name: "clean", path: testImagePath, status: http.StatusOK},
+		{name: "duplicate slashes", path: "/insecure//rs:fit:100:100//aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusOK},
+		{name: "traversal", path: "/insecure/../rs:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", status: http.StatusBadRequest},
+	}
+	e := newTestEnv(t, map[string]string{"CLEAN_PATHS": "true", "ADMIN_TOKEN": "secret"}, nil)
+	e.get(testImagePath)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := e.admin(http.MethodGet, "/admin/cache?path="+url.QueryEscape(tt.path))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var status cacheStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Path != testImagePath {
+				t.Errorf("path = %q, want %q", status.Path, testImagePath)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	errorPixelGIF = "gif"
+	errorPixelPNG = "png"
+
+	// errorPixelCacheControl keeps placeholders short lived, the error may
+	// well be gone on the next request
+	errorPixelCacheControl = "public, max-age=60"
+)
+
+// Transparent 1x1 images served in place of the ERROR_PIXEL_STATUSES errors
+var (
+	transparentGIF = []byte{
+		0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+	}
+	transparentPNG = []byte{
+		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4,
+		0x89, 0x00, 0x00, 0x00, 0x0b, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x63, 0x60, 0x00, 0x02, 0x00,
+		0x00, 0x05, 0x00, 0x01, 0xe9, 0xfa, 0xdc, 0xd8, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44,
+		0xae, 0x42, 0x60, 0x82,
+	}
+)
+
+// errorPixel returns the placeholder for an error status, nil when the
+// status isn't one of ERROR_PIXEL_STATUSES
+func errorPixel(cfg *Config, status int) ([]byte, string) {
+	if !slices.Contains(cfg.ErrorPixelStatuses, status) {
+		return nil, ""
+	}
+	if cfg.ErrorPixelFormat == errorPixelPNG {
+		return transparentPNG, "image/png"
+	}
+	return transparentGIF, "image/gif"
+}
+
+// servePixel replaces an imgproxy error response with the placeholder
+func servePixel(resp *http.Response, img []byte, contentType string) {
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Status = http.StatusText(http.StatusOK)
+	resp.Body = io.NopCloser(bytes.NewReader(img))
+	resp.ContentLength = int64(len(img))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("ETag")
+	setPixelHeaders(resp.Header, img, contentType)
+}
+
+func setPixelHeaders(h http.Header, img []byte, contentType string) {
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(img)))
+	h.Set("Cache-Control", errorPixelCacheControl)
+}
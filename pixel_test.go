@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	"net/http"
+	"testing"
+)
+
+func TestErrorPixel(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		status      int
+		contentType string
+	}{
+		{name: "gif by default", status: http.StatusNotFound, contentType: "image/gif"},
+		{name: "png", format: "png", status: http.StatusNotFound, contentType: "image/png"},
+		{name: "unlisted status", status: http.StatusUnprocessableEntity},
+		{name: "unreachable imgproxy", format: "png", status: http.StatusBadGateway, contentType: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"ERROR_PIXEL_STATUSES": "404,502"}
+			if tt.format != "" {
+				env["ERROR_PIXEL_FORMAT"] = tt.format
+			}
+			e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "not rendered", tt.status)
+			})
+			if tt.status == http.StatusBadGateway {
+				e.img.Close()
+			}
+			resp := e.get(testImagePath)
+			body := readAll(t, resp)
+			if tt.contentType == "" {
+				if resp.StatusCode != tt.status {
+					t.Errorf("status = %d, want imgproxy's %d", resp.StatusCode, tt.status)
+				}
+				return
+			}
+
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != tt.contentType {
+				t.Fatalf("status = %d, Content-Type = %q, want a %s pixel", resp.StatusCode, resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != errorPixelCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, errorPixelCacheControl)
+			}
+			size, _, err := image.DecodeConfig(bytes.NewReader(body))
+			if err != nil || size.Width != 1 || size.Height != 1 {
+				t.Errorf("pixel is %dx%d, err = %v", size.Width, size.Height, err)
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != 0 {
+				t.Errorf("the placeholder was cached: %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// presets maps imgproxy preset names to their option segments
+type presets map[string][]string
+
+// loadPresets reads presets the same way imgproxy does, from the comma
+// separated IMGPROXY_PRESETS and the one-per-line IMGPROXY_PRESETS_PATH file,
+// so both processes always agree on what a preset means
+func loadPresets() (presets, error) {
+	ps := presets{}
+	for _, def := range strings.Split(getenv("IMGPROXY_PRESETS"), ",") {
+		if err := ps.add(def); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := getenv("IMGPROXY_PRESETS_PATH"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open presets file: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); !strings.HasPrefix(line, "#") {
+				if err := ps.add(line); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read presets file: %w", err)
+		}
+	}
+	return ps, nil
+}
+
+// add parses a name=option/option preset definition
+func (ps presets) add(def string) error {
+	def = strings.TrimSpace(def)
+	if def == "" {
+		return nil
+	}
+	name, options, ok := strings.Cut(def, "=")
+	if !ok || name == "" || options == "" {
+		return fmt.Errorf("invalid preset %q, expected name=options", def)
+	}
+	ps[name] = strings.Split(options, "/")
+	return nil
+}
+
+// canonicalize expands preset references into the options they stand for and
+// spells every option with its full name, so a preset URL and the equivalent
+// expanded URL end up with identical options
+func (ps presets) canonicalize(options []string) []string {
+	out := make([]string, 0, len(options))
+	for _, o := range options {
+		name, args, _ := strings.Cut(o, ":")
+		name = canonicalOptionName(name)
+		if name != "preset" {
+			out = append(out, canonicalOption(name, args))
+			continue
+		}
+		for _, preset := range strings.Split(args, ":") {
+			expanded, ok := ps[preset]
+			if !ok {
+				out = append(out, canonicalOption(name, preset))
+				continue
+			}
+			for _, e := range expanded {
+				n, a, _ := strings.Cut(e, ":")
+				out = append(out, canonicalOption(canonicalOptionName(n), a))
+			}
+		}
+	}
+	return out
+}
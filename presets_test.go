@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalizePresetsKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "presets")
+	if err := os.WriteFile(file, []byte("# from imgproxy\nsquare=rs:fill:200:200\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const source = "/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn"
+	tests := []struct {
+		name      string
+		canonical string
+		a, b      string
+		same      bool
+	}{
+		{name: "preset and expanded", canonical: "true", a: "/sig/preset:thumbnail", b: "/sig/resize:fit:100:100/quality:80", same: true},
+		{name: "shorthand preset and aliases", canonical: "true", a: "/sig/pr:thumbnail", b: "/sig/rs:fit:100:100/q:80", same: true},
+		{name: "signature ignored", canonical: "true", a: "/sig1/pr:thumbnail", b: "/sig2/pr:thumbnail", same: true},
+		{name: "preset from file", canonical: "true", a: "/sig/pr:square", b: "/sig/resize:fill:200:200", same: true},
+		{name: "chained presets", canonical: "true", a: "/sig/pr:thumbnail:square", b: "/sig/pr:thumbnail/pr:square", same: true},
+		{name: "different options", canonical: "true", a: "/sig/pr:thumbnail", b: "/sig/rs:fit:100:100/q:90", same: false},
+		{name: "unknown preset", canonical: "true", a: "/sig/pr:unknown", b: "/sig/rs:fit:100:100/q:80", same: false},
+		{name: "disabled", canonical: "false", a: "/sig/preset:thumbnail", b: "/sig/resize:fit:100:100/quality:80", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{
+				"CANONICALIZE_PRESETS":  tt.canonical,
+				"IMGPROXY_PRESETS":      "thumbnail=rs:fit:100:100/q:80",
+				"IMGPROXY_PRESETS_PATH": file,
+			})
+			a := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.a+source, nil), contentTypePNG)
+			b := objectKey(cfg, httptest.NewRequest(http.MethodGet, tt.b+source, nil), contentTypePNG)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestLoadPresetsInvalid(t *testing.T) {
+	for _, def := range []string{"thumbnail", "=rs:fit:1:1", "thumbnail="} {
+		t.Run(def, func(t *testing.T) {
+			t.Setenv("IMGPROXY_PRESETS", def)
+			t.Setenv("IMGPROXY_PRESETS_PATH", "")
+			if _, err := loadPresets(); err == nil {
+				t.Errorf("loadPresets accepted %q", def)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// reloadableFields are the Config fields /admin/reload applies live. Every
+// other field is wired into long-lived state at startup and needs a restart.
+var reloadableFields = []string{
+	"PathRewrites",
+	"CanonicalizePath",
+	"KeyGenerator",
+	"KeyIncludeMethod",
+	"CanonicalizePresets",
+	"Presets",
+	"NormalizeSourceURL",
+	"CacheKeyLength",
+	"KeyQueryInclude",
+	"KeyQueryExclude",
+	"VaryHeaders",
+	"CORSAllowedOrigins",
+	"CORSAllowedMethods",
+	"CORSAllowedHeaders",
+	"CORSMaxAge",
+	"CacheControl",
+	"CacheRules",
+	"ExposeCacheKey",
+	"MaintenanceMode",
+	"S3ObjectACL",
+	"SinglePutMaxSize",
+}
+
+type reloadResult struct {
+	// Reloaded lists the live settings the reload changed
+	Reloaded []string `json:"reloaded"`
+	// Ignored lists the settings that changed but only apply after a restart
+	Ignored []string `json:"ignored"`
+}
+
+// reloadConfig returns cur with the reloadable fields taken from next
+func reloadConfig(cur, next Config) (Config, reloadResult) {
+	result := reloadResult{Reloaded: []string{}, Ignored: []string{}}
+	out := cur
+	outV, nextV, curV := reflect.ValueOf(&out).Elem(), reflect.ValueOf(next), reflect.ValueOf(cur)
+	for i := range curV.NumField() {
+		name := curV.Type().Field(i).Name
+		changed := !configValueEqual(curV.Field(i), nextV.Field(i))
+		switch {
+		case slices.Contains(reloadableFields, name):
+			outV.Field(i).Set(nextV.Field(i))
+			if changed {
+				result.Reloaded = append(result.Reloaded, name)
+			}
+		case changed:
+			result.Ignored = append(result.Ignored, name)
+		}
+	}
+	return out, result
+}
+
+// configValueEqual is reflect.DeepEqual, except that funcs are equal when
+// they are the same function: DeepEqual never finds two non-nil funcs
+// equal, which would report every KEY_GENERATOR or RESPONSE_TRANSFORM as
+// changed on each reload.
+func configValueEqual(a, b reflect.Value) bool {
+	if a.Kind() != b.Kind() || a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Kind() == reflect.Pointer && a.Pointer() == b.Pointer() {
+			return true
+		}
+		return configValueEqual(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !configValueEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Kind() == reflect.Slice && a.IsNil() != b.IsNil() {
+			return false
+		}
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !configValueEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			v := b.MapIndex(iter.Key())
+			if !v.IsValid() || !configValueEqual(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	default:
+		return false
+	}
+}
+
+// adminReloadHandler re-reads the configuration (CONFIG_FILE included) and
+// swaps in the settings that are safe to change live
+func (s *server) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	next, err := loadConfig()
+	if err != nil {
+		slog.Error("Failed to reload configuration", "error", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	cur := s.config()
+	// The detected version only changes with imgproxy, which a reload doesn't restart
+	if next.UpstreamVersionHeader != "" {
+		next.CacheVersion = cur.CacheVersion
+	}
+	cfg, result := reloadConfig(*cur, next)
+	s.cfg.Store(&cfg)
+	// The maintenance toggle may have been flipped through the admin
+	// endpoint since, only override it when the configuration changed
+	if cfg.MaintenanceMode != cur.MaintenanceMode {
+		s.maint.enabled.Store(cfg.MaintenanceMode)
+	}
+
+	slog.Info("Configuration reloaded", "reloaded", result.Reloaded, "ignored", result.Ignored)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// loadConfigFile exports the KEY=VALUE lines of CONFIG_FILE to the
+// environment, overriding it, so settings can be edited and reloaded without
+// a restart. Removing a line doesn't unset a previously loaded value.
+func loadConfigFile() error {
+	path := getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid config file line %q, expected NAME=value", line)
+		}
+		if err := os.Setenv(strings.TrimSpace(name), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	base := map[string]string{"RESPONSE_TRANSFORM": "strip-exif", "KEY_GENERATOR": "hash-path+query"}
+	tests := []struct {
+		name     string
+		changes  map[string]string
+		reloaded []string
+		ignored  []string
+	}{
+		{name: "unchanged"},
+		{name: "live setting", changes: map[string]string{"CORS_ALLOWED_ORIGINS": "https://example.com"}, reloaded: []string{"CORSAllowedOrigins"}},
+		{name: "restart setting", changes: map[string]string{"UPSTREAM_CONCURRENCY": "4"}, ignored: []string{"UpstreamConcurrency"}},
+		{name: "generator", changes: map[string]string{"KEY_GENERATOR": "hash-path"}, reloaded: []string{"KeyGenerator"}},
+		{name: "transform", changes: map[string]string{"RESPONSE_TRANSFORM": ""}, ignored: []string{"ResponseTransform"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := testConfig(t, base)
+			next := testConfig(t, mergeEnv(base, tt.changes))
+			cfg, result := reloadConfig(cur, next)
+			if !slices.Equal(result.Reloaded, append([]string{}, tt.reloaded...)) {
+				t.Errorf("reloaded = %v, want %v", result.Reloaded, tt.reloaded)
+			}
+			if !slices.Equal(result.Ignored, append([]string{}, tt.ignored...)) {
+				t.Errorf("ignored = %v, want %v", result.Ignored, tt.ignored)
+			}
+			if cfg.UpstreamConcurrency != cur.UpstreamConcurrency {
+				t.Error("a restart setting was applied")
+			}
+			if !slices.Equal(cfg.CORSAllowedOrigins, next.CORSAllowedOrigins) {
+				t.Error("a live setting wasn't applied")
+			}
+		})
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.env")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The file is exported to the environment, restored after the test
+	e := newTestEnv(t, map[string]string{
+		"ADMIN_TOKEN":        "secret",
+		"CONFIG_FILE":        file,
+		"EXPOSE_CACHE_KEY":   "",
+		"MAX_CONNECTIONS":    "",
+		"UPLOAD_SAMPLE_RATE": "",
+	}, nil)
+	if err := os.WriteFile(file, []byte("# live\nEXPOSE_CACHE_KEY=true\nMAX_CONNECTIONS=10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := e.admin(http.MethodGet, "/admin/reload"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want 405", resp.StatusCode)
+	}
+	resp := e.admin(http.MethodPost, "/admin/reload")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var result reloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Reloaded, []string{"ExposeCacheKey"}) || !slices.Equal(result.Ignored, []string{"MaxConnections"}) {
+		t.Errorf("result = %+v", result)
+	}
+	if got := e.get(testImagePath).Header.Get("X-Cache-Key"); got == "" {
+		t.Error("EXPOSE_CACHE_KEY wasn't applied live")
+	}
+
+	os.WriteFile(file, []byte("UPLOAD_SAMPLE_RATE=2\n"), 0o600)
+	if resp := e.admin(http.MethodPost, "/admin/reload"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid file: status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRetryAfter tells clients of a 429 or 503 when to come back, in whole
+// seconds rounded up. Other statuses and a zero delay leave h alone.
+func setRetryAfter(h http.Header, status int, d time.Duration) {
+	if d <= 0 || (status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable) {
+		return
+	}
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
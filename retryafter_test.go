@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetRetryAfter(t *testing.T) {
+	tests := []struct {
+		status int
+		delay  time.Duration
+		want   string
+	}{
+		{status: http.StatusServiceUnavailable, delay: 5 * time.Minute, want: "300"},
+		{status: http.StatusTooManyRequests, delay: 1500 * time.Millisecond, want: "2"},
+		{status: http.StatusTooManyRequests, delay: time.Millisecond, want: "1"},
+		{status: http.StatusServiceUnavailable, delay: 0, want: ""},
+		{status: http.StatusBadGateway, delay: time.Minute, want: ""},
+		{status: http.StatusOK, delay: time.Minute, want: ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		setRetryAfter(h, tt.status, tt.delay)
+		if got := h.Get("Retry-After"); got != tt.want {
+			t.Errorf("setRetryAfter(%d, %v): Retry-After = %q, want %q", tt.status, tt.delay, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "default", want: "300"},
+		{name: "configured", env: map[string]string{"MAINTENANCE_RETRY_AFTER": "90s"}, want: "90"},
+		{name: "disabled", env: map[string]string{"MAINTENANCE_RETRY_AFTER": "0s"}, want: ""},
+		{name: "not a throttling status", env: map[string]string{"MAINTENANCE_STATUS": "404"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{"MAINTENANCE_MODE": "true"}, tt.env), nil)
+			resp := e.get(testImagePath)
+			if got := resp.Header.Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
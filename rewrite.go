@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type pathRewrite struct {
+	from, to string
+}
+
+// pathRewrites maps public path prefixes to the prefixes imgproxy expects.
+// The first matching rule wins.
+type pathRewrites []pathRewrite
+
+// parsePathRewrites parses a comma separated list of from=to prefix pairs
+// such as "/cdn/=/,/img/=/"
+func parsePathRewrites(s string) (pathRewrites, error) {
+	var rewrites pathRewrites
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected /from=/to", rule)
+		}
+		rewrites = append(rewrites, pathRewrite{from: from, to: to})
+	}
+	return rewrites, nil
+}
+
+// rewrite returns the canonical (imgproxy side) form of a public path
+func (rw pathRewrites) rewrite(path string) string {
+	for _, r := range rw {
+		if rest, ok := strings.CutPrefix(path, r.from); ok {
+			return r.to + rest
+		}
+	}
+	return path
+}
+
+// apply rewrites u in place, keeping the escaped form of the path in sync so
+// encoded source URLs reach imgproxy untouched
+func (rw pathRewrites) apply(u *url.URL) {
+	for _, r := range rw {
+		rest, ok := strings.CutPrefix(u.Path, r.from)
+		if !ok {
+			continue
+		}
+		u.Path = r.to + rest
+		if rawRest, ok := strings.CutPrefix(u.RawPath, r.from); ok {
+			u.RawPath = r.to + rawRest
+		} else {
+			u.RawPath = ""
+		}
+		return
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParsePathRewrites(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "/cdn/=/", want: 1},
+		{in: " /cdn/=/ , /img/=/v1/ ,", want: 2},
+		{in: "cdn=/", wantErr: true},
+		{in: "/cdn/", wantErr: true},
+		{in: "/cdn/=img", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rw, err := parsePathRewrites(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(rw) != tt.want {
+				t.Errorf("got %d rules, want %d", len(rw), tt.want)
+			}
+		})
+	}
+}
+
+func TestPathRewritesRewrite(t *testing.T) {
+	rw, err := parsePathRewrites("/cdn/=/,/cdn2/=/v2/,/=/all/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ path, want string }{
+		{path: "/cdn/insecure/x", want: "/insecure/x"},
+		{path: "/cdn2/insecure/x", want: "/v2/insecure/x"},
+		// The first matching rule wins
+		{path: "/other", want: "/all/other"},
+	}
+	for _, tt := range tests {
+		if got := rw.rewrite(tt.path); got != tt.want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathRewriteKeysOnUpstreamPath(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"UPSTREAM_PATH_REWRITES": "/cdn/=/"}, nil)
+	// An escaped slash in the source must reach imgproxy as sent
+	const public = "/cdn/insecure/rs:fit:100:100/plain/local:%2F%2Fcat.png"
+	resp := e.get(public)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	renders := e.img.renders()
+	if len(renders) != 1 {
+		t.Fatalf("imgproxy received %d requests, want 1", len(renders))
+	}
+	if got, want := renders[0].URL.EscapedPath(), "/insecure/rs:fit:100:100/plain/local:%2F%2Fcat.png"; got != want {
+		t.Errorf("imgproxy received %q, want %q", got, want)
+	}
+
+	// The direct path renders the same image, it must not be cached twice
+	if resp := e.get("/insecure/rs:fit:100:100/plain/local:%2F%2Fcat.png"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("direct path: status = %d, want 200", resp.StatusCode)
+	}
+	keys := e.s3.keys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("bucket has %v, want a single key", keys)
+	}
+	u, _ := url.Parse(public)
+	lookup, err := lookupRequest(e.srv.config(), u, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objectKey(*e.srv.config(), lookup, contentTypePNG); got != keys[0] {
+		t.Errorf("lookup of the public path = %q, want %q", got, keys[0])
+	}
+}
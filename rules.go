@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// cacheRule is one entry of CACHE_RULES_FILE, a JSON array evaluated in
+// order against the path sent to imgproxy. The first matching rule applies,
+// unset fields fall back to the global settings.
+type cacheRule struct {
+	Path         string   `json:"path"`
+	Cache        *bool    `json:"cache"`
+	TTL          string   `json:"ttl"`
+	MaxSize      int64    `json:"max_size"`
+	ContentTypes []string `json:"content_types"`
+
+	pattern *regexp.Regexp
+	ttl     time.Duration
+	types   map[contentType]bool
+}
+
+// loadCacheRules reads and validates a rules file, none when path is empty
+func loadCacheRules(path string) ([]cacheRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CACHE_RULES_FILE: %w", err)
+	}
+	var rules []cacheRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid CACHE_RULES_FILE: %w", err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.Path == "" {
+			return nil, fmt.Errorf("cache rule %d has no path", i)
+		}
+		r.pattern = globPattern(r.Path)
+		if r.TTL != "" {
+			if r.ttl, err = time.ParseDuration(r.TTL); err != nil || r.ttl <= 0 {
+				return nil, fmt.Errorf("cache rule %d has an invalid ttl %q", i, r.TTL)
+			}
+		}
+		if r.MaxSize < 0 {
+			return nil, fmt.Errorf("cache rule %d has a negative max_size", i)
+		}
+		if len(r.ContentTypes) > 0 {
+			r.types = make(map[contentType]bool, len(r.ContentTypes))
+			for _, name := range r.ContentTypes {
+				t := contentTypeByName(name)
+				if t < 0 {
+					return nil, fmt.Errorf("cache rule %d has an unknown content type %q", i, name)
+				}
+				r.types[t] = true
+			}
+		}
+	}
+	return rules, nil
+}
+
+// globPattern compiles a glob where * matches any run of characters, slashes
+// included, and ? a single one
+func globPattern(glob string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(glob)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// matchCacheRule returns the first rule matching path, nil when none does
+func matchCacheRule(rules []cacheRule, path string) *cacheRule {
+	for i := range rules {
+		if rules[i].pattern.MatchString(path) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// cacheControl returns the Cache-Control rules to apply under r: its ttl
+// replaces every CACHE_CONTROL_MAX_AGES entry
+func (r *cacheRule) cacheControl(global cacheControlRules) cacheControlRules {
+	if r == nil || r.ttl == 0 {
+		return global
+	}
+	global.maxAge, global.fallback = nil, r.ttl
+	return global
+}
+
+// allowsUpload reports whether a response of type t and length size (-1
+// when unknown) may be cached under r. With max_size, bodies of unknown
+// length aren't cached.
+func (r *cacheRule) allowsUpload(t contentType, size int64) bool {
+	if r == nil {
+		return true
+	}
+	if r.Cache != nil && !*r.Cache {
+		return false
+	}
+	if r.types != nil && !r.types[t] {
+		return false
+	}
+	return r.MaxSize == 0 || (size >= 0 && size <= r.MaxSize)
+}
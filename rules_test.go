@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeRules writes a CACHE_RULES_FILE and returns its path
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadCacheRulesInvalid(t *testing.T) {
+	tests := []struct{ name, rules string }{
+		{name: "not JSON", rules: `{"path": "/*"`},
+		{name: "no path", rules: `[{"cache": false}]`},
+		{name: "invalid ttl", rules: `[{"path": "/*", "ttl": "soon"}]`},
+		{name: "negative ttl", rules: `[{"path": "/*", "ttl": "-1h"}]`},
+		{name: "negative max_size", rules: `[{"path": "/*", "max_size": -1}]`},
+		{name: "unknown content type", rules: `[{"path": "/*", "content_types": ["tiff"]}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadCacheRules(writeRules(t, tt.rules)); err == nil {
+				t.Errorf("%s was accepted", tt.rules)
+			}
+		})
+	}
+}
+
+func TestMatchCacheRule(t *testing.T) {
+	rules, err := loadCacheRules(writeRules(t, `[
+		{"path": "/insecure/rs:fit:?:?/*", "ttl": "1m"},
+		{"path": "/insecure/*.png", "ttl": "2m"},
+		{"path": "/insecure/*", "ttl": "3m"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/insecure/rs:fit:1:1/YWJj", want: "1m"},
+		// ? is a single character
+		{path: "/insecure/rs:fit:10:10/YWJj.png", want: "2m"},
+		// * spans slashes, the first match wins
+		{path: "/insecure/a/b/c.png", want: "2m"},
+		{path: "/insecure/YWJj", want: "3m"},
+		{path: "/other/YWJj", want: ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if r := matchCacheRule(rules, tt.path); r != nil {
+			got = r.TTL
+		}
+		if got != tt.want {
+			t.Errorf("matchCacheRule(%q) = rule %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCacheRulesApplied(t *testing.T) {
+	file := writeRules(t, `[
+		{"path": "/insecure/nocache/*", "cache": false},
+		{"path": "/insecure/short/*", "ttl": "60s"},
+		{"path": "/insecure/small/*", "max_size": 10},
+		{"path": "/insecure/webp/*", "content_types": ["webp"]}
+	]`)
+	tests := []struct {
+		name         string
+		path         string
+		cacheControl string
+		uploaded     bool
+	}{
+		{name: "no rule", path: "/insecure/other/YWJj", cacheControl: "public, max-age=3600", uploaded: true},
+		{name: "not cached", path: "/insecure/nocache/YWJj", cacheControl: "public, max-age=3600"},
+		{name: "ttl", path: "/insecure/short/YWJj", cacheControl: "public, max-age=60", uploaded: true},
+		{name: "too large", path: "/insecure/small/YWJj", cacheControl: "public, max-age=3600"},
+		{name: "other content type", path: "/insecure/webp/YWJj", cacheControl: "public, max-age=3600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"CACHE_RULES_FILE": file, "CACHE_CONTROL_MAX_AGES": "default=1h"}, nil)
+			resp := e.get(tt.path)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cacheControl)
+			}
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+			skipped := int64(0)
+			if !tt.uploaded {
+				skipped = 1
+			}
+			if got := e.srv.stats.uploadsSkippedRule.Load(); got != skipped {
+				t.Errorf("uploads_skipped_rule = %d, want %d", got, skipped)
+			}
+		})
+	}
+}
+
+func TestCacheRulesReloaded(t *testing.T) {
+	rules := writeRules(t, `[{"path": "/insecure/*", "cache": false}]`)
+	env := filepath.Join(t.TempDir(), "config.env")
+	if err := os.WriteFile(env, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "CONFIG_FILE": env, "CACHE_RULES_FILE": rules}, nil)
+	for i, cached := range []bool{false, true} {
+		if cached {
+			if err := os.WriteFile(rules, []byte(`[{"path": "/insecure/*", "cache": true}]`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if resp := e.admin(http.MethodPost, "/admin/reload"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("reload: status = %d", resp.StatusCode)
+			}
+		}
+		before := len(e.s3.keys(testBucket))
+		e.get(renderPath("local:///" + strconv.Itoa(i)))
+		if got := len(e.s3.keys(testBucket)) > before; got != cached {
+			t.Errorf("request %d: cached = %v, want %v", i, got, cached)
+		}
+	}
+}
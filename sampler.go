@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// maxSeenEntries bounds the frequency counter. When reached the counter is
+// reset, which only delays caching of the long tail a little more.
+const maxSeenEntries = 100000
+
+// uploadSampler decides which misses are worth caching, so storage isn't
+// spent on one-hit long-tail transforms
+type uploadSampler struct {
+	rate    float64
+	minSeen int
+
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func newUploadSampler(rate float64, minSeen int) *uploadSampler {
+	return &uploadSampler{rate: rate, minSeen: minSeen, seen: make(map[string]int)}
+}
+
+// shouldUpload reports whether the response for key should be uploaded: the
+// key must have been requested at least minSeen times and then pass the
+// random sampling
+func (s *uploadSampler) shouldUpload(key string) bool {
+	if s.minSeen > 1 {
+		s.mu.Lock()
+		if len(s.seen) >= maxSeenEntries {
+			clear(s.seen)
+		}
+		s.seen[key]++
+		if s.seen[key] < s.minSeen {
+			s.mu.Unlock()
+			return false
+		}
+		// It's about to be cached, no need to keep counting
+		delete(s.seen, key)
+		s.mu.Unlock()
+	}
+	return s.rate >= 1 || rand.Float64() < s.rate
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestUploadSampler(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		minSeen int
+		want    []bool
+	}{
+		{name: "everything", rate: 1, minSeen: 1, want: []bool{true, true, true}},
+		{name: "nothing", rate: 0, minSeen: 1, want: []bool{false, false, false}},
+		// Counting starts over once the key was let through
+		{name: "min seen", rate: 1, minSeen: 3, want: []bool{false, false, true, false, false, true}},
+		{name: "min seen, never sampled", rate: 0, minSeen: 2, want: []bool{false, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUploadSampler(tt.rate, tt.minSeen)
+			var got []bool
+			for range tt.want {
+				got = append(got, s.shouldUpload("key"))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("shouldUpload = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadSampleRate(t *testing.T) {
+	s := newUploadSampler(0.5, 1)
+	const n = 2000
+	uploaded := 0
+	for i := range n {
+		if s.shouldUpload(strconv.Itoa(i)) {
+			uploaded++
+		}
+	}
+	if uploaded < n*4/10 || uploaded > n*6/10 {
+		t.Errorf("%d of %d sampled, want about half", uploaded, n)
+	}
+}
+
+func TestUploadMinSeen(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"UPLOAD_MIN_SEEN": "3"}, nil)
+	for i, cached := range []bool{false, false, true} {
+		e.get(testImagePath)
+		if got := len(e.s3.keys(testBucket)) == 1; got != cached {
+			t.Errorf("request %d: cached = %v, want %v", i+1, got, cached)
+		}
+	}
+	if skipped, sampled := e.srv.stats.uploadsSkipped.Load(), e.srv.stats.uploadsSampled.Load(); skipped != 2 || sampled != 1 {
+		t.Errorf("uploads_skipped = %d, uploads_sampled = %d, want 2 and 1", skipped, sampled)
+	}
+}
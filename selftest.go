@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// selftestUploadTimeout bounds the wait for the rendered image to land in the bucket
+const selftestUploadTimeout = 30 * time.Second
+
+// runSelftest renders SELFTEST_PATH through a private instance of the
+// server, then checks the image was uploaded and reads back identical. It
+// never touches the public listener.
+func runSelftest(ctx context.Context, srv *server) error {
+	cfg := srv.config()
+	if cfg.SelftestPath == "" {
+		return fmt.Errorf("SELFTEST_PATH is required for the self-test")
+	}
+	if !cfg.CacheEnabled {
+		return fmt.Errorf("the self-test needs CACHE_ENABLED")
+	}
+	u, err := url.Parse(cfg.SelftestPath)
+	if err != nil {
+		return fmt.Errorf("invalid SELFTEST_PATH: %w", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer l.Close()
+	go http.Serve(l, srv)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+l.Addr().String()+u.RequestURI(), nil)
+	if err != nil {
+		return fmt.Errorf("invalid SELFTEST_PATH: %w", err)
+	}
+	// Set explicitly so the transport neither adds Accept-Encoding nor
+	// decompresses the render, and so the key is looked up with what was
+	// sent when VARY_HEADERS is set
+	req.Header = http.Header{
+		"User-Agent":      {"imgproxy2tigris-selftest"},
+		"Accept-Encoding": {"identity"},
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("render request failed: %w", err)
+	}
+	rendered, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read rendered image: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("render returned %d", resp.StatusCode)
+	}
+	if ct, ok := sniffImage(bufio.NewReader(bytes.NewReader(rendered))); !ok {
+		return fmt.Errorf("render returned %s, not an image", ct)
+	}
+	if resp.Header.Get("X-Cache") != cacheMiss {
+		return fmt.Errorf("render wasn't uploaded (X-Cache %s), check the sampling and debounce settings", resp.Header.Get("X-Cache"))
+	}
+	slog.Info("Self-test render ok", "path", u.Path, "size", len(rendered))
+
+	lookup, err := lookupRequest(cfg, u, req.Header)
+	if err != nil {
+		return fmt.Errorf("invalid SELFTEST_PATH: %w", err)
+	}
+	key := objectKey(*cfg, lookup, normalizeContentType(resp.Header.Get("Content-Type")))
+	if err := waitForObject(ctx, srv.s3, cfg.S3Bucket, key); err != nil {
+		return err
+	}
+	slog.Info("Self-test upload ok", "key", key)
+
+	out, err := srv.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(cfg.S3Bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", key, err)
+	}
+	stored, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", key, err)
+	}
+	if !bytes.Equal(stored, rendered) {
+		return fmt.Errorf("stored object differs from the render (%d bytes, rendered %d)", len(stored), len(rendered))
+	}
+	slog.Info("Self-test read back ok", "key", key)
+	return nil
+}
+
+// waitForObject polls HeadObject until key exists, the upload being asynchronous
+func waitForObject(ctx context.Context, client *s3.Client, bucket, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, selftestUploadTimeout)
+	defer cancel()
+	for {
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err == nil {
+			return nil
+		}
+		if !isNotFound(err) {
+			return fmt.Errorf("HeadObject %s failed: %w", key, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("object %s not uploaded after %v", key, selftestUploadTimeout)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
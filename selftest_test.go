@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{name: "ok"},
+		{name: "vary headers", env: map[string]string{"VARY_HEADERS": "User-Agent,Accept-Encoding"}},
+		{
+			name:    "not an image",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			wantErr: "not an image",
+		},
+		{name: "not uploaded", env: map[string]string{"UPLOAD_SAMPLE_RATE": "0"}, wantErr: "wasn't uploaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{"SELFTEST_PATH": testImagePath}, tt.env), tt.handler)
+			err := runSelftest(t.Context(), e.srv)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("runSelftest: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("runSelftest error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// server proxies requests to imgproxy, uploading the rendered images to the
+// bucket as they're streamed to the client, and serves the operational and
+// admin endpoints. Everything it depends on is injected so the whole flow can
+// run against a fake imgproxy and a fake S3 endpoint.
+type server struct {
+	// cfg is swapped as a whole by /admin/reload, read it through config()
+	cfg      atomic.Pointer[Config]
+	s3       *s3.Client
+	uploader *manager.Uploader
+	mirror   *mirror // nil without MIRROR_S3_BUCKET
+	proxy    *httputil.ReverseProxy
+	mux      *http.ServeMux
+	apiPaths map[string]bool
+	handler  http.Handler
+
+	health         *upstreamHealth
+	bucketHealth   *bucketHealth
+	limiter        Limiter
+	maint          *maintenance
+	sampler        *uploadSampler
+	debouncer      *uploadDebouncer
+	missingSources *negativeCache
+	fallbackImage  []byte
+	buffers        *bufferBudget
+	stats          *counters
+	events         *cacheEventNotifier
+	keyLocks       Coordinator
+	upstreamStats  *upstreamHeaderStats
+	sourceFallback *sourceFallback
+	healthz        *healthzChecker
+
+	// hostname identifies this instance in the provenance metadata
+	hostname string
+	// draining makes /readyz fail while shutting down
+	draining atomic.Bool
+	// uploads tracks the upload goroutines so shutdown can wait for them
+	uploads sync.WaitGroup
+}
+
+const uploadPartSize = 5 * 1024 * 1024
+
+func newServer(cfg Config, s3Client, mirrorClient *s3.Client, target *url.URL, upstream http.RoundTripper) (*server, error) {
+	s := &server{
+		s3:             s3Client,
+		health:         newUpstreamHealth(),
+		bucketHealth:   newBucketHealth(),
+		maint:          newMaintenance(cfg),
+		sampler:        newUploadSampler(cfg.UploadSampleRate, cfg.UploadMinSeen),
+		debouncer:      newUploadDebouncer(cfg.UploadDebounce),
+		missingSources: newNegativeCache(cfg.NegativeCacheTTL),
+		buffers:        newBufferBudget(cfg.MaxTotalBufferBytes),
+		stats:          &counters{},
+		events:         newCacheEventNotifier(cfg),
+		upstreamStats:  newUpstreamHeaderStats(cfg.UpstreamMetricHeaders),
+		sourceFallback: newSourceFallback(cfg),
+	}
+	s.cfg.Store(&cfg)
+	s.hostname, _ = os.Hostname()
+	s.healthz = newHealthzChecker(cfg, target.String(), upstream, s3Client)
+	if mirrorClient != nil {
+		s.mirror = newMirror(cfg, mirrorClient)
+	}
+
+	var err error
+	if s.limiter, err = limiterBackends[cfg.LimiterBackend](cfg); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s limiter: %w", cfg.LimiterBackend, err)
+	}
+	if s.keyLocks, err = coordinatorBackends[cfg.CoordinatorBackend](cfg); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s coordinator: %w", cfg.CoordinatorBackend, err)
+	}
+
+	if cfg.MissingSourceBehavior == missingSourceFallback {
+		img, err := os.ReadFile(cfg.FallbackImagePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fallback image: %w", err)
+		}
+		s.fallbackImage = img
+	}
+
+	// Initialize S3 uploader
+	if cfg.CacheEnabled {
+		s.uploader = manager.NewUploader(s3Client, func(u *manager.Uploader) {
+			u.PartSize = uploadPartSize
+			u.BufferProvider = manager.NewBufferedReadSeekerWriteToPool(10 * 1024 * 1024)
+		})
+	}
+
+	s.proxy = httputil.NewSingleHostReverseProxy(target)
+	director := s.proxy.Director
+	s.proxy.Director = func(req *http.Request) {
+		director(req)
+		cfg := s.config()
+		cfg.PathRewrites.apply(req.URL)
+		cfg.CanonicalizePath.apply(req.URL)
+	}
+	s.proxy.Transport = upstream
+	if len(cfg.UpstreamQueryAllowed) > 0 {
+		s.proxy.Transport = &queryFilterTransport{next: upstream, allowed: cfg.UpstreamQueryAllowed}
+	}
+	if cfg.FollowUpstreamRedirects {
+		s.proxy.Transport = &redirectTransport{next: s.proxy.Transport, maxRedirects: cfg.UpstreamMaxRedirects}
+	}
+	// Flush every write so the client receives bytes as soon as imgproxy sends them
+	s.proxy.FlushInterval = -1
+	s.proxy.BufferPool = newBufferPool(cfg.CopyBufferSize)
+	s.proxy.ModifyResponse = s.modifyResponse
+	s.proxy.ErrorHandler = s.proxyError
+
+	s.mux = http.NewServeMux()
+	s.apiPaths = make(map[string]bool)
+	handle := func(pattern string, h http.HandlerFunc) {
+		s.mux.HandleFunc(pattern, h)
+		s.apiPaths[pattern] = true
+	}
+	handle("/readyz", readyzHandler(s.health, s.bucketHealth, s.maint, &s.draining))
+	handle("/healthz", s.healthzHandler)
+	// The JSON endpoints are compressed for clients accepting gzip
+	api := func(pattern string, h http.HandlerFunc) {
+		handle(pattern, gzipHandler(h))
+	}
+	api("/stats", statsHandler(s.health, s.limiter, s.maint, s.buffers, s.stats, s.upstreamStats, false))
+
+	if cfg.AdminToken != "" {
+		admin := func(pattern string, h http.HandlerFunc) {
+			api(pattern, s.audit(cfg, requireAdminIP(cfg, requireAdminToken(cfg, h))))
+		}
+		if cfg.CacheEnabled {
+			admin("/admin/cache", adminCacheHandler(s.config, s3Client, s.mirror))
+			admin("/admin/list", adminListHandler(s.config, s3Client))
+		} else {
+			disabled := func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "caching is disabled"})
+			}
+			admin("/admin/cache", disabled)
+			admin("/admin/list", disabled)
+		}
+		admin("/admin/maintenance", adminMaintenanceHandler(s.maint))
+		admin("/admin/reload", s.adminReloadHandler)
+		admin("/admin/stats/reset", statsHandler(s.health, s.limiter, s.maint, s.buffers, s.stats, s.upstreamStats, true))
+	}
+
+	s.mux.HandleFunc("/", s.serveImage)
+	s.handler = newAccessLogger(cfg.AccessLogFormat, os.Stdout).wrap(http.HandlerFunc(s.route))
+	return s, nil
+}
+
+func (s *server) config() *Config {
+	return s.cfg.Load()
+}
+
+// route sends requests to the mux. With CLEAN_PATHS, paths are cleaned here
+// instead: the mux would redirect image paths to a cleaned form that mangles
+// plain source URLs.
+func (s *server) route(w http.ResponseWriter, r *http.Request) {
+	if !s.config().CleanPaths || s.apiPaths[r.URL.Path] {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	if err := cleanURLPath(r.URL); err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if s.apiPaths[r.URL.Path] {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+	s.serveImage(w, r)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *server) serveImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		servePreflight(s.config(), w, r)
+		return
+	}
+	if methods := s.config().AllowedMethods; !slices.Contains(methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if limit := s.config().MaxUploadBodySize; limit > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limit {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Bodies of unknown length fail while being forwarded, see proxyError
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	if policy := s.config().OptionPolicy; policy.enabled() {
+		if err := policy.check(s.upstreamPath(r.URL)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.maint.Enabled() {
+		s.maint.serve(w)
+		return
+	}
+
+	if s.config().MissingSourceBehavior == missingSourceNegativeCache && s.missingSources.Contains(s.upstreamPath(r.URL)) {
+		w.Header().Set("X-Cache", cacheNegative)
+		http.Error(w, "Source image not found", http.StatusNotFound)
+		return
+	}
+
+	acquired, err := s.limiter.Acquire(r.Context())
+	switch {
+	case err != nil && s.config().RateLimitFailOpen:
+		slog.Warn("Limiter failed, serving the request anyway", "path", r.URL.Path, "error", err)
+	case err != nil:
+		slog.Error("Limiter failed", "path", r.URL.Path, "error", err)
+		setRetryAfter(w.Header(), http.StatusTooManyRequests, s.config().SaturatedRetryAfter)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	case !acquired:
+		setRetryAfter(w.Header(), http.StatusServiceUnavailable, s.config().SaturatedRetryAfter)
+		http.Error(w, "Too many concurrent renders", http.StatusServiceUnavailable)
+		return
+	default:
+		defer s.limiter.Release()
+	}
+	if grace := s.config().SlowRenderGrace; grace > 0 {
+		g := newGraceWriter(w, grace)
+		defer g.stop()
+		w = g
+	}
+	s.proxy.ServeHTTP(w, r)
+}
+
+// proxyError answers requests imgproxy couldn't render, with the source
+// image itself when FALLBACK_TO_SOURCE allows it
+func (s *server) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	slog.Error("Proxy error", "path", r.URL.Path, "error", err)
+	cfg := s.config()
+	if cfg.FallbackToSource && s.sourceFallback.serve(r.Context(), w, r, s.upstreamPath(r.URL)) {
+		return
+	}
+	if img, contentType := errorPixel(cfg, http.StatusBadGateway); img != nil {
+		setPixelHeaders(w.Header(), img, contentType)
+		w.Write(img)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// upstreamPath is the path imgproxy receives for u
+func (s *server) upstreamPath(u *url.URL) string {
+	cfg := s.config()
+	u2 := *u
+	cfg.PathRewrites.apply(&u2)
+	cfg.CanonicalizePath.apply(&u2)
+	return u2.Path
+}
+
+func (s *server) modifyResponse(resp *http.Response) error {
+	cfg := s.config()
+	s.upstreamStats.record(resp.Header, cfg.StripUpstreamMetricHeaders)
+	// Overridden below once the response is known to be uploaded
+	resp.Header.Set("X-Cache", cacheBypass)
+	// Variants are cached separately, caches in front must tell them apart too
+	for _, h := range cfg.VaryHeaders {
+		resp.Header.Add("Vary", h)
+	}
+
+	// Placeholders are never uploaded, the error may be transient
+	if img, contentType := errorPixel(cfg, resp.StatusCode); img != nil {
+		servePixel(resp, img, contentType)
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		switch cfg.MissingSourceBehavior {
+		case missingSourceFallback:
+			serveFallbackImage(resp, s.fallbackImage)
+			return nil
+		case missingSourceNegativeCache:
+			s.missingSources.Add(resp.Request.URL.Path)
+		}
+	}
+
+	if cfg.FallbackToSource && resp.StatusCode >= http.StatusInternalServerError {
+		// Handled by proxyError
+		return errUpstreamFailed
+	}
+	if resp.StatusCode >= http.StatusBadRequest && !cfg.UpstreamErrorPassthrough {
+		sanitizeErrorResponse(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	// Deferred so it wraps the upload tee, whatever is decided about caching
+	if cfg.ResponseTransform != nil {
+		defer applyResponseTransform(cfg.ResponseTransform, resp)
+	}
+	ct := normalizeContentType(resp.Header.Get("Content-Type"))
+	byType := &s.stats.byContentType[ct]
+	byType.renders.Add(1)
+	// Checked before CACHE_CONTROL_MAX_AGES may overwrite imgproxy's directive
+	noCache := upstreamForbidsCaching(cfg.NoCacheHeaders, resp.Header)
+	rule := matchCacheRule(cfg.CacheRules, resp.Request.URL.Path)
+	rule.cacheControl(cfg.CacheControl).apply(resp.Header)
+	// A HEAD response has no body, caching it under the GET key would
+	// replace the image with an empty object
+	head := resp.Request.Method == http.MethodHead
+	if head && !cfg.KeyIncludeMethod {
+		return nil
+	}
+	if !cfg.CacheEnabled {
+		return nil
+	}
+	if noCache {
+		s.stats.uploadsNoCache.Add(1)
+		return nil
+	}
+	if !rule.allowsUpload(ct, resp.ContentLength) {
+		s.stats.uploadsSkippedRule.Add(1)
+		return nil
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < cfg.MinCacheObjectSize {
+		s.stats.uploadsTooSmall.Add(1)
+		return nil
+	}
+	if resp.ContentLength > cfg.MaxObjectSize {
+		s.stats.uploadsTooLarge.Add(1)
+		slog.Warn("Skipping upload, body is above TIGRIS_MAX_OBJECT_SIZE", "path", resp.Request.URL.Path, "content_length", resp.ContentLength, "max", cfg.MaxObjectSize)
+		return nil
+	}
+
+	key := objectKey(*cfg, resp.Request, ct)
+	if cfg.ExposeCacheKey {
+		resp.Header.Set("X-Cache-Key", key)
+	}
+	if !s.sampler.shouldUpload(key) {
+		s.stats.uploadsSkipped.Add(1)
+		return nil
+	}
+	if !s.debouncer.allow(key) {
+		s.stats.uploadsDebounced.Add(1)
+		return nil
+	}
+	s.stats.uploadsSampled.Add(1)
+
+	// With KEY_INCLUDE_METHOD, HEAD has its own key holding only the
+	// response's metadata, the body is never read
+	if head {
+		meta := newObjectMeta(resp)
+		meta.HeadContentLength = resp.ContentLength
+		resp.Header.Set("X-Cache", cacheMiss)
+		path := resp.Request.URL.Path
+		s.uploads.Add(1)
+		go func() {
+			defer s.uploads.Done()
+			if err := s.uploadToS3(context.Background(), bytes.NewReader(nil), 0, path, key, meta); err != nil {
+				byType.uploadFailures.Add(1)
+				slog.Error("S3 upload failed", "error", err)
+				return
+			}
+			byType.uploads.Add(1)
+		}()
+		return nil
+	}
+
+	// Encoded bytes can't be sniffed, so they can't be proven to be an image
+	if cfg.StrictImageOnly && resp.Header.Get("Content-Encoding") != "" {
+		s.stats.uploadsRejected.Add(1)
+		slog.Warn("Refusing to cache encoded response in strict image mode", "path", resp.Request.URL.Path)
+		return nil
+	}
+
+	if cfg.UploadKeyLock && !s.keyLocks.TryLock(key) {
+		s.stats.uploadsConcurrent.Add(1)
+		return nil
+	}
+	unlock := func() {
+		if cfg.UploadKeyLock {
+			s.keyLocks.Unlock(key)
+		}
+	}
+
+	// The tee may queue that much more for an upload falling behind
+	bufferSize := uploadBufferSize(cfg, resp.ContentLength) + int64(cfg.UploadTeeBufferSize)
+	if !s.buffers.tryAcquire(bufferSize) {
+		unlock()
+		s.stats.uploadsSkippedMemory.Add(1)
+		slog.Warn("Skipping upload, buffer budget exhausted", "path", resp.Request.URL.Path, "buffered", s.buffers.Used())
+		return nil
+	}
+
+	// Stream the body to the client and, through a pipe, to S3 at the same time.
+	// The copy is queued for the uploader, which is dropped rather than let
+	// the client wait when it falls UPLOAD_TEE_BUFFER_SIZE behind.
+	pr, pw := io.Pipe()
+	tee := newTeeBody(resp.Body, pw, cfg.UploadTeeBufferSize)
+	resp.Body = tee
+	resp.Header.Set("X-Cache", cacheMiss)
+
+	path, size := resp.Request.URL.Path, resp.ContentLength
+	meta := newObjectMeta(resp)
+	if cfg.ProvenanceMetadata {
+		meta.Provenance = &provenance{RenderHost: s.hostname, Schema: metaSchemaVersion}
+		// Per response, imgproxy may be upgraded behind a running proxy
+		if cfg.UpstreamVersionHeader != "" {
+			meta.Provenance.ImgproxyVersion = resp.Header.Get(cfg.UpstreamVersionHeader)
+		}
+	}
+	if cfg.StoreUpstreamETag {
+		meta.UpstreamETag = resp.Header.Get("ETag")
+	}
+	if cfg.VerifyKeySource {
+		meta.KeySource = keySource(*cfg, resp.Request)
+	}
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		defer unlock()
+		defer s.buffers.release(bufferSize)
+		body := &countingReader{r: pr}
+		var src io.Reader = body
+		var lengthCheck *lengthCheckReader
+		if cfg.VerifyContentLength && size >= 0 {
+			lengthCheck = &lengthCheckReader{r: body, want: size}
+			src = lengthCheck
+		}
+		var sizeLimit *sizeLimitReader
+		if size < 0 {
+			sizeLimit = &sizeLimitReader{r: src, max: cfg.MaxObjectSize}
+			src = sizeLimit
+		}
+		if cfg.StrictImageOnly {
+			// Trust the bytes rather than the upstream header
+			br := bufio.NewReaderSize(src, sniffLen)
+			ct, ok := sniffImage(br)
+			if !ok {
+				s.stats.uploadsRejected.Add(1)
+				slog.Warn("Refusing to cache non-image response", "path", path, "detected", ct)
+				pr.CloseWithError(errNotAnImage)
+				return
+			}
+			meta.ContentType = ct
+			src = br
+		}
+		// Bodies of unknown length are only known to be large enough once
+		// that many bytes arrived
+		if min := int(cfg.MinCacheObjectSize); min > 0 && size < 0 {
+			br := bufio.NewReaderSize(src, min)
+			if head, _ := br.Peek(min); len(head) < min {
+				s.stats.uploadsTooSmall.Add(1)
+				pr.CloseWithError(errTooSmall)
+				return
+			}
+			src = br
+		}
+		var err error
+		if cfg.ContentAddressed && size <= cfg.ContentAddressedMaxSize {
+			err = s.uploadContentAddressed(context.Background(), src, size, path, key, ct, meta)
+		} else {
+			err = s.uploadToS3(context.Background(), src, size, path, key, meta)
+		}
+		if sizeLimit != nil && sizeLimit.exceeded {
+			s.stats.uploadsTooLarge.Add(1)
+			slog.Warn("Aborted upload, body went above TIGRIS_MAX_OBJECT_SIZE", "path", path, "max", cfg.MaxObjectSize)
+		}
+		if lengthCheck != nil && lengthCheck.mismatch {
+			s.stats.uploadsLengthMismatch.Add(1)
+			slog.Warn("Dropped upload, body length doesn't match Content-Length", "path", path, "content_length", size, "read", lengthCheck.n)
+		}
+		if err != nil {
+			byType.uploadFailures.Add(1)
+			slog.Error("S3 upload failed", "error", err)
+		} else {
+			byType.uploads.Add(1)
+			s.events.notify(cacheEvent{
+				Key:         key,
+				Path:        path,
+				Size:        body.n,
+				ContentType: meta.ContentType,
+				Timestamp:   time.Now().UTC(),
+			})
+		}
+		if tee.dropped.Load() {
+			s.stats.uploadsTooSlow.Add(1)
+			slog.Warn("Aborted upload, it fell UPLOAD_TEE_BUFFER_SIZE behind the client", "path", path, "buffer", cfg.UploadTeeBufferSize)
+		}
+		// Unblock the tee if the upload stopped reading early
+		pr.CloseWithError(err)
+	}()
+	return nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testImagePath = "/insecure/rs:fit:100:100/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn"
+
+func TestMissUploadsRender(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"EXPOSE_CACHE_KEY": "true"}, nil)
+
+	resp := e.get(testImagePath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if !bytes.Equal(readAll(t, resp), testPNG) {
+		t.Error("client didn't receive the render")
+	}
+	if got := resp.Header.Get("X-Cache"); got != cacheMiss {
+		t.Errorf("X-Cache = %q, want %q", got, cacheMiss)
+	}
+	key := resp.Header.Get("X-Cache-Key")
+	o, ok := e.s3.object(key)
+	if !ok {
+		t.Fatalf("nothing stored under %q, bucket has %v", key, e.s3.keys(testBucket))
+	}
+	if !bytes.Equal(o.body, testPNG) {
+		t.Errorf("stored %d bytes, want the %d byte render", len(o.body), len(testPNG))
+	}
+	if got := o.header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("stored Content-Type = %q, want image/png", got)
+	}
+	if got := o.header.Get("X-Amz-Meta-" + statusMetadataKey); got != "200" {
+		t.Errorf("stored status = %q, want 200", got)
+	}
+	if n := len(e.img.renders()); n != 1 {
+		t.Errorf("imgproxy rendered %d times, want 1", n)
+	}
+}
+
+func TestUploadDecisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		handler http.HandlerFunc
+		method  string
+		status  int
+		upload  bool
+	}{
+		{name: "render", status: http.StatusOK, upload: true},
+		{
+			name:    "missing source",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "imgproxy error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "boom", http.StatusInternalServerError) },
+			status:  http.StatusInternalServerError,
+		},
+		{
+			name: "upstream forbids caching",
+			env:  map[string]string{"NO_CACHE_HEADERS": "Cache-Control"},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "no-store")
+				servePNG(w, r)
+			},
+			status: http.StatusOK,
+		},
+		{name: "caching disabled", env: map[string]string{"CACHE_ENABLED": "false"}, status: http.StatusOK},
+		{name: "head", method: http.MethodHead, status: http.StatusOK},
+		{name: "method not allowed", method: http.MethodPost, status: http.StatusMethodNotAllowed},
+		{name: "below minimum size", env: map[string]string{"MIN_CACHE_OBJECT_SIZE": "100000"}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.env, tt.handler)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			resp := e.do(httptest.NewRequest(method, testImagePath, nil))
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if stored := len(e.s3.keys(testBucket)) > 0; stored != tt.upload {
+				t.Errorf("uploaded = %v, want %v", stored, tt.upload)
+			}
+			if want := map[bool]string{true: cacheMiss, false: cacheBypass}[tt.upload]; tt.status == http.StatusOK && resp.Header.Get("X-Cache") != want {
+				t.Errorf("X-Cache = %q, want %q", resp.Header.Get("X-Cache"), want)
+			}
+		})
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+	e.get(testImagePath)
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		exists bool
+	}{
+		{name: "no token", path: "/admin/cache?path=" + testImagePath, status: http.StatusUnauthorized},
+		{name: "wrong token", path: "/admin/cache?path=" + testImagePath, token: "nope", status: http.StatusUnauthorized},
+		{name: "missing path", path: "/admin/cache", token: "secret", status: http.StatusBadRequest},
+		{name: "not cached", path: "/admin/cache?path=/insecure/aHR0cHM6Ly9leGFtcGxlLmNvbS9kb2cuanBn", token: "secret", status: http.StatusNotFound},
+		{name: "cached", path: "/admin/cache?path=" + testImagePath, token: "secret", status: http.StatusOK, exists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := e.do(req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK && tt.status != http.StatusNotFound {
+				return
+			}
+			var status cacheStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if status.Exists != tt.exists {
+				t.Errorf("exists = %v, want %v", status.Exists, tt.exists)
+			}
+			if tt.exists && status.Size != int64(len(testPNG)) {
+				t.Errorf("size = %d, want %d", status.Size, len(testPNG))
+			}
+		})
+	}
+}
+
+func TestAdminList(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "S3_FOLDER": "cache/"}, nil)
+	for _, key := range []string{"cache/a", "cache/b", "cache/c", "other/d"} {
+		e.s3.put(key, []byte("x"), http.Header{})
+	}
+
+	list := func(t *testing.T, query string) objectList {
+		t.Helper()
+		resp := e.admin(http.MethodGet, "/admin/list"+query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		var out objectList
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return out
+	}
+
+	all := list(t, "")
+	if len(all.Objects) != 3 || all.NextToken != "" {
+		t.Errorf("listed %+v, want the 3 objects under S3_FOLDER", all)
+	}
+	page := list(t, "?limit=2")
+	if len(page.Objects) != 2 || page.NextToken == "" {
+		t.Fatalf("first page = %+v, want 2 objects and a token", page)
+	}
+	rest := list(t, "?limit=2&token="+page.NextToken)
+	if len(rest.Objects) != 1 || rest.Objects[0].Key != "cache/c" {
+		t.Errorf("second page = %+v, want cache/c", rest)
+	}
+	if resp := e.admin(http.MethodGet, "/admin/list?limit=0"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("limit=0: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestAdminListByType(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "S3_FOLDER": "cache/", "S3_FOLDERS_BY_TYPE": "avif=avif/"}, nil)
+	e.s3.put("cache/a", []byte("x"), http.Header{})
+	e.s3.put("avif/b", []byte("x"), http.Header{})
+
+	tests := []struct {
+		query  string
+		status int
+		keys   []string
+	}{
+		{query: "", status: http.StatusOK, keys: []string{"cache/a"}},
+		{query: "?type=avif", status: http.StatusOK, keys: []string{"avif/b"}},
+		// Types without a folder of their own stay in S3_FOLDER
+		{query: "?type=png", status: http.StatusOK, keys: []string{"cache/a"}},
+		{query: "?type=bmp", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp := e.admin(http.MethodGet, "/admin/list"+tt.query)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var out objectList
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, o := range out.Objects {
+				keys = append(keys, o.Key)
+			}
+			if !slices.Equal(keys, tt.keys) {
+				t.Errorf("listed %v, want %v", keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestAdminListRequests(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "S3_FOLDER": "cache/"}, nil)
+	e.s3.put("cache/ab", []byte("12345"), http.Header{})
+	e.s3.put("cache/ac", []byte("1"), http.Header{})
+	e.s3.put("cache/b", []byte("1"), http.Header{})
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		token  string
+		fail   bool
+		status int
+		keys   []string
+	}{
+		{name: "prefix", query: "?prefix=a", status: http.StatusOK, keys: []string{"cache/ab", "cache/ac"}},
+		{name: "largest page", query: "?limit=1000", status: http.StatusOK, keys: []string{"cache/ab", "cache/ac", "cache/b"}},
+		{name: "page too large", query: "?limit=1001", status: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=all", status: http.StatusBadRequest},
+		{name: "POST", method: http.MethodPost, status: http.StatusMethodNotAllowed},
+		{name: "no token", token: "-", status: http.StatusUnauthorized},
+		{name: "bucket failure", fail: true, status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := cmp.Or(tt.method, http.MethodGet)
+			req := httptest.NewRequest(method, "/admin/list"+tt.query, nil)
+			if tt.token == "" {
+				req.Header.Set("Authorization", "Bearer secret")
+			}
+			if tt.fail {
+				e.s3.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+				defer e.s3.setFail(nil)
+			}
+			resp := e.do(req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var out objectList
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, o := range out.Objects {
+				keys = append(keys, o.Key)
+				if o.LastModified == nil || o.Size == 0 {
+					t.Errorf("%s: size = %d, last_modified = %v", o.Key, o.Size, o.LastModified)
+				}
+			}
+			if !slices.Equal(keys, tt.keys) {
+				t.Errorf("listed %v, want %v", keys, tt.keys)
+			}
+			if out.Objects[0].Key == "cache/ab" && out.Objects[0].Size != 5 {
+				t.Errorf("cache/ab size = %d, want 5", out.Objects[0].Size)
+			}
+		})
+	}
+}
+
+func TestHeadNeverUploadsBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		includeMethod string
+		stored        bool
+	}{
+		{name: "shared key", includeMethod: "false"},
+		{name: "KEY_INCLUDE_METHOD", includeMethod: "true", stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"KEY_INCLUDE_METHOD": tt.includeMethod, "EXPOSE_CACHE_KEY": "true"}, nil)
+			resp := e.do(httptest.NewRequest(http.MethodHead, testImagePath, nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			keys := e.s3.keys(testBucket)
+			if !tt.stored {
+				if len(keys) != 0 {
+					t.Errorf("stored %v, want nothing", keys)
+				}
+				return
+			}
+			o, ok := e.s3.object(resp.Header.Get("X-Cache-Key"))
+			if !ok {
+				t.Fatalf("nothing stored under the HEAD key, bucket has %v", keys)
+			}
+			if len(o.body) != 0 {
+				t.Errorf("stored a %d byte body, want an empty object", len(o.body))
+			}
+			if got, want := o.header.Get("X-Amz-Meta-"+headContentLengthMetadataKey), strconv.Itoa(len(testPNG)); got != want {
+				t.Errorf("stored Content-Length = %q, want %q", got, want)
+			}
+			if got := o.header.Get("Content-Type"); got != "image/png" {
+				t.Errorf("stored Content-Type = %q, want image/png", got)
+			}
+		})
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	img := newFakeImgproxy(t, nil)
+	fake := newFakeS3(t)
+	// No bucket and no credentials, the S3 endpoint must never be reached
+	cfg := testConfig(t, map[string]string{
+		"CACHE_ENABLED": "false",
+		"S3_BUCKET":     "",
+		"S3_ENDPOINT":   fake.URL,
+		"UPSTREAM_URL":  img.URL,
+		"ADMIN_TOKEN":   "secret",
+	})
+	target, _ := url.Parse(cfg.UpstreamURL)
+	srv, err := newServer(cfg, nil, nil, target, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &testEnv{t: t, img: img, s3: fake, srv: srv}
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{method: http.MethodGet, path: testImagePath, status: http.StatusOK},
+		{method: http.MethodHead, path: testImagePath, status: http.StatusOK},
+		{method: http.MethodGet, path: "/healthz", status: http.StatusOK},
+		{method: http.MethodGet, path: "/admin/cache?path=" + testImagePath, status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/admin/list", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp := e.admin(tt.method, tt.path)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+		if strings.HasPrefix(tt.path, "/insecure") && resp.Header.Get("X-Cache") != cacheBypass {
+			t.Errorf("%s %s: X-Cache = %q, want %s", tt.method, tt.path, resp.Header.Get("X-Cache"), cacheBypass)
+		}
+	}
+	if n := len(img.renders()); n != 2 {
+		t.Errorf("imgproxy received %d requests, want 2", n)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost} {
+		if n := fake.calls(method); n != 0 {
+			t.Errorf("the S3 endpoint received %d %s requests", n, method)
+		}
+	}
+}
+
+func TestMaxUploadBodySize(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunked   bool
+		status    int
+		forwarded bool
+	}{
+		{name: "under the limit", size: 100, status: http.StatusOK, forwarded: true},
+		{name: "at the limit", size: 1024, status: http.StatusOK, forwarded: true},
+		{name: "over the limit", size: 1025, status: http.StatusRequestEntityTooLarge},
+		// Without a Content-Length the limit is only hit while forwarding,
+		// whether imgproxy saw the request by then is a matter of timing
+		{name: "over the limit, unknown length", size: 4096, chunked: true, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received int
+			e := newTestEnv(t, map[string]string{"MAX_UPLOAD_BODY_SIZE": "1024", "ALLOWED_METHODS": "GET,HEAD,POST"}, func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return
+				}
+				received = len(body)
+				servePNG(w, r)
+			})
+			var body io.Reader = bytes.NewReader(make([]byte, tt.size))
+			if tt.chunked {
+				body = io.MultiReader(body)
+			}
+			resp := e.do(httptest.NewRequest(http.MethodPost, testImagePath, body))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if forwarded := len(e.img.renders()) == 1; !tt.chunked && forwarded != tt.forwarded {
+				t.Errorf("forwarded = %v, want %v", forwarded, tt.forwarded)
+			}
+			if tt.status == http.StatusOK && received != tt.size {
+				t.Errorf("imgproxy received %d bytes, want %d", received, tt.size)
+			}
+		})
+	}
+}
+
+func TestAdminCacheFallbackFolders(t *testing.T) {
+	tests := []struct {
+		name      string
+		promote   string
+		inPrimary bool
+		promoted  bool
+	}{
+		{name: "found in a former folder", promote: "false"},
+		{name: "promoted", promote: "true", promoted: true},
+		{name: "primary first", promote: "true", inPrimary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{
+				"ADMIN_TOKEN":         "secret",
+				"S3_FOLDER":           "new/",
+				"S3_FALLBACK_FOLDERS": "older/,old/",
+				"S3_FALLBACK_PROMOTE": tt.promote,
+			}, nil)
+			req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			current := objectKey(*e.srv.config(), req, contentTypePNG)
+			former := *e.srv.config()
+			former.S3Folder, former.S3FoldersByType = "old/", nil
+			old := objectKey(former, req, contentTypePNG)
+			e.s3.put(old, testPNG, http.Header{"Content-Type": {"image/png"}, "X-Amz-Meta-Status": {"200"}})
+			if tt.inPrimary {
+				e.s3.put(current, testPNG, http.Header{"Content-Type": {"image/png"}})
+			}
+
+			resp := e.admin(http.MethodGet, "/admin/cache?path="+testImagePath)
+			var status cacheStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || !status.Exists {
+				t.Fatalf("status = %d, exists = %v", resp.StatusCode, status.Exists)
+			}
+			want, wantFrom := old, ""
+			if tt.inPrimary || tt.promoted {
+				want = current
+			}
+			if tt.promoted {
+				wantFrom = old
+			}
+			if status.Key != want || status.PromotedFrom != wantFrom {
+				t.Errorf("key = %q, promoted_from = %q, want %q and %q", status.Key, status.PromotedFrom, want, wantFrom)
+			}
+			o, ok := e.s3.object(current)
+			if ok != (tt.inPrimary || tt.promoted) {
+				t.Fatalf("object in the current folder = %v", ok)
+			}
+			if tt.promoted && (!bytes.Equal(o.body, testPNG) || o.header.Get("X-Amz-Meta-Status") != "200") {
+				t.Error("the promoted copy lost its body or metadata")
+			}
+			if e.s3.calls(http.MethodPut) > 0 != tt.promoted {
+				t.Errorf("%d copies, promoted = %v", e.s3.calls(http.MethodPut), tt.promoted)
+			}
+		})
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		method  string
+		status  int
+		allow   string
+	}{
+		{name: "GET by default", method: http.MethodGet, status: http.StatusOK},
+		{name: "HEAD by default", method: http.MethodHead, status: http.StatusOK},
+		{name: "POST by default", method: http.MethodPost, status: http.StatusMethodNotAllowed, allow: "GET, HEAD"},
+		{name: "DELETE by default", method: http.MethodDelete, status: http.StatusMethodNotAllowed, allow: "GET, HEAD"},
+		{name: "configured", allowed: "get,post", method: http.MethodPost, status: http.StatusOK},
+		{name: "left out", allowed: "get,post", method: http.MethodHead, status: http.StatusMethodNotAllowed, allow: "GET, POST"},
+		// Preflights are answered by the proxy whatever the list
+		{name: "OPTIONS", method: http.MethodOptions, status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ALLOWED_METHODS": tt.allowed}, nil)
+			resp := e.do(httptest.NewRequest(tt.method, testImagePath, nil))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+			forwarded := len(e.img.renders()) == 1
+			if want := tt.status == http.StatusOK; forwarded != want {
+				t.Errorf("forwarded = %v, want %v", forwarded, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serve listens until ctx is done, then shuts down in phases: /readyz
+// reports not ready for SHUTDOWN_DELAY while requests keep being served, so
+// load balancers deregister the instance, then in-flight requests and
+// uploads get up to SHUTDOWN_TIMEOUT to finish.
+func (s *server) serve(ctx context.Context) error {
+	cfg := s.config()
+	httpServer := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	l, err := net.Listen("tcp", cfg.TigrisProxyBind)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxConnections > 0 {
+		l = newLimitListener(l, cfg.MaxConnections)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- httpServer.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.draining.Store(true)
+	slog.Info("Shutdown requested, draining", "delay", cfg.ShutdownDelay)
+	time.Sleep(cfg.ShutdownDelay)
+
+	slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	slog.Info("Requests drained, waiting for uploads")
+
+	uploaded := make(chan struct{})
+	go func() {
+		s.uploads.Wait()
+		close(uploaded)
+	}()
+	select {
+	case <-uploaded:
+		slog.Info("Server stopped")
+		return nil
+	case <-shutdownCtx.Done():
+		return errors.New("uploads still running after SHUTDOWN_TIMEOUT")
+	}
+}
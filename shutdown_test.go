@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainingDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	addr := freeAddr(t)
+	e := newTestEnv(t, map[string]string{"IMGPROXY_BIND": addr, "SHUTDOWN_DELAY": delay.String()}, nil)
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	go func() { errc <- e.srv.serve(ctx) }()
+
+	url := "http://" + addr
+	status := func(path string) int {
+		resp, err := noKeepAlive.Get(url + path)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitReady(t, addr)
+
+	cancel()
+	start := time.Now()
+	for status("/readyz") != http.StatusServiceUnavailable {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > delay/2 {
+		t.Errorf("/readyz flipped after %v, want at once", elapsed)
+	}
+	if got := status(testImagePath); got != http.StatusOK {
+		t.Errorf("status while draining = %d, want 200", got)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("stopped after %v, before SHUTDOWN_DELAY", elapsed)
+	}
+	if got := status("/readyz"); got != 0 {
+		t.Errorf("/readyz = %d after shutdown, want the listener closed", got)
+	}
+}
+
+func TestShutdownWaitsForUploads(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		wantErr bool
+	}{
+		{name: "uploads finish", timeout: "5s"},
+		{name: "uploads outlive SHUTDOWN_TIMEOUT", timeout: "50ms", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			e := newTestEnv(t, map[string]string{"IMGPROXY_BIND": addr, "SHUTDOWN_TIMEOUT": tt.timeout}, nil)
+			ctx, cancel := context.WithCancel(t.Context())
+			errc := make(chan error, 1)
+			go func() { errc <- e.srv.serve(ctx) }()
+
+			waitReady(t, addr)
+
+			e.s3.setDelay(300 * time.Millisecond)
+			resp, err := noKeepAlive.Get("http://" + addr + testImagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			cancel()
+			if err := <-errc; (err != nil) != tt.wantErr {
+				t.Errorf("serve: err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded == tt.wantErr {
+				t.Errorf("uploaded = %v when serve returned", uploaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of a body content detection looks at
+const sniffLen = 512
+
+var errNotAnImage = errors.New("response body is not an image")
+
+// sniffImage detects the image type from the first bytes of a body without
+// consuming them. SVG isn't accepted: it's scriptable markup, not image bytes.
+func sniffImage(r *bufio.Reader) (string, bool) {
+	head, _ := r.Peek(sniffLen)
+	if ct := isoBMFFImageType(head); ct != "" {
+		return ct, true
+	}
+	ct := http.DetectContentType(head)
+	return ct, strings.HasPrefix(ct, "image/")
+}
+
+// isoBMFFImageType recognizes AVIF and HEIF, whose ftyp box the standard
+// sniffer reports as video/mp4
+func isoBMFFImageType(head []byte) string {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return ""
+	}
+	switch string(head[8:12]) {
+	case "avif", "avis":
+		return "image/avif"
+	case "heic", "heix", "mif1":
+		return "image/heif"
+	}
+	return ""
+}
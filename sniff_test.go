@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestStrictImageOnly(t *testing.T) {
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	avif := append([]byte{0, 0, 0, 0x1c}, []byte("ftypavif\x00\x00\x00\x00avifmif1miaf")...)
+	tests := []struct {
+		name     string
+		strict   string
+		body     []byte
+		header   string
+		encoding string
+		// stored is the Content-Type of the cached object, empty when rejected
+		stored string
+	}{
+		{name: "image", strict: "true", body: testPNG, header: "image/png", stored: "image/png"},
+		{name: "mislabeled image", strict: "true", body: testPNG, header: "text/plain", stored: "image/png"},
+		{name: "avif", strict: "true", body: avif, header: "application/octet-stream", stored: "image/avif"},
+		{name: "html posing as an image", strict: "true", body: html, header: "image/png"},
+		{name: "svg", strict: "true", body: svg, header: "image/svg+xml"},
+		{name: "encoded", strict: "true", body: testPNG, header: "image/png", encoding: "br"},
+		{name: "disabled", strict: "false", body: html, header: "image/png", stored: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"STRICT_IMAGE_ONLY": tt.strict}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.header)
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				w.Write(tt.body)
+			})
+			resp := e.get(testImagePath)
+			// Rejected bodies are still served as imgproxy sent them
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(readAll(t, resp), tt.body) {
+				t.Errorf("status = %d, the client didn't receive the upstream body", resp.StatusCode)
+			}
+
+			keys := e.s3.keys(testBucket)
+			if tt.stored == "" {
+				if len(keys) != 0 {
+					t.Errorf("uploaded %v", keys)
+				}
+				if got := e.srv.stats.uploadsRejected.Load(); got != 1 {
+					t.Errorf("uploads_rejected = %d, want 1", got)
+				}
+				return
+			}
+			if len(keys) != 1 {
+				t.Fatalf("bucket has %v, want one object", keys)
+			}
+			if o, _ := e.s3.object(keys[0]); o.header.Get("Content-Type") != tt.stored {
+				t.Errorf("stored Content-Type = %q, want %q", o.header.Get("Content-Type"), tt.stored)
+			}
+		})
+	}
+}
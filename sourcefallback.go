@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const sourceFetchTimeout = 10 * time.Second
+
+var errUpstreamFailed = errors.New("imgproxy failed to render")
+
+// sourceFallback serves the original source image when imgproxy can't render
+// it, so users get the full size image rather than a broken one. Only sources
+// under the allowed prefixes are fetched: the proxy doesn't check signatures,
+// anything else would let anyone make it fetch arbitrary URLs.
+type sourceFallback struct {
+	allowed []*url.URL
+	baseURL string
+	client  *http.Client
+}
+
+const maxSourceRedirects = 5
+
+func newSourceFallback(cfg Config) *sourceFallback {
+	f := &sourceFallback{baseURL: cfg.ImgproxyBaseURL}
+	for _, prefix := range cfg.FallbackSourceAllowed {
+		// Validated by loadConfig
+		if u, err := parseSourcePrefix(prefix); err == nil {
+			f.allowed = append(f.allowed, u)
+		}
+	}
+	f.client = &http.Client{
+		Timeout: sourceFetchTimeout,
+		// Every hop must be allowed, or a redirect would reach anything
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxSourceRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			if !f.isAllowed(req.URL) {
+				return fmt.Errorf("redirect to %q isn't allowed", req.URL)
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// parseSourcePrefix parses a FALLBACK_SOURCE_ALLOWED entry, an http(s) URL
+// whose path, if any, sources must be under
+func parseSourcePrefix(prefix string) (*url.URL, error) {
+	u, err := url.Parse(prefix)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid FALLBACK_SOURCE_ALLOWED entry %q, expected http(s)://host[:port][/path]", prefix)
+	}
+	return u, nil
+}
+
+// sourceURL decodes the source image URL of an imgproxy path
+func (f *sourceFallback) sourceURL(path string) (*url.URL, error) {
+	p, ok := parseImgproxyPath(path)
+	if !ok {
+		return nil, fmt.Errorf("not a processing path")
+	}
+	src, _, err := decodeSource(p.Source)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(f.baseURL + src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("unsupported source %q", f.baseURL+src)
+	}
+	if !f.isAllowed(u) {
+		return nil, fmt.Errorf("source %q isn't allowed", u)
+	}
+	return u, nil
+}
+
+// isAllowed reports whether u is under one of the allowed prefixes: same
+// scheme and host, and a path equal to or below the prefix's, compared on
+// whole segments. Dot segments and credentials are never allowed, they would
+// make the URL fetched differ from the one checked.
+func (f *sourceFallback) isAllowed(u *url.URL) bool {
+	if u.User != nil || hasDotSegment(u.Path) {
+		return false
+	}
+	for _, prefix := range f.allowed {
+		if !strings.EqualFold(u.Scheme, prefix.Scheme) || !strings.EqualFold(hostPort(u), hostPort(prefix)) {
+			continue
+		}
+		dir := prefix.Path
+		if !strings.HasSuffix(dir, "/") {
+			if u.Path == dir {
+				return true
+			}
+			dir += "/"
+		}
+		if strings.HasPrefix(u.Path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort is the host of u with its port, the scheme's default one when
+// not given
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func hasDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// serve reports false when nothing was written and the caller must answer
+func (f *sourceFallback) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, path string) bool {
+	src, err := f.sourceURL(path)
+	if err != nil {
+		slog.Debug("No source fallback", "path", path, "error", err)
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		slog.Warn("Source fallback failed", "source", src, "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		slog.Warn("Source fallback failed", "source", src, "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
+		return false
+	}
+
+	slog.Warn("Serving unprocessed source image", "path", path, "source", src)
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(resp.ContentLength))
+	}
+	// The fallback must not outlive the outage in any cache
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Cache", cacheBypass)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.Copy(w, resp.Body)
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSourceFallbackAllowed(t *testing.T) {
+	f := newSourceFallback(Config{FallbackSourceAllowed: []string{
+		"https://cdn.example.com/images",
+		"http://assets.example.com",
+	}})
+	tests := []struct {
+		src     string
+		allowed bool
+	}{
+		{"https://cdn.example.com/images/cat.jpg", true},
+		{"https://cdn.example.com/images", true},
+		{"https://CDN.example.com:443/images/cat.jpg", true},
+		{"http://assets.example.com/any/path.png", true},
+		{"https://cdn.example.com/images2/cat.jpg", false},
+		{"https://cdn.example.com/imagesecret", false},
+		{"https://cdn.example.com/images/../admin", false},
+		{"https://cdn.example.com/images/%2e%2e/admin", false},
+		{"https://cdn.example.com.evil.com/images/cat.jpg", false},
+		{"https://cdn.example.com:8443/images/cat.jpg", false},
+		{"https://cdn.example.com@evil.com/images/cat.jpg", false},
+		{"https://user@cdn.example.com/images/cat.jpg", false},
+		{"http://cdn.example.com/images/cat.jpg", false},
+		{"https://assets.example.com/cat.jpg", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := f.sourceURL(renderPath(tt.src))
+			if (err == nil) != tt.allowed {
+				t.Errorf("sourceURL error = %v, want allowed = %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestParseSourcePrefix(t *testing.T) {
+	for _, prefix := range []string{"cdn.example.com", "ftp://cdn.example.com", "https://", "https://user:pw@cdn.example.com", "https://cdn.example.com/?a=1"} {
+		if _, err := parseSourcePrefix(prefix); err == nil {
+			t.Errorf("parseSourcePrefix(%q) succeeded", prefix)
+		}
+	}
+	if _, err := parseSourcePrefix("https://cdn.example.com/images/"); err != nil {
+		t.Errorf("parseSourcePrefix: %v", err)
+	}
+}
+
+func TestSourceFallbackRedirects(t *testing.T) {
+	image := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}
+	outside := httptest.NewServer(http.HandlerFunc(image))
+	defer outside.Close()
+	inside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/moved.png":
+			http.Redirect(w, r, "/images/cat.png", http.StatusFound)
+		case "/images/away.png":
+			http.Redirect(w, r, outside.URL+"/cat.png", http.StatusFound)
+		default:
+			image(w, r)
+		}
+	}))
+	defer inside.Close()
+
+	f := newSourceFallback(Config{FallbackSourceAllowed: []string{inside.URL + "/images/"}})
+	tests := []struct {
+		path   string
+		served bool
+	}{
+		{"/images/cat.png", true},
+		{"/images/moved.png", true},
+		{"/images/away.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			served := f.serve(req.Context(), rec, req, renderPath(inside.URL+tt.path))
+			if served != tt.served {
+				t.Fatalf("served = %v, want %v", served, tt.served)
+			}
+			if served && !strings.HasPrefix(rec.Header().Get("Content-Type"), "image/") {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
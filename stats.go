@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// counters are cumulative since boot or the last POST /admin/stats/reset
+type counters struct {
+	uploadsSampled   atomic.Int64
+	uploadsSkipped   atomic.Int64
+	uploadsDebounced atomic.Int64
+	// uploadsTooSlow counts uploads aborted for falling behind the client
+	uploadsTooSlow atomic.Int64
+	// uploadsSkippedMemory counts responses not cached for lack of buffer budget
+	uploadsSkippedMemory atomic.Int64
+	// uploadsRejected counts responses STRICT_IMAGE_ONLY didn't recognize as images
+	uploadsRejected atomic.Int64
+	// uploadsConcurrent counts uploads dropped because the key was already being written
+	uploadsConcurrent atomic.Int64
+	// uploadsTooSmall counts responses below MIN_CACHE_OBJECT_SIZE
+	uploadsTooSmall atomic.Int64
+	// uploadsDeduplicated counts CONTENT_ADDRESSED renders whose bytes were already stored
+	uploadsDeduplicated atomic.Int64
+	// uploadsTooLarge counts responses above TIGRIS_MAX_OBJECT_SIZE
+	uploadsTooLarge atomic.Int64
+	// uploadsNoCache counts responses imgproxy marked uncacheable, see NO_CACHE_HEADERS
+	uploadsNoCache atomic.Int64
+	// uploadsSkippedRule counts responses a CACHE_RULES_FILE rule kept out of the bucket
+	uploadsSkippedRule atomic.Int64
+	// uploadsLengthMismatch counts uploads VERIFY_CONTENT_LENGTH dropped
+	uploadsLengthMismatch atomic.Int64
+
+	// mirror* count the copies to MIRROR_S3_BUCKET
+	mirrorWrites   atomic.Int64
+	mirrorFailures atomic.Int64
+	mirrorDropped  atomic.Int64
+
+	byContentType [numContentTypes]contentTypeCounters
+}
+
+// contentTypeCounters break renders and their uploads down by content type
+type contentTypeCounters struct {
+	renders        atomic.Int64
+	uploads        atomic.Int64
+	uploadFailures atomic.Int64
+}
+
+type contentTypeSnapshot struct {
+	Renders        int64 `json:"renders"`
+	Uploads        int64 `json:"uploads"`
+	UploadFailures int64 `json:"upload_failures"`
+}
+
+type statsSnapshot struct {
+	UpstreamHealthy       bool  `json:"upstream_healthy"`
+	UpstreamInFlight      int64 `json:"upstream_in_flight"`
+	MaintenanceMode       bool  `json:"maintenance_mode"`
+	UploadsSampled        int64 `json:"uploads_sampled"`
+	UploadsSkipped        int64 `json:"uploads_skipped"`
+	UploadsDebounced      int64 `json:"uploads_debounced"`
+	UploadsTooSlow        int64 `json:"uploads_too_slow"`
+	UploadsSkippedMemory  int64 `json:"uploads_skipped_memory"`
+	UploadsRejected       int64 `json:"uploads_rejected"`
+	UploadsConcurrent     int64 `json:"uploads_concurrent"`
+	UploadsTooSmall       int64 `json:"uploads_too_small"`
+	UploadsTooLarge       int64 `json:"uploads_too_large"`
+	UploadsDeduplicated   int64 `json:"uploads_deduplicated"`
+	MirrorWrites          int64 `json:"mirror_writes"`
+	MirrorFailures        int64 `json:"mirror_failures"`
+	MirrorDropped         int64 `json:"mirror_dropped"`
+	UploadsNoCache        int64 `json:"uploads_no_cache"`
+	UploadsSkippedRule    int64 `json:"uploads_skipped_rule"`
+	UploadsLengthMismatch int64 `json:"uploads_length_mismatch"`
+	BufferedBytes         int64 `json:"buffered_bytes"`
+
+	ContentTypes map[string]contentTypeSnapshot `json:"content_types"`
+	// UpstreamHeaders aggregates the numeric imgproxy headers of UPSTREAM_METRIC_HEADERS
+	UpstreamHeaders map[string]headerStat `json:"upstream_headers"`
+}
+
+// statsHandler serves the counters. With reset it requires POST and zeroes
+// them, answering with their values from before the reset. The gauges
+// (health, in flight, buffered bytes) are never reset.
+func statsHandler(health *upstreamHealth, limiter Limiter, maint *maintenance, buffers *bufferBudget, c *counters, upstream *upstreamHeaderStats, reset bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reset && r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, statsSnapshot{
+			UpstreamHealthy:       health.Healthy(),
+			UpstreamInFlight:      limiter.InFlight(),
+			MaintenanceMode:       maint.Enabled(),
+			UploadsSampled:        counterValue(&c.uploadsSampled, reset),
+			UploadsSkipped:        counterValue(&c.uploadsSkipped, reset),
+			UploadsDebounced:      counterValue(&c.uploadsDebounced, reset),
+			UploadsTooSlow:        counterValue(&c.uploadsTooSlow, reset),
+			UploadsSkippedMemory:  counterValue(&c.uploadsSkippedMemory, reset),
+			UploadsRejected:       counterValue(&c.uploadsRejected, reset),
+			UploadsConcurrent:     counterValue(&c.uploadsConcurrent, reset),
+			UploadsTooSmall:       counterValue(&c.uploadsTooSmall, reset),
+			UploadsTooLarge:       counterValue(&c.uploadsTooLarge, reset),
+			UploadsDeduplicated:   counterValue(&c.uploadsDeduplicated, reset),
+			MirrorWrites:          counterValue(&c.mirrorWrites, reset),
+			MirrorFailures:        counterValue(&c.mirrorFailures, reset),
+			MirrorDropped:         counterValue(&c.mirrorDropped, reset),
+			UploadsNoCache:        counterValue(&c.uploadsNoCache, reset),
+			UploadsSkippedRule:    counterValue(&c.uploadsSkippedRule, reset),
+			UploadsLengthMismatch: counterValue(&c.uploadsLengthMismatch, reset),
+			BufferedBytes:         buffers.Used(),
+			ContentTypes:          c.contentTypes(reset),
+			UpstreamHeaders:       upstream.snapshot(reset),
+		})
+	}
+}
+
+// counterValue reads v, zeroing it when reset is set. The swap is atomic so
+// an increment racing with a reset is counted in exactly one period.
+func counterValue(v *atomic.Int64, reset bool) int64 {
+	if reset {
+		return v.Swap(0)
+	}
+	return v.Load()
+}
+
+func (c *counters) contentTypes(reset bool) map[string]contentTypeSnapshot {
+	out := make(map[string]contentTypeSnapshot, numContentTypes)
+	for t := range numContentTypes {
+		ct := &c.byContentType[t]
+		out[t.String()] = contentTypeSnapshot{
+			Renders:        counterValue(&ct.renders, reset),
+			Uploads:        counterValue(&ct.uploads, reset),
+			UploadFailures: counterValue(&ct.uploadFailures, reset),
+		}
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestStatsReset(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		status     int
+		beforeNext int64
+	}{
+		{name: "POST", method: http.MethodPost, status: http.StatusOK, beforeNext: 0},
+		{name: "GET", method: http.MethodGet, status: http.StatusMethodNotAllowed, beforeNext: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+			e.srv.stats.uploadsDebounced.Add(3)
+			e.srv.stats.byContentType[contentTypePNG].renders.Add(2)
+
+			resp := e.admin(tt.method, "/admin/stats/reset")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				var before statsSnapshot
+				if err := json.NewDecoder(resp.Body).Decode(&before); err != nil {
+					t.Fatal(err)
+				}
+				if before.UploadsDebounced != 3 || before.ContentTypes["png"].Renders != 2 {
+					t.Errorf("snapshot = %+v, want the values from before the reset", before)
+				}
+			}
+
+			var after statsSnapshot
+			if err := json.NewDecoder(e.get("/stats").Body).Decode(&after); err != nil {
+				t.Fatal(err)
+			}
+			if after.UploadsDebounced != tt.beforeNext {
+				t.Errorf("uploads_debounced = %d after the reset, want %d", after.UploadsDebounced, tt.beforeNext)
+			}
+			if !after.UpstreamHealthy {
+				t.Error("the health gauge was reset")
+			}
+		})
+	}
+}
+
+func TestStatsResetUnderLoad(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+	const workers, increments = 8, 2000
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				e.srv.stats.uploadsDebounced.Add(1)
+				e.srv.stats.byContentType[contentTypeWebP].uploads.Add(1)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Every increment is in exactly one snapshot, none lost nor counted
+	// twice by the resets
+	var counted, byType int64
+	reset := func() {
+		var s statsSnapshot
+		if err := json.NewDecoder(e.admin(http.MethodPost, "/admin/stats/reset").Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		counted += s.UploadsDebounced
+		byType += s.ContentTypes["webp"].Uploads
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		reset()
+	}
+	if counted != workers*increments || byType != workers*increments {
+		t.Errorf("counted %d and %d increments, want %d", counted, byType, workers*increments)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errBodyNotFullyRead = errors.New("response body closed before EOF")
+	errUploadTooSlow    = errors.New("upload fell behind the client")
+)
+
+// teeChunks recycles the copies queued for the uploader
+var teeChunks sync.Pool
+
+// teeBody streams the upstream body to the client while copying every chunk
+// into a pipe consumed by the S3 uploader. The copies are queued, at most
+// UPLOAD_TEE_BUFFER_SIZE bytes of them, and written to the pipe by their own
+// goroutine, so a slow upload never holds the client back: when the queue is
+// full the copy is dropped and the upload aborted. Failures on the copy side
+// never reach the client either.
+type teeBody struct {
+	body io.ReadCloser
+	w    *io.PipeWriter
+	// chunks is nil once the copy is finished or dropped
+	chunks      chan *[]byte
+	queued      atomic.Int64
+	maxQueued   int64
+	uploadEnded atomic.Bool
+	// dropped is set when the copy was aborted for falling behind
+	dropped atomic.Bool
+}
+
+func newTeeBody(body io.ReadCloser, w *io.PipeWriter, maxQueued int) *teeBody {
+	t := &teeBody{
+		body: body,
+		w:    w,
+		// Chunks are at least 512 bytes unless the upstream writes less at a
+		// time, in which case the byte bound is hit late
+		chunks:    make(chan *[]byte, max(1, maxQueued/512)),
+		maxQueued: int64(maxQueued),
+	}
+	go t.pump(t.chunks)
+	return t
+}
+
+// pump writes the queued copies to the pipe until the queue is closed
+func (t *teeBody) pump(chunks <-chan *[]byte) {
+	for chunk := range chunks {
+		if !t.uploadEnded.Load() {
+			if _, err := t.w.Write(*chunk); err != nil {
+				// The uploader closed its end, drain the queue
+				t.uploadEnded.Store(true)
+			}
+		}
+		t.queued.Add(-int64(len(*chunk)))
+		teeChunks.Put(chunk)
+	}
+	// A no-op when the pipe was already closed with an error
+	t.w.Close()
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 && t.chunks != nil {
+		if t.uploadEnded.Load() {
+			// Keep serving the client alone
+			t.finish(nil)
+		} else if !t.enqueue(p[:n]) {
+			t.dropped.Store(true)
+			t.finish(errUploadTooSlow)
+		}
+	}
+	if err != nil && t.chunks != nil {
+		if err == io.EOF {
+			t.finish(nil)
+		} else {
+			t.finish(err)
+		}
+	}
+	return n, err
+}
+
+func (t *teeBody) enqueue(b []byte) bool {
+	if t.queued.Load()+int64(len(b)) > t.maxQueued {
+		return false
+	}
+	chunk, _ := teeChunks.Get().(*[]byte)
+	if chunk == nil || cap(*chunk) < len(b) {
+		buf := make([]byte, 0, max(len(b), 32*1024))
+		chunk = &buf
+	}
+	*chunk = append((*chunk)[:0], b...)
+	t.queued.Add(int64(len(b)))
+	select {
+	case t.chunks <- chunk:
+		return true
+	default:
+		t.queued.Add(-int64(len(b)))
+		teeChunks.Put(chunk)
+		return false
+	}
+}
+
+// finish ends the copy. With an error the pipe is closed right away, the
+// chunks still queued are discarded; otherwise they are written first.
+func (t *teeBody) finish(err error) {
+	if err != nil {
+		t.uploadEnded.Store(true)
+		t.w.CloseWithError(err)
+	}
+	close(t.chunks)
+	t.chunks = nil
+}
+
+// Close aborts the copy when the body wasn't read to the end (e.g. the client
+// went away) so a truncated object never gets uploaded.
+func (t *teeBody) Close() error {
+	if t.chunks != nil {
+		t.finish(errBodyNotFullyRead)
+	}
+	return t.body.Close()
+}
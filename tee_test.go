@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTeeBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	tests := []struct {
+		name string
+		// stall keeps the uploader from reading until the client is done
+		stall      bool
+		queue      int
+		closeEarly bool
+		wantCopy   bool
+		wantErr    error
+	}{
+		{name: "copied", queue: len(body), wantCopy: true},
+		{name: "uploader falls behind", stall: true, queue: 64 * 1024, wantErr: errUploadTooSlow},
+		{name: "client goes away", closeEarly: true, queue: len(body), wantErr: errBodyNotFullyRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			tee := newTeeBody(io.NopCloser(bytes.NewReader(body)), pw, tt.queue)
+			copied := make(chan []byte)
+			start := make(chan struct{})
+			var copyErr error
+			go func() {
+				if tt.stall {
+					<-start
+				}
+				b, err := io.ReadAll(pr)
+				copyErr = err
+				copied <- b
+			}()
+
+			if tt.closeEarly {
+				io.ReadFull(tee, make([]byte, 1024))
+				tee.Close()
+			} else if got, err := io.ReadAll(tee); err != nil || !bytes.Equal(got, body) {
+				t.Fatalf("client read %d bytes, %v, want the whole body", len(got), err)
+			}
+			close(start)
+			got := <-copied
+			if !errors.Is(copyErr, tt.wantErr) {
+				t.Errorf("copy error = %v, want %v", copyErr, tt.wantErr)
+			}
+			if tt.wantCopy && !bytes.Equal(got, body) {
+				t.Errorf("copied %d bytes, want %d", len(got), len(body))
+			}
+			if tee.dropped.Load() != (tt.wantErr == errUploadTooSlow) {
+				t.Errorf("dropped = %v", tee.dropped.Load())
+			}
+		})
+	}
+}
+
+// A slow bucket must not delay the client: before the tee was queued, the
+// client stalled as soon as the uploader stopped reading to send a part.
+func TestSlowUploadDoesNotDelayClient(t *testing.T) {
+	const size = 12 << 20
+	chunk := bytes.Repeat([]byte{'x'}, 64*1024)
+	e := newTestEnv(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for range size / len(chunk) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+	const delay = 2 * time.Second
+	e.s3.setDelay(delay)
+	proxy := httptest.NewServer(e.srv)
+	defer proxy.Close()
+
+	start := time.Now()
+	resp, err := http.Get(proxy.URL + testImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("reading first byte: %v", err)
+	}
+	firstByte := time.Since(start)
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n+1 != size {
+		t.Fatalf("client read %d bytes, %v, want %d", n+1, err, size)
+	}
+	total := time.Since(start)
+	if firstByte > delay/4 || total > delay/2 {
+		t.Errorf("first byte after %v, whole body after %v, with the bucket answering after %v", firstByte, total, delay)
+	}
+
+	e.srv.uploads.Wait()
+	if got := e.srv.stats.uploadsTooSlow.Load(); got != 1 {
+		t.Errorf("uploads_too_slow = %d, want 1", got)
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 0 {
+		t.Errorf("stored %v, the upload should have been dropped", keys)
+	}
+}
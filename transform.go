@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ResponseTransform rewrites the body of a rendered image on its way to the
+// client. It runs after the upload tee, so the cached object always is the
+// untransformed render.
+type ResponseTransform interface {
+	// Transform returns the body to serve, or body itself to leave it alone
+	Transform(resp *http.Response, body io.ReadCloser) io.ReadCloser
+}
+
+// ResponseTransformFunc adapts a plain function to the ResponseTransform interface
+type ResponseTransformFunc func(resp *http.Response, body io.ReadCloser) io.ReadCloser
+
+func (f ResponseTransformFunc) Transform(resp *http.Response, body io.ReadCloser) io.ReadCloser {
+	return f(resp, body)
+}
+
+// responseTransforms holds the transforms selectable through RESPONSE_TRANSFORM
+var responseTransforms = map[string]ResponseTransform{
+	"strip-exif": ResponseTransformFunc(stripExifTransform),
+}
+
+// RegisterResponseTransform makes a custom transform selectable through
+// RESPONSE_TRANSFORM. Call it from the init function of a file dropped into
+// the package at build time.
+func RegisterResponseTransform(name string, t ResponseTransform) {
+	if _, exists := responseTransforms[name]; exists {
+		panic(fmt.Sprintf("response transform %q already registered", name))
+	}
+	responseTransforms[name] = t
+}
+
+// applyResponseTransform swaps the response body for the transformed one.
+// The transformed length isn't known in advance.
+func applyResponseTransform(t ResponseTransform, resp *http.Response) {
+	body := t.Transform(resp, resp.Body)
+	if body == resp.Body {
+		return
+	}
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
+
+// pipeTransform serves what transform writes while reading body
+func pipeTransform(body io.ReadCloser, transform func(w io.Writer, r io.Reader) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(transform(pw, body))
+	}()
+	return &transformedBody{PipeReader: pr, src: body, done: done}
+}
+
+type transformedBody struct {
+	*io.PipeReader
+	src  io.ReadCloser
+	done chan struct{}
+}
+
+// Close stops the transform and closes the source, which aborts the upload
+// when the source wasn't read to the end. The source is only closed once the
+// transform returned, it would otherwise still be reading it.
+func (b *transformedBody) Close() error {
+	b.PipeReader.Close()
+	<-b.done
+	return b.src.Close()
+}
+
+func stripExifTransform(resp *http.Response, body io.ReadCloser) io.ReadCloser {
+	if normalizeContentType(resp.Header.Get("Content-Type")) != contentTypeJPEG {
+		return body
+	}
+	return pipeTransform(body, stripExif)
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// stripExif copies a JPEG stream without its Exif APP1 segments. Anything
+// that doesn't look like a JPEG is copied untouched.
+func stripExif(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	soi, err := br.Peek(2)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		_, err := io.Copy(w, br)
+		return err
+	}
+	br.Discard(2)
+	if _, err := w.Write([]byte{0xFF, 0xD8}); err != nil {
+		return err
+	}
+
+	for {
+		marker, err := readMarker(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == 0xDA || marker == 0xD9:
+			// Entropy coded data follows the start of scan, copy the rest as is
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, br)
+			return err
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Standalone markers have no length
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return fmt.Errorf("invalid JPEG segment length %d", n)
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			continue
+		}
+		for _, b := range [][]byte{{0xFF, marker}, length[:], payload} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readMarker reads the next segment marker, skipping fill bytes
+func readMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("invalid JPEG marker prefix 0x%02X", b)
+	}
+	for {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			return b, nil
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// jpegWithExif returns a JPEG, and the same JPEG with an Exif APP1 segment
+// after its SOI marker
+func jpegWithExif(t *testing.T) (plain, withExif []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain = buf.Bytes()
+	payload := append([]byte("Exif\x00\x00"), []byte("MM\x00\x2agps=48.85,2.35")...)
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(payload) + 2)}, payload...)
+	withExif = append(append(append([]byte{}, plain[:2]...), segment...), plain[2:]...)
+	return plain, withExif
+}
+
+func TestStripExif(t *testing.T) {
+	plain, withExif := jpegWithExif(t)
+	tests := []struct {
+		name     string
+		in, want []byte
+	}{
+		{name: "exif removed", in: withExif, want: plain},
+		{name: "no exif", in: plain, want: plain},
+		{name: "not a jpeg", in: testPNG, want: testPNG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := stripExif(&out, bytes.NewReader(tt.in)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.want) {
+				t.Errorf("got %d bytes, want %d", out.Len(), len(tt.want))
+			}
+		})
+	}
+	if err := stripExif(&bytes.Buffer{}, bytes.NewReader(withExif[:10])); err == nil {
+		t.Error("a truncated JPEG was copied without an error")
+	}
+}
+
+func TestResponseTransformServesTransformedCachesOriginal(t *testing.T) {
+	plain, withExif := jpegWithExif(t)
+	e := newTestEnv(t, map[string]string{"RESPONSE_TRANSFORM": "strip-exif"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(withExif)))
+		w.Write(withExif)
+	})
+	resp := e.get(testImagePath)
+	body := readAll(t, resp)
+	if !bytes.Equal(body, plain) {
+		t.Errorf("served %d bytes, want the %d bytes without Exif", len(body), len(plain))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(body)); err != nil {
+		t.Errorf("the served JPEG doesn't decode: %v", err)
+	}
+	if got := resp.Header.Get("Content-Length"); got == strconv.Itoa(len(withExif)) {
+		t.Error("the untransformed Content-Length was served")
+	}
+
+	keys := e.s3.keys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("bucket has %v, want one object", keys)
+	}
+	if o, _ := e.s3.object(keys[0]); !bytes.Equal(o.body, withExif) {
+		t.Error("the cached object isn't the untransformed render")
+	}
+}
+
+// endlessBody is a source that never ends, failing reads once it was closed
+type endlessBody struct {
+	closed         bool
+	readAfterClose bool
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.closed {
+		b.readAfterClose = true
+		return 0, io.ErrClosedPipe
+	}
+	clear(p)
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+// TestTransformedBodyClientAbort closes the body half way, as the reverse
+// proxy does when the client goes away. Run with -race, the source must not
+// be read while or after being closed.
+func TestTransformedBodyClientAbort(t *testing.T) {
+	src := &endlessBody{}
+	body := pipeTransform(src, stripExif)
+	if _, err := io.ReadFull(body, make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !src.closed {
+		t.Error("the source wasn't closed")
+	}
+	if src.readAfterClose {
+		t.Error("the source was read after being closed")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// loadCertPool returns the system cert pool extended with the PEM
+// certificates found in caFile
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// s3HTTPClient builds the HTTP client used by the SDK, honoring the custom
+// CA bundle, TLS verification and proxy settings
+func s3HTTPClient(cfg Config) (*awshttp.BuildableClient, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.S3CABundle != "" {
+		pool, err := loadCertPool(cfg.S3CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.S3InsecureSkipVerify {
+		slog.Warn("TLS verification of the S3 endpoint is disabled, never do this in production")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	var proxyURL *url.URL
+	if cfg.S3HTTPProxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(cfg.S3HTTPProxy); err != nil {
+			return nil, fmt.Errorf("invalid S3_HTTP_PROXY: %w", err)
+		}
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+		if proxyURL != nil {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+	}), nil
+}
+
+// upstreamTransport returns the transport used to reach imgproxy. It dials
+// IMGPROXY_UNIX_SOCKET whatever the request's host when set, and verifies
+// https upstreams against the system pool plus UPSTREAM_CA_BUNDLE.
+func upstreamTransport(cfg Config) (http.RoundTripper, error) {
+	if cfg.ImgproxyUnixSocket == "" && cfg.UpstreamCABundle == "" && !cfg.UpstreamInsecureSkipVerify {
+		return http.DefaultTransport, nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ImgproxyUnixSocket != "" {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", cfg.ImgproxyUnixSocket)
+		}
+	}
+
+	tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.UpstreamCABundle != "" {
+		pool, err := loadCertPool(cfg.UpstreamCABundle)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if cfg.UpstreamInsecureSkipVerify {
+		slog.Warn("TLS verification of imgproxy is disabled, never do this in production")
+		tr.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return tr, nil
+}
+
+// queryFilterTransport forwards only the allowed query parameters to
+// imgproxy. The response keeps pointing at the unfiltered request, so keys
+// are still derived from the query the client sent.
+type queryFilterTransport struct {
+	next    http.RoundTripper
+	allowed []string
+}
+
+func (t *queryFilterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.RawQuery == "" {
+		return t.next.RoundTrip(req)
+	}
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = allowedQuery(req.URL.RawQuery, t.allowed)
+	resp, err := t.next.RoundTrip(out)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// allowedQuery keeps the allowed parameters of a raw query, in their order
+func allowedQuery(rawQuery string, allowed []string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err == nil && slices.Contains(allowed, name) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// redirectTransport follows imgproxy's redirects itself, so the final image
+// is served and cached under the key of the original request. Hops leaving
+// imgproxy's host go through the default transport, without credentials.
+type redirectTransport struct {
+	next         http.RoundTripper
+	maxRedirects int
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	for hops := 0; err == nil && isRedirect(resp.StatusCode); hops++ {
+		location, locErr := resp.Location()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBodySize))
+		resp.Body.Close()
+		if locErr != nil {
+			return nil, fmt.Errorf("imgproxy redirect without a valid Location: %w", locErr)
+		}
+		if hops == t.maxRedirects {
+			return nil, fmt.Errorf("imgproxy redirected more than %d times", t.maxRedirects)
+		}
+		resp, err = t.hop(req, location)
+	}
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+func (t *redirectTransport) hop(req *http.Request, location *url.URL) (*http.Response, error) {
+	method := http.MethodGet
+	if req.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	hop, err := http.NewRequestWithContext(req.Context(), method, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	hop.Header = req.Header.Clone()
+	next := t.next
+	if location.Host != req.URL.Host {
+		hop.Header.Del("Authorization")
+		hop.Header.Del("Cookie")
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(hop)
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
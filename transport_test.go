@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestImgproxyUnixSocket(t *testing.T) {
+	// Socket paths are limited to about a hundred bytes, t.TempDir may be longer
+	dir, err := os.MkdirTemp("", "imgproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "imgproxy.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host is never resolved, every connection goes to the socket
+	e := newTestEnv(t, map[string]string{
+		"UPSTREAM_URL":         "http://imgproxy.invalid",
+		"IMGPROXY_UNIX_SOCKET": socket,
+	}, nil)
+	unix := &httptest.Server{Listener: ln, Config: &http.Server{Handler: e.img.Config.Handler}}
+	unix.Start()
+	t.Cleanup(unix.Close)
+
+	transport, err := upstreamTransport(*e.srv.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForHealth(e.srv.config().UpstreamURL, transport, *e.srv.config()); err != nil {
+		t.Errorf("waitForHealth: %v", err)
+	}
+	if resp := e.get(testImagePath); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if n := len(e.img.renders()); n != 1 {
+		t.Errorf("imgproxy rendered %d requests over the socket, want 1", n)
+	}
+	if keys := e.s3.keys(testBucket); len(keys) != 1 {
+		t.Errorf("bucket has %v, want the render cached", keys)
+	}
+}
+
+func TestUpstreamTransportTCP(t *testing.T) {
+	transport, err := upstreamTransport(testConfig(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport != http.DefaultTransport {
+		t.Errorf("got %T, want the default transport without IMGPROXY_UNIX_SOCKET", transport)
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	img := newFakeImgproxy(t, nil)
+	tlsSrv := httptest.NewTLSServer(img.Config.Handler)
+	t.Cleanup(tlsSrv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "unknown CA", env: map[string]string{}, ok: false},
+		{name: "custom CA", env: map[string]string{"UPSTREAM_CA_BUNDLE": ca}, ok: true},
+		{name: "skip verify", env: map[string]string{"UPSTREAM_INSECURE_SKIP_VERIFY": "true"}, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{
+				"UPSTREAM_URL":                  tlsSrv.URL,
+				"HEALTH_CHECK_TIMEOUT_IN_SEC":   "1",
+				"HEALTH_CHECK_INTERVAL":         "50ms",
+				"UPSTREAM_CA_BUNDLE":            "",
+				"UPSTREAM_INSECURE_SKIP_VERIFY": "false",
+			}, tt.env), nil)
+			cfg := *e.srv.config()
+			transport, err := upstreamTransport(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := waitForHealth(cfg.UpstreamURL, transport, cfg); (err == nil) != tt.ok {
+				t.Errorf("waitForHealth: %v, want ok = %v", err, tt.ok)
+			}
+			want := http.StatusBadGateway
+			if tt.ok {
+				want = http.StatusOK
+			}
+			if resp := e.get(testImagePath); resp.StatusCode != want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, want)
+			}
+		})
+	}
+	if n := len(img.renders()); n != 2 {
+		t.Errorf("imgproxy rendered %d requests over TLS, want 2", n)
+	}
+}
+
+func TestAllowedQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		allowed []string
+		want    string
+	}{
+		{query: "w=100&nocache=1", allowed: []string{"w"}, want: "w=100"},
+		{query: "nocache=1&h=2&w=1", allowed: []string{"w", "h"}, want: "h=2&w=1"},
+		{query: "nocache=1", allowed: []string{"w"}, want: ""},
+		{query: "%77=1&w%3D=2", allowed: []string{"w"}, want: "%77=1"},
+		{query: "w&w=2", allowed: []string{"w"}, want: "w&w=2"},
+	}
+	for _, tt := range tests {
+		if got := allowedQuery(tt.query, tt.allowed); got != tt.want {
+			t.Errorf("allowedQuery(%q, %v) = %q, want %q", tt.query, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamQueryAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		query     string
+		forwarded string
+	}{
+		{name: "internal params stripped", allowed: "w,h", query: "w=100&nocache=1", forwarded: "w=100"},
+		{name: "nothing allowed sent", allowed: "w", query: "nocache=1", forwarded: ""},
+		{name: "everything forwarded by default", query: "w=100&nocache=1", forwarded: "w=100&nocache=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"UPSTREAM_QUERY_ALLOWED": tt.allowed, "KEY_GENERATOR": "hash-path+query"}, nil)
+			e.get(testImagePath + "?" + tt.query)
+			e.get(testImagePath + "?" + tt.forwarded)
+			renders := e.img.renders()
+			if len(renders) != 2 || renders[0].URL.RawQuery != tt.forwarded {
+				t.Fatalf("imgproxy received %v, want the query %q", renders, tt.forwarded)
+			}
+			// The key is still derived from the query the client sent
+			want := 2
+			if tt.query == tt.forwarded {
+				want = 1
+			}
+			if keys := e.s3.keys(testBucket); len(keys) != want {
+				t.Errorf("bucket has %v, want %d objects", keys, want)
+			}
+		})
+	}
+}
+
+func TestUpstreamRedirects(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		hops    int
+		status  int
+		renders int
+		cached  bool
+	}{
+		{name: "passed through by default", hops: 2, status: http.StatusFound, renders: 1},
+		{name: "followed", env: map[string]string{"FOLLOW_UPSTREAM_REDIRECTS": "true"}, hops: 2, status: http.StatusOK, renders: 3, cached: true},
+		{name: "at the limit", env: map[string]string{"FOLLOW_UPSTREAM_REDIRECTS": "true", "UPSTREAM_MAX_REDIRECTS": "2"}, hops: 2, status: http.StatusOK, renders: 3, cached: true},
+		{name: "over the limit", env: map[string]string{"FOLLOW_UPSTREAM_REDIRECTS": "true", "UPSTREAM_MAX_REDIRECTS": "1"}, hops: 2, status: http.StatusBadGateway, renders: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hops := 0
+			e := newTestEnv(t, tt.env, func(w http.ResponseWriter, r *http.Request) {
+				if hops < tt.hops {
+					hops++
+					http.Redirect(w, r, "/hop/"+strconv.Itoa(hops), http.StatusFound)
+					return
+				}
+				servePNG(w, r)
+			})
+			resp := e.get(testImagePath)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if n := len(e.img.renders()); n != tt.renders {
+				t.Errorf("imgproxy received %d requests, want %d", n, tt.renders)
+			}
+			keys := e.s3.keys(testBucket)
+			if cached := len(keys) == 1; cached != tt.cached {
+				t.Fatalf("cached = %v, bucket has %v", cached, keys)
+			}
+			// The final image is stored under the key of the original request
+			if tt.cached {
+				want := objectKey(*e.srv.config(), httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+				if keys[0] != want {
+					t.Errorf("key = %q, want %q", keys[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestS3HTTPClient(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	fake := newFakeS3(t)
+	tlsSrv := httptest.NewTLSServer(fake.Config.Handler)
+	t.Cleanup(tlsSrv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proxied := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		ok      bool
+		proxied bool
+	}{
+		{name: "unknown CA", env: map[string]string{"S3_ENDPOINT": tlsSrv.URL}},
+		{name: "custom CA", env: map[string]string{"S3_ENDPOINT": tlsSrv.URL, "S3_CA_BUNDLE": ca}, ok: true},
+		{name: "skip verify", env: map[string]string{"S3_ENDPOINT": tlsSrv.URL, "S3_INSECURE_SKIP_VERIFY": "true"}, ok: true},
+		{name: "proxy", env: map[string]string{"S3_ENDPOINT": fake.URL, "S3_HTTP_PROXY": proxy.URL}, ok: true, proxied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied = 0
+			cfg := testConfig(t, mergeEnv(map[string]string{"S3_RETRY_MAX_ATTEMPTS": "1"}, tt.env))
+			_, err := initS3Client(cfg).HeadBucket(t.Context(), &s3.HeadBucketInput{Bucket: aws.String(testBucket)})
+			if (err == nil) != tt.ok {
+				t.Errorf("HeadBucket: %v, want ok = %v", err, tt.ok)
+			}
+			if (proxied > 0) != tt.proxied {
+				t.Errorf("%d requests went through the proxy", proxied)
+			}
+		})
+	}
+}
+
+func TestS3HTTPClientInvalid(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "missing CA bundle", env: map[string]string{"S3_CA_BUNDLE": filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "CA bundle without certificates", env: map[string]string{"S3_CA_BUNDLE": empty}},
+		{name: "invalid proxy", env: map[string]string{"S3_HTTP_PROXY": "http://[::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s3HTTPClient(testConfig(t, tt.env)); err == nil {
+				t.Error("s3HTTPClient succeeded")
+			}
+		})
+	}
+}
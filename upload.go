@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxMultipartObjectSize is the largest object a multipart upload can send
+// with our part size, S3 and Tigris taking at most 10000 parts
+const maxMultipartObjectSize = int(manager.MaxUploadParts) * uploadPartSize
+
+var (
+	errTooSmall       = errors.New("response body is below MIN_CACHE_OBJECT_SIZE")
+	errTooLarge       = errors.New("response body is above TIGRIS_MAX_OBJECT_SIZE")
+	errLengthMismatch = errors.New("response body length doesn't match Content-Length")
+)
+
+// objectMeta holds what must be stored with an object so it is served the
+// same way imgproxy served it
+type objectMeta struct {
+	StatusCode      int
+	ContentType     string
+	ContentEncoding string
+	CacheControl    string
+	// KeySource is the keySource digest, empty when VERIFY_KEY_SOURCE is off
+	KeySource string
+	// UpstreamETag is imgproxy's ETag, empty when STORE_UPSTREAM_ETAG is off
+	UpstreamETag string
+	// Provenance tells which imgproxy build and proxy host rendered the
+	// object, nil when PROVENANCE_METADATA is off
+	Provenance *provenance
+	// HeadContentLength is the Content-Length of a HEAD response, whose
+	// object holds no body, -1 otherwise
+	HeadContentLength int64
+}
+
+// provenance is stored in the user metadata of every object and reported by
+// the admin lookup
+type provenance struct {
+	ImgproxyVersion string `json:"imgproxy_version,omitempty"`
+	RenderHost      string `json:"render_host,omitempty"`
+	Schema          string `json:"schema"`
+}
+
+const (
+	// statusMetadataKey holds the upstream status code in the object's user metadata
+	statusMetadataKey = "status"
+	// headContentLengthMetadataKey holds the Content-Length a HEAD response
+	// announced, the object standing for it being empty
+	headContentLengthMetadataKey = "head-content-length"
+	// keySourceMetadataKey holds the digest of what the key was derived from
+	keySourceMetadataKey = "key-source"
+	// upstreamETagMetadataKey holds imgproxy's ETag, weak ones keeping their
+	// W/ prefix. The object's own ETag is computed by the bucket.
+	upstreamETagMetadataKey = "upstream-etag"
+
+	imgproxyVersionMetadataKey = "imgproxy-version"
+	renderHostMetadataKey      = "render-host"
+	// metaSchemaMetadataKey versions the layout of our user metadata
+	metaSchemaMetadataKey = "meta-schema"
+	metaSchemaVersion     = "1"
+)
+
+func (p *provenance) store(metadata map[string]string) {
+	if p.ImgproxyVersion != "" {
+		metadata[imgproxyVersionMetadataKey] = p.ImgproxyVersion
+	}
+	if p.RenderHost != "" {
+		metadata[renderHostMetadataKey] = p.RenderHost
+	}
+	metadata[metaSchemaMetadataKey] = p.Schema
+}
+
+// storedProvenance reads back the provenance of an object, nil for objects
+// stored without it
+func storedProvenance(metadata map[string]string) *provenance {
+	schema, ok := metadata[metaSchemaMetadataKey]
+	if !ok {
+		return nil
+	}
+	return &provenance{
+		ImgproxyVersion: metadata[imgproxyVersionMetadataKey],
+		RenderHost:      metadata[renderHostMetadataKey],
+		Schema:          schema,
+	}
+}
+
+func newObjectMeta(resp *http.Response) objectMeta {
+	return objectMeta{
+		StatusCode:        resp.StatusCode,
+		ContentType:       resp.Header.Get("Content-Type"),
+		ContentEncoding:   resp.Header.Get("Content-Encoding"),
+		CacheControl:      resp.Header.Get("Cache-Control"),
+		HeadContentLength: -1,
+	}
+}
+
+// uploadToS3 uploads the body read from r, whose size is -1 when unknown.
+// Bodies known to be small are sent with a single PutObject from an exactly
+// sized buffer, larger or unknown ones go through the multipart uploader, or
+// are sent part by part when RESUMABLE_UPLOADS is set.
+func (s *server) uploadToS3(ctx context.Context, r io.Reader, size int64, path, key string, meta objectMeta) error {
+	cfg := s.config()
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(cfg.S3Bucket),
+		Key:    aws.String(key),
+		Body:   r,
+		ACL:    cfg.S3ObjectACL,
+		Metadata: map[string]string{
+			statusMetadataKey: strconv.Itoa(meta.StatusCode),
+		},
+	}
+	if meta.KeySource != "" {
+		input.Metadata[keySourceMetadataKey] = meta.KeySource
+	}
+	if meta.UpstreamETag != "" {
+		input.Metadata[upstreamETagMetadataKey] = meta.UpstreamETag
+	}
+	if meta.Provenance != nil {
+		meta.Provenance.store(input.Metadata)
+	}
+	if meta.ContentType != "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+	if meta.CacheControl != "" {
+		input.CacheControl = aws.String(meta.CacheControl)
+	}
+	// The stored bytes are the raw (possibly compressed) upstream bytes, so the
+	// encoding must be replayed alongside them when the object is served
+	if meta.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(meta.ContentEncoding)
+	}
+	if meta.HeadContentLength >= 0 {
+		input.Metadata[headContentLengthMetadataKey] = strconv.FormatInt(meta.HeadContentLength, 10)
+	}
+
+	var err error
+	switch {
+	case singlePut(cfg, size):
+		err = s.putObject(ctx, input, size)
+	case cfg.ResumableUploads:
+		err = s.resumableUpload(ctx, input)
+	default:
+		_, err = s.uploader.Upload(ctx, input)
+	}
+
+	if err != nil {
+		slog.Error("Upload failed", "path", path, "key", key, "error", err)
+		return err
+	}
+
+	slog.Info("Uploaded to S3", "path", path, "bucket", cfg.S3Bucket, "key", key)
+	s.mirrorObject(key)
+	return nil
+}
+
+func singlePut(cfg *Config, size int64) bool {
+	return size >= 0 && size <= cfg.SinglePutMaxSize
+}
+
+func (s *server) putObject(ctx context.Context, input *s3.PutObjectInput, size int64) error {
+	body := make([]byte, size)
+	if _, err := io.ReadFull(input.Body, body); err != nil {
+		return fmt.Errorf("read upload data failed: %w", err)
+	}
+	input.Body = bytes.NewReader(body)
+	input.ContentLength = aws.Int64(size)
+	_, err := s.s3.PutObject(ctx, input)
+	return err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sizeLimitReader fails the read that goes over max, so bodies of unknown
+// length that turn out too large are aborted as soon as they are
+type sizeLimitReader struct {
+	r        io.Reader
+	max, n   int64
+	exceeded bool
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		l.exceeded = true
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// lengthCheckReader fails the read that overruns want, or ends short of it,
+// so the upload is aborted instead of storing a truncated object
+type lengthCheckReader struct {
+	r        io.Reader
+	want, n  int64
+	mismatch bool
+}
+
+func (l *lengthCheckReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.want || (err == io.EOF && l.n < l.want) {
+		l.mismatch = true
+		return n, errLengthMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCompressedResponseRoundTrip(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(testPNG)
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "identity", body: testPNG},
+		{name: "gzip", encoding: "gzip", body: compressed.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				w.Write(tt.body)
+			})
+			req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp := e.do(req)
+			if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("client Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if !bytes.Equal(readAll(t, resp), tt.body) {
+				t.Error("the client didn't receive the bytes imgproxy sent")
+			}
+
+			// What the bucket serves on a hit
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("bucket has %v, want one object", keys)
+			}
+			out, err := e.s3.client().GetObject(t.Context(), &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String(keys[0])})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Body.Close()
+			if got := aws.ToString(out.ContentEncoding); got != tt.encoding {
+				t.Errorf("stored Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			stored, _ := io.ReadAll(out.Body)
+			if !bytes.Equal(stored, tt.body) {
+				t.Error("the stored body isn't the raw upstream body")
+			}
+
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.ContentEncoding != tt.encoding {
+				t.Errorf("admin content_encoding = %q, want %q", status.ContentEncoding, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestStoredStatusReplayed(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		want   int
+	}{
+		{name: "legacy object", want: http.StatusOK},
+		{name: "203", stored: "203", want: http.StatusNonAuthoritativeInfo},
+		{name: "404", stored: "404", want: http.StatusNotFound},
+		{name: "unparsable", stored: "gone", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret"}, nil)
+			key := objectKey(*e.srv.config(), httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+			header := http.Header{"Content-Type": {"image/png"}}
+			if tt.stored != "" {
+				header.Set("X-Amz-Meta-Status", tt.stored)
+			}
+			e.s3.put(key, testPNG, header)
+
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists || status.Status != tt.want {
+				t.Errorf("exists = %v, status = %d, want %d", status.Exists, status.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadStoresStatus(t *testing.T) {
+	e := newTestEnv(t, nil, nil)
+	e.get(testImagePath)
+	key := objectKey(*e.srv.config(), httptest.NewRequest(http.MethodGet, testImagePath, nil), contentTypePNG)
+	o, ok := e.s3.object(key)
+	if !ok {
+		t.Fatalf("%q wasn't uploaded", key)
+	}
+	if got := o.header.Get("X-Amz-Meta-Status"); got != "200" {
+		t.Errorf("status metadata = %q, want 200", got)
+	}
+}
+
+func TestSinglePutThreshold(t *testing.T) {
+	const size = 6 << 20
+	body := append(slices.Clone(testPNG), make([]byte, size-len(testPNG))...)
+	tests := []struct {
+		name         string
+		singlePutMax string
+		chunked      bool
+		multipart    bool
+	}{
+		{name: "below the threshold", singlePutMax: strconv.Itoa(8 << 20), multipart: false},
+		{name: "above the threshold", singlePutMax: strconv.Itoa(5 << 20), multipart: true},
+		{name: "disabled", singlePutMax: "0", multipart: true},
+		// Without a Content-Length the size can't be peeked
+		{name: "unknown length", singlePutMax: strconv.Itoa(8 << 20), chunked: true, multipart: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The tee buffer holds the whole body, the upload mustn't be
+			// dropped for not keeping up with the client
+			env := map[string]string{"SINGLE_PUT_MAX_SIZE": tt.singlePutMax, "UPLOAD_TEE_BUFFER_SIZE": strconv.Itoa(2 * size)}
+			e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				w.Write(body)
+			})
+			if resp := e.get(testImagePath); resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("bucket has %v, want one object", keys)
+			}
+			if o, _ := e.s3.object(keys[0]); !bytes.Equal(o.body, body) {
+				t.Errorf("stored %d bytes, want %d", len(o.body), len(body))
+			}
+			if multipart := e.s3.calls(http.MethodPost) > 0; multipart != tt.multipart {
+				t.Errorf("multipart = %v, want %v", multipart, tt.multipart)
+			}
+		})
+	}
+}
+
+func TestMinCacheObjectSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		min      int
+		chunked  bool
+		uploaded bool
+	}{
+		{name: "below", min: len(testPNG) + 1},
+		{name: "at", min: len(testPNG), uploaded: true},
+		{name: "disabled", min: 0, uploaded: true},
+		// Bodies of unknown length are only measured as they stream
+		{name: "below, unknown length", min: len(testPNG) + 1, chunked: true},
+		{name: "at, unknown length", min: len(testPNG), chunked: true, uploaded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"MIN_CACHE_OBJECT_SIZE": strconv.Itoa(tt.min)}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(testPNG)))
+				}
+				w.Write(testPNG)
+			})
+			resp := e.get(testImagePath)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(readAll(t, resp), testPNG) {
+				t.Errorf("status = %d, the image wasn't served", resp.StatusCode)
+			}
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+			wantSkipped := int64(0)
+			if !tt.uploaded {
+				wantSkipped = 1
+			}
+			if got := e.srv.stats.uploadsTooSmall.Load(); got != wantSkipped {
+				t.Errorf("uploads_too_small = %d, want %d", got, wantSkipped)
+			}
+		})
+	}
+}
+
+func TestProvenanceMetadata(t *testing.T) {
+	host, _ := os.Hostname()
+	tests := []struct {
+		name    string
+		env     map[string]string
+		version string
+		want    *provenance
+	}{
+		{name: "disabled", env: map[string]string{"PROVENANCE_METADATA": "false"}},
+		{name: "host and schema", env: map[string]string{"PROVENANCE_METADATA": "true"}, want: &provenance{RenderHost: host, Schema: metaSchemaVersion}},
+		{
+			name:    "imgproxy version",
+			env:     map[string]string{"PROVENANCE_METADATA": "true", "UPSTREAM_VERSION_HEADER": "X-Imgproxy-Version"},
+			version: "v3.24.1",
+			want:    &provenance{ImgproxyVersion: "v3.24.1", RenderHost: host, Schema: metaSchemaVersion},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, mergeEnv(map[string]string{"ADMIN_TOKEN": "secret"}, tt.env), func(w http.ResponseWriter, r *http.Request) {
+				if tt.version != "" {
+					w.Header().Set("X-Imgproxy-Version", tt.version)
+				}
+				servePNG(w, r)
+			})
+			e.get(testImagePath)
+
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists {
+				t.Fatal("nothing was uploaded")
+			}
+			if (status.Provenance == nil) != (tt.want == nil) || tt.want != nil && *status.Provenance != *tt.want {
+				t.Errorf("provenance = %+v, want %+v", status.Provenance, tt.want)
+			}
+		})
+	}
+}
+
+func TestLengthCheckReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		want     int64
+		mismatch bool
+	}{
+		{name: "matching", body: "abcdef", want: 6},
+		{name: "short", body: "abc", want: 6, mismatch: true},
+		{name: "long", body: "abcdefgh", want: 6, mismatch: true},
+		{name: "empty", body: "", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lengthCheckReader{r: strings.NewReader(tt.body), want: tt.want}
+			_, err := io.Copy(io.Discard, l)
+			if l.mismatch != tt.mismatch || (err != nil) != tt.mismatch {
+				t.Errorf("mismatch = %v, err = %v, want mismatch %v", l.mismatch, err, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestVerifyContentLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		verify   bool
+		declared int
+		uploaded bool
+	}{
+		{name: "matching", verify: true, declared: len(testPNG), uploaded: true},
+		{name: "truncated", verify: true, declared: len(testPNG) + 10},
+		// A short body is an upstream error even without the check
+		{name: "truncated, unverified", declared: len(testPNG) + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"VERIFY_CONTENT_LENGTH": strconv.FormatBool(tt.verify)}, func(w http.ResponseWriter, r *http.Request) {
+				// Hijacked so the declared length can lie about the body
+				conn, buf, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: %d\r\n\r\n", tt.declared)
+				buf.Write(testPNG)
+				buf.Flush()
+			})
+			e.get(testImagePath)
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+		})
+	}
+}
+
+func TestStoreUpstreamETag(t *testing.T) {
+	tests := []struct {
+		name  string
+		store bool
+		etag  string
+		want  string
+	}{
+		{name: "strong", store: true, etag: `"abc"`, want: `"abc"`},
+		{name: "weak keeps its prefix", store: true, etag: `W/"abc"`, want: `W/"abc"`},
+		{name: "none sent", store: true},
+		{name: "disabled", etag: `"abc"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"ADMIN_TOKEN": "secret", "STORE_UPSTREAM_ETAG": strconv.FormatBool(tt.store)}, func(w http.ResponseWriter, r *http.Request) {
+				if tt.etag != "" {
+					w.Header().Set("ETag", tt.etag)
+				}
+				servePNG(w, r)
+			})
+			e.get(testImagePath)
+
+			var status cacheStatus
+			if err := json.NewDecoder(e.admin(http.MethodGet, "/admin/cache?path="+testImagePath).Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.Exists {
+				t.Fatal("nothing was uploaded")
+			}
+			if status.UpstreamETag != tt.want {
+				t.Errorf("upstream_etag = %q, want %q", status.UpstreamETag, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamNotModifiedPassedThrough(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{ifNoneMatch: `"abc"`, status: http.StatusNotModified},
+		{ifNoneMatch: `W/"abc"`, status: http.StatusNotModified},
+		{ifNoneMatch: `"other"`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ifNoneMatch, func(t *testing.T) {
+			// imgproxy evaluates If-None-Match itself, weakly as the spec wants
+			e := newTestEnv(t, map[string]string{"STORE_UPSTREAM_ETAG": "true"}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `W/"abc"`)
+				if strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/") == `"abc"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				servePNG(w, r)
+			})
+			req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			resp := e.do(req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if cached := len(e.s3.keys(testBucket)) == 1; cached != (tt.status == http.StatusOK) {
+				t.Errorf("cached = %v after a %d", cached, tt.status)
+			}
+		})
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		chunked  bool
+		uploaded bool
+	}{
+		{name: "below", max: len(testPNG) + 1, uploaded: true},
+		{name: "at", max: len(testPNG), uploaded: true},
+		{name: "above", max: len(testPNG) - 1},
+		// Bodies of unknown length are aborted once they go over
+		{name: "at, unknown length", max: len(testPNG), chunked: true, uploaded: true},
+		{name: "above, unknown length", max: len(testPNG) - 1, chunked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"TIGRIS_MAX_OBJECT_SIZE": strconv.Itoa(tt.max)}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(testPNG)))
+				}
+				w.Write(testPNG)
+			})
+			resp := e.get(testImagePath)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(readAll(t, resp), testPNG) {
+				t.Errorf("status = %d, the image wasn't served", resp.StatusCode)
+			}
+			if uploaded := len(e.s3.keys(testBucket)) == 1; uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+			wantSkipped := int64(0)
+			if !tt.uploaded {
+				wantSkipped = 1
+			}
+			if got := e.srv.stats.uploadsTooLarge.Load(); got != wantSkipped {
+				t.Errorf("uploads_too_large = %d, want %d", got, wantSkipped)
+			}
+		})
+	}
+}
+
+func TestObjectACL(t *testing.T) {
+	large := append(slices.Clone(testPNG), make([]byte, 6<<20)...)
+	tests := []struct {
+		name      string
+		acl       string
+		multipart bool
+		want      string
+	}{
+		{name: "bucket default", want: ""},
+		{name: "canned", acl: "public-read", want: "public-read"},
+		{name: "multipart", acl: "public-read", multipart: true, want: "public-read"},
+		{name: "unknown ignored", acl: "world-writable", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := testPNG
+			if tt.multipart {
+				body = large
+			}
+			env := map[string]string{"S3_OBJECT_ACL": tt.acl, "SINGLE_PUT_MAX_SIZE": "0", "UPLOAD_TEE_BUFFER_SIZE": strconv.Itoa(2 * len(large))}
+			e := newTestEnv(t, env, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(body)
+			})
+			e.get(testImagePath)
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("bucket has %v, want one object", keys)
+			}
+			if multipart := e.s3.calls(http.MethodPost) > 0; multipart != tt.multipart {
+				t.Errorf("multipart = %v, want %v", multipart, tt.multipart)
+			}
+			if o, _ := e.s3.object(keys[0]); o.header.Get("X-Amz-Acl") != tt.want {
+				t.Errorf("ACL = %q, want %q", o.header.Get("X-Amz-Acl"), tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadACL(t *testing.T) {
+	large := make([]byte, 6<<20)
+	tests := []struct {
+		name      string
+		acl       string
+		multipart bool
+		want      string
+	}{
+		{name: "bucket default", want: ""},
+		{name: "canned", acl: "public-read", want: "public-read"},
+		{name: "multipart", acl: "public-read", multipart: true, want: "public-read"},
+		{name: "unknown ignored", acl: "world-writable", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			cfg := testConfig(t, map[string]string{"S3_OBJECT_ACL": tt.acl})
+			body := testPNG
+			if tt.multipart {
+				body = large
+			}
+			key := objectKey(cfg, httptest.NewRequest(http.MethodGet, "/insecure/img", nil), contentTypePNG)
+			s := &server{s3: fake.client(), uploader: manager.NewUploader(fake.client())}
+			s.cfg.Store(&cfg)
+			if err := s.uploadToS3(context.Background(), bytes.NewReader(body), -1, "/insecure/img", key, objectMeta{}); err != nil {
+				t.Fatalf("uploadToS3: %v", err)
+			}
+			o, ok := fake.object(key)
+			if !ok {
+				t.Fatalf("nothing stored, bucket has %v", fake.keys(testBucket))
+			}
+			if multipart := fake.calls(http.MethodPost) > 0; multipart != tt.multipart {
+				t.Errorf("multipart = %v, want %v", multipart, tt.multipart)
+			}
+			if got := o.header.Get("X-Amz-Acl"); got != tt.want {
+				t.Errorf("ACL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadContentEncoding(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, nil)
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}}}
+	key := objectKey(cfg, httptest.NewRequest(http.MethodGet, "/insecure/img", nil), contentTypePNG)
+	s := &server{s3: fake.client(), uploader: manager.NewUploader(fake.client())}
+	s.cfg.Store(&cfg)
+	if err := s.uploadToS3(context.Background(), bytes.NewReader([]byte("gzipped")), -1, "/insecure/img", key, newObjectMeta(resp)); err != nil {
+		t.Fatalf("uploadToS3: %v", err)
+	}
+	o, ok := fake.object(key)
+	if !ok {
+		t.Fatalf("nothing stored, bucket has %v", fake.keys(testBucket))
+	}
+	if got := o.header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("stored Content-Encoding = %q, want gzip", got)
+	}
+
+	rec := httptest.NewRecorder()
+	adminCacheHandler(func() *Config { return &cfg }, fake.client(), nil)(rec, httptest.NewRequest(http.MethodGet, "/admin/cache?path=/insecure/img", nil))
+	var status cacheStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if status.ContentEncoding != "gzip" {
+		t.Errorf("content_encoding = %q, want gzip", status.ContentEncoding)
+	}
+}
+
+func TestUploadStatusMetadata(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	key := objectKey(cfg, httptest.NewRequest(http.MethodGet, "/insecure/img", nil), contentTypePNG)
+	s := &server{s3: fake.client(), uploader: manager.NewUploader(fake.client())}
+	s.cfg.Store(&cfg)
+	if err := s.uploadToS3(context.Background(), bytes.NewReader(testPNG), -1, "/insecure/img", key, newObjectMeta(resp)); err != nil {
+		t.Fatalf("uploadToS3: %v", err)
+	}
+	o, ok := fake.object(key)
+	if !ok {
+		t.Fatalf("nothing stored, bucket has %v", fake.keys(testBucket))
+	}
+	if got := o.header.Get("X-Amz-Meta-" + statusMetadataKey); got != "200" {
+		t.Errorf("stored status = %q, want 200", got)
+	}
+
+	// Objects stored before the status was recorded were 200 responses
+	for _, path := range []string{"/insecure/img", "/insecure/legacy"} {
+		lookup := objectKey(cfg, httptest.NewRequest(http.MethodGet, path, nil), contentTypePNG)
+		if path == "/insecure/legacy" {
+			fake.put(lookup, testPNG, http.Header{})
+		}
+		rec := httptest.NewRecorder()
+		adminCacheHandler(func() *Config { return &cfg }, fake.client(), nil)(rec, httptest.NewRequest(http.MethodGet, "/admin/cache?path="+path, nil))
+		var status cacheStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatalf("%s: decoding response: %v", path, err)
+		}
+		if status.Status != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", path, status.Status)
+		}
+	}
+}
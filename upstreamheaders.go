@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultUpstreamMetricHeaders are the numeric headers imgproxy sends with
+// IMGPROXY_ENABLE_DEBUG_HEADERS and IMGPROXY_SERVER_TIMING
+var defaultUpstreamMetricHeaders = []string{
+	"Server-Timing",
+	"X-Origin-Content-Length",
+	"X-Origin-Width",
+	"X-Origin-Height",
+	"X-Result-Width",
+	"X-Result-Height",
+}
+
+// upstreamHeaderStats aggregates numeric imgproxy response headers
+type upstreamHeaderStats struct {
+	names []string
+
+	mu    sync.Mutex
+	stats map[string]*headerStat
+}
+
+type headerStat struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Max   float64 `json:"max"`
+}
+
+func newUpstreamHeaderStats(names []string) *upstreamHeaderStats {
+	s := &upstreamHeaderStats{names: names, stats: make(map[string]*headerStat, len(names))}
+	for _, name := range names {
+		s.stats[name] = &headerStat{}
+	}
+	return s
+}
+
+// record adds the values found in h, optionally removing the headers so
+// they don't reach the client
+func (s *upstreamHeaderStats) record(h http.Header, strip bool) {
+	for _, name := range s.names {
+		v := h.Get(name)
+		if v == "" {
+			continue
+		}
+		if strip {
+			h.Del(name)
+		}
+		n, ok := headerNumber(name, v)
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		st := s.stats[name]
+		st.Count++
+		st.Sum += n
+		st.Max = max(st.Max, n)
+		s.mu.Unlock()
+	}
+}
+
+// headerNumber parses a numeric header. Server-Timing counts as the total of
+// its dur parameters, in milliseconds.
+func headerNumber(name, v string) (float64, bool) {
+	if name != "Server-Timing" {
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	var total float64
+	found := false
+	for _, metric := range strings.Split(v, ",") {
+		for _, param := range strings.Split(metric, ";") {
+			if d, ok := strings.CutPrefix(strings.TrimSpace(param), "dur="); ok {
+				if n, err := strconv.ParseFloat(d, 64); err == nil {
+					total += n
+					found = true
+				}
+			}
+		}
+	}
+	return total, found
+}
+
+// snapshot returns the aggregates, zeroing them when reset is set
+func (s *upstreamHeaderStats) snapshot(reset bool) map[string]headerStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]headerStat, len(s.stats))
+	for name, st := range s.stats {
+		out[name] = *st
+		if reset {
+			*st = headerStat{}
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderNumber(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        float64
+		ok          bool
+	}{
+		{name: "X-Origin-Width", value: " 640 ", want: 640, ok: true},
+		{name: "X-Origin-Width", value: "wide"},
+		{name: "Server-Timing", value: "processing;dur=12.5, fetch;desc=\"source\";dur=7.5", want: 20, ok: true},
+		{name: "Server-Timing", value: "cache;desc=miss"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			got, ok := headerNumber(tt.name, tt.value)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("headerNumber = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUpstreamMetricHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		metric   string
+		want     headerStat
+		reaching map[string]bool
+	}{
+		{
+			name:     "defaults",
+			metric:   "X-Origin-Width",
+			want:     headerStat{Count: 2, Sum: 1600, Max: 1000},
+			reaching: map[string]bool{"X-Origin-Width": true, "X-Custom-Time": true},
+		},
+		{
+			name:     "server timing",
+			metric:   "Server-Timing",
+			want:     headerStat{Count: 2, Sum: 60, Max: 40},
+			reaching: map[string]bool{"Server-Timing": true},
+		},
+		{
+			name:     "configured",
+			env:      map[string]string{"UPSTREAM_METRIC_HEADERS": "x-custom-time"},
+			metric:   "X-Custom-Time",
+			want:     headerStat{Count: 2, Sum: 3, Max: 2},
+			reaching: map[string]bool{"X-Origin-Width": true, "X-Custom-Time": true},
+		},
+		{
+			name:     "stripped",
+			env:      map[string]string{"STRIP_UPSTREAM_METRIC_HEADERS": "true"},
+			metric:   "X-Origin-Width",
+			want:     headerStat{Count: 2, Sum: 1600, Max: 1000},
+			reaching: map[string]bool{"X-Origin-Width": false, "X-Custom-Time": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renders := []struct{ width, timing, custom string }{
+				{"600", "processing;dur=20", "1"},
+				{"1000", "processing;dur=30, fetch;dur=10", "2"},
+			}
+			var n int
+			e := newTestEnv(t, tt.env, func(w http.ResponseWriter, r *http.Request) {
+				h := renders[n%len(renders)]
+				n++
+				w.Header().Set("X-Origin-Width", h.width)
+				w.Header().Set("Server-Timing", h.timing)
+				w.Header().Set("X-Custom-Time", h.custom)
+				servePNG(w, r)
+			})
+			for _, src := range []string{"https://example.com/a.jpg", "https://example.com/b.jpg"} {
+				resp := e.get(renderPath(src))
+				for name, want := range tt.reaching {
+					if got := resp.Header.Get(name) != ""; got != want {
+						t.Errorf("%s reached the client = %v, want %v", name, got, want)
+					}
+				}
+			}
+
+			var stats statsSnapshot
+			if err := json.NewDecoder(e.get("/stats").Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if got := stats.UpstreamHeaders[tt.metric]; got != tt.want {
+				t.Errorf("upstream_headers[%s] = %+v, want %+v", tt.metric, got, tt.want)
+			}
+		})
+	}
+}
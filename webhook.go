@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// cacheEvent is posted to the webhook for every object written to the bucket
+type cacheEvent struct {
+	Key         string    `json:"key"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (ev cacheEvent) subject() string {
+	return ev.Key
+}
+
+// webhookEvent is anything posted to the webhook, its subject identifies it
+// in the logs
+type webhookEvent interface {
+	subject() string
+}
+
+const (
+	cacheEventAttempts = 3
+	cacheEventBackoff  = time.Second
+)
+
+// cacheEventNotifier delivers cache events to CACHE_EVENT_WEBHOOK_URL from a
+// bounded queue. Events are dropped when the queue is full so a slow receiver
+// never holds up serving.
+type cacheEventNotifier struct {
+	url    string
+	client *http.Client
+	queue  chan webhookEvent
+}
+
+func newCacheEventNotifier(cfg Config) *cacheEventNotifier {
+	return &cacheEventNotifier{
+		url:    cfg.CacheEventWebhookURL,
+		client: &http.Client{Timeout: cfg.CacheEventTimeout},
+		queue:  make(chan webhookEvent, cfg.CacheEventQueueSize),
+	}
+}
+
+func (n *cacheEventNotifier) notify(ev webhookEvent) {
+	if n.url == "" {
+		return
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		slog.Warn("Dropping cache event, queue is full", "key", ev.subject())
+	}
+}
+
+// run delivers queued events until ctx is done
+func (n *cacheEventNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			n.deliver(ctx, ev)
+		}
+	}
+}
+
+func (n *cacheEventNotifier) deliver(ctx context.Context, ev webhookEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Failed to encode cache event", "key", ev.subject(), "error", err)
+		return
+	}
+
+	backoff := cacheEventBackoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, payload)
+		if err == nil {
+			return
+		}
+		if attempt == cacheEventAttempts {
+			slog.Error("Failed to deliver cache event", "key", ev.subject(), "attempts", attempt, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *cacheEventNotifier) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBodySize))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
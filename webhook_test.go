@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookReceiver collects the events posted to it, failing the first
+// failures requests
+func webhookReceiver(t *testing.T, failures int) (*httptest.Server, <-chan []byte) {
+	received := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestCacheEventWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+	}{
+		{name: "delivered"},
+		{name: "retried", failures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook, received := webhookReceiver(t, tt.failures)
+			e := newTestEnv(t, map[string]string{"CACHE_EVENT_WEBHOOK_URL": hook.URL}, nil)
+			go e.srv.events.run(t.Context())
+
+			before := time.Now()
+			e.get(testImagePath)
+			var payload []byte
+			select {
+			case payload = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event received")
+			}
+			var ev cacheEvent
+			if err := json.Unmarshal(payload, &ev); err != nil {
+				t.Fatal(err)
+			}
+			keys := e.s3.keys(testBucket)
+			if len(keys) != 1 || ev.Key != keys[0] {
+				t.Errorf("key = %q, bucket has %v", ev.Key, keys)
+			}
+			if ev.Path != testImagePath || ev.Size != int64(len(testPNG)) || ev.ContentType != "image/png" {
+				t.Errorf("event = %+v", ev)
+			}
+			if ev.Timestamp.Before(before.Truncate(time.Second)) || ev.Timestamp.After(time.Now()) {
+				t.Errorf("timestamp = %v", ev.Timestamp)
+			}
+		})
+	}
+}
+
+func TestCacheEventWebhookNotOnFailedUpload(t *testing.T) {
+	hook, received := webhookReceiver(t, 0)
+	e := newTestEnv(t, map[string]string{"CACHE_EVENT_WEBHOOK_URL": hook.URL}, nil)
+	e.s3.setFail(func(r *http.Request) int { return http.StatusInternalServerError })
+	go e.srv.events.run(t.Context())
+
+	e.get(testImagePath)
+	select {
+	case payload := <-received:
+		t.Errorf("received %s for a failed upload", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCacheEventQueueBounded(t *testing.T) {
+	// Nothing delivers the queue, a full one mustn't block
+	n := newCacheEventNotifier(testConfig(t, map[string]string{
+		"CACHE_EVENT_WEBHOOK_URL": "http://webhook.invalid",
+		"CACHE_EVENT_QUEUE_SIZE":  "2",
+	}))
+	for range 5 {
+		n.notify(cacheEvent{Key: "k"})
+	}
+	if got := len(n.queue); got != 2 {
+		t.Errorf("%d events queued, want 2", got)
+	}
+}